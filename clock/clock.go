@@ -0,0 +1,69 @@
+// Package clock abstracts wall-clock time behind an interface so the
+// servers' timing behavior (failure detection, view expiry) can be
+// driven deterministically by a fake clock in tests.
+package clock
+
+import "time"
+
+// Ticker delivers ticks on C, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer delivers a single moment on C, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Clock tells time and makes tickers and timers. Production code
+// uses Real(); tests use clocktest.FakeClock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Real returns a Clock backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{t: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (rt *realTicker) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt *realTicker) Stop() {
+	rt.t.Stop()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (rt *realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt *realTimer) Stop() {
+	rt.t.Stop()
+}
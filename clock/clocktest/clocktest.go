@@ -0,0 +1,118 @@
+// Package clocktest provides a manually advanced clock.Clock for
+// deterministic timing tests.
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"dsdemo/clock"
+)
+
+// FakeClock implements clock.Clock. Time only moves when a test
+// calls Advance, which also fires any tickers that come due.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+// New returns a FakeClock reading start.
+func New(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and delivers a tick to every
+// ticker for each interval that elapsed. Ticks are dropped if the
+// receiver isn't keeping up, matching time.Ticker.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.ch <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.interval)
+		}
+	}
+	for _, t := range c.timers {
+		if !t.stopped && !t.fired && !t.when.After(c.now) {
+			t.fired = true
+			select {
+			case t.ch <- t.when:
+			default:
+			}
+		}
+	}
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clk:      c,
+		ch:       make(chan time.Time, 1),
+		interval: d,
+		next:     c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+type fakeTicker struct {
+	clk      *FakeClock
+	ch       chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	t.stopped = true
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		clk:  c,
+		ch:   make(chan time.Time, 1),
+		when: c.now.Add(d),
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+type fakeTimer struct {
+	clk     *FakeClock
+	ch      chan time.Time
+	when    time.Time
+	fired   bool
+	stopped bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	t.stopped = true
+}
@@ -0,0 +1,25 @@
+package cluster
+
+import "testing"
+
+// TestNewCluster brings up a two-server cluster over real localhost
+// TCP and checks that the returned client can write and read back.
+func TestNewCluster(t *testing.T) {
+	c, err := NewCluster(2)
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	defer c.Stop()
+
+	ck := c.Client()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "v" {
+		t.Fatalf("Get(k) = %q, want %q", got, "v")
+	}
+	// With two servers the view must have replicated the write.
+	if got := ck.GetStale("k"); got != "v" {
+		t.Fatalf("GetStale(k) = %q, want %q", got, "v")
+	}
+}
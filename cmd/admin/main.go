@@ -0,0 +1,140 @@
+// Command admin drives operator RPCs against a running cluster:
+// snapshot a KV server's contents to a file on its host, or restore
+// such a file into an idle server before it joins a view.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"dsdemo/kvservice"
+	"dsdemo/transport"
+	"dsdemo/viewservice"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: admin [-vs addr] [-secret s] <command> [args]
+
+commands:
+  snapshot <addr> <path>   write the server's contents to path on its host
+  restore <addr> <path>    load a snapshot file into an idle server
+  stepdown <addr>          hand the primary role to the backup cleanly
+  resync <addr>            make the primary re-stream its state to the backup
+  ack-dataloss [shard]     accept losing a shard's data so an empty
+                           server may replace its dead primary
+  describe                 print the current view and per-server stats
+`)
+	os.Exit(2)
+}
+
+func main() {
+	vsAddr := flag.String("vs", "127.0.0.1:9000", "view service address")
+	network := flag.String("network", "tcp", "network the cluster runs on: tcp or unix (addresses are socket paths)")
+	secret := flag.String("secret", "", "admin secret shared with the servers")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	tr := transport.Network(*network)
+	ck := kvservice.MakeClientWithConfig(kvservice.ClientConfig{Transport: tr}, *vsAddr)
+
+	switch args[0] {
+	case "snapshot":
+		if len(args) != 3 {
+			usage()
+		}
+		keys, err := ck.SnapshotTo(args[1], args[2], *secret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "snapshot failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("snapshot wrote %d keys to %s\n", keys, args[2])
+	case "restore":
+		if len(args) != 3 {
+			usage()
+		}
+		keys, err := ck.RestoreFrom(args[1], args[2], *secret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "restore failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("restore loaded %d keys from %s\n", keys, args[2])
+	case "stepdown":
+		if len(args) != 2 {
+			usage()
+		}
+		r, err := ck.StepDown(args[1], *secret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "stepdown failed:", err)
+			os.Exit(1)
+		}
+		if r.Queued {
+			fmt.Println("stepdown queued; the view service will apply it shortly")
+			return
+		}
+		fmt.Printf("view %d: primary=%q backup=%q\n", r.View.ViewNum, r.View.Primary, r.View.Backup)
+	case "resync":
+		if len(args) != 2 {
+			usage()
+		}
+		if err := ck.Resync(args[1], *secret); err != nil {
+			fmt.Fprintln(os.Stderr, "resync failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("backup resynced")
+	case "ack-dataloss":
+		shard := 0
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				usage()
+			}
+			shard = n
+		} else if len(args) != 1 {
+			usage()
+		}
+		vck := viewservice.MakeClerkWithTransport("", *vsAddr, tr)
+		if _, err := vck.AdminReassign(&viewservice.AdminReassignArgs{
+			Secret: *secret, Action: "ack-dataloss", Shard: shard,
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, "ack-dataloss failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("data loss on shard %d acknowledged\n", shard)
+	case "describe":
+		vck := viewservice.MakeClerkWithTransport("", *vsAddr, tr)
+		views, err := vck.GetShards()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "describe failed:", err)
+			os.Exit(1)
+		}
+		for i, v := range views {
+			fmt.Printf("shard %d: view %d primary=%q backup=%q\n", i, v.ViewNum, v.Primary, v.Backup)
+		}
+		servers, err := ck.ListServers()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "describe failed:", err)
+			os.Exit(1)
+		}
+		for _, s := range servers {
+			line := fmt.Sprintf("%-30s role=%-8s shard=%d alive=%-5v ping_age=%s",
+				s.Name, s.Role, s.Shard, s.Alive, s.PingAge.Round(time.Millisecond))
+			if s.Alive {
+				if st, err := ck.Stats(s.Name); err == nil {
+					line += fmt.Sprintf(" keys=%d approx_bytes=%d syncing=%v", st.Keys, st.ApproxBytes, st.Syncing)
+				} else {
+					line += " stats=unreachable"
+				}
+			}
+			fmt.Println(line)
+		}
+	default:
+		usage()
+	}
+}
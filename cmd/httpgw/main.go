@@ -0,0 +1,132 @@
+// Command httpgw is a JSON/HTTP gateway in front of the KV service,
+// for consumers that don't speak Go net/rpc:
+//
+//	GET    /kv/{key}   -> {"key":k,"value":v}, 404 if missing
+//	PUT    /kv/{key}   -> stores the request body as the value
+//	DELETE /kv/{key}   -> removes the key
+//
+// A single long-lived Client is shared across requests. Operations
+// that can't reach a primary within -timeout answer 503.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"dsdemo/kvservice"
+)
+
+var opTimeout time.Duration
+
+type result struct {
+	value  string
+	exists bool
+	err    error
+}
+
+// runWithTimeout runs op in the background and gives up after the
+// configured timeout; the KV client itself retries forever, so the
+// gateway imposes the deadline. A timed-out operation may still
+// complete server-side.
+func runWithTimeout(op func() result) (result, bool) {
+	done := make(chan result, 1)
+	go func() { done <- op() }()
+	select {
+	case r := <-done:
+		return r, true
+	case <-time.After(opTimeout):
+		return result{}, false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func handleKV(ck *kvservice.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/kv/")
+		if key == "" {
+			writeError(w, http.StatusBadRequest, "missing key")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			res, ok := runWithTimeout(func() result {
+				v, exists, _ := ck.GetOK(key)
+				return result{value: v, exists: exists}
+			})
+			if !ok {
+				writeError(w, http.StatusServiceUnavailable, "no primary available")
+				return
+			}
+			if !res.exists {
+				writeError(w, http.StatusNotFound, "no such key")
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"key": key, "value": res.value})
+
+		case http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "unreadable body")
+				return
+			}
+			res, ok := runWithTimeout(func() result {
+				return result{err: ck.Put(key, string(body))}
+			})
+			if !ok {
+				writeError(w, http.StatusServiceUnavailable, "no primary available")
+				return
+			}
+			if res.err != nil {
+				writeError(w, http.StatusRequestEntityTooLarge, res.err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"key": key})
+
+		case http.MethodDelete:
+			res, ok := runWithTimeout(func() result {
+				return result{err: ck.Delete(key)}
+			})
+			if !ok {
+				writeError(w, http.StatusServiceUnavailable, "no primary available")
+				return
+			}
+			if res.err != nil {
+				writeError(w, http.StatusRequestEntityTooLarge, res.err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"key": key})
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "address to serve HTTP on")
+	vs := flag.String("vs", "127.0.0.1:9000", "view service address")
+	flag.DurationVar(&opTimeout, "timeout", 5*time.Second, "per-operation timeout before answering 503")
+	flag.Parse()
+
+	ck := kvservice.MakeClient(*vs)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", handleKV(ck))
+
+	log.Printf("httpgw listening on %s (viewservice %s)", *addr, *vs)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -0,0 +1,75 @@
+// Command kvd runs a KV server. The view service decides whether it
+// acts as primary, backup or stays idle.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"dsdemo/clock"
+	"dsdemo/kvservice"
+	"dsdemo/transport"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9001", "address advertised to the view service and clients")
+	listen := flag.String("listen", "", "address to bind the listener to (defaults to -addr)")
+	network := flag.String("network", "tcp", "listen/dial network: tcp or unix (addresses are socket paths); all servers and clients must agree")
+	vs := flag.String("vs", "127.0.0.1:9000", "view service address")
+	dataDir := flag.String("data", "", "directory for on-disk storage (empty keeps data in memory)")
+	secret := flag.String("admin-secret", "", "shared secret for admin RPCs (empty leaves them open)")
+	maxKeys := flag.Int("max-keys", 0, "maximum number of keys to hold (0 = unlimited)")
+	snapFormat := flag.String("snapshot-format", "gob", "serialization for snapshot files (gob or json)")
+	compressAbove := flag.Int("compress-above", 0, "store values of at least this many bytes gzip-compressed (0 = off)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "drop client connections idle for this long (0 = never)")
+	verifyInterval := flag.Duration("verify-interval", 0, "compare checksums with the backup this often and re-sync on mismatch (0 = never)")
+	priority := flag.Int("priority", 0, "promotion preference; higher-priority servers reclaim the primary role when healthy")
+	backupOnly := flag.Bool("backup-only", false, "never take the primary role; the server still serves as a backup")
+	rateLimit := flag.Int("rate-limit", 0, "maximum client operations per second (0 = unlimited)")
+	requireBackup := flag.Bool("require-backup", false, "refuse writes while serving without a backup")
+	maxConns := flag.Int("max-conns", 0, "maximum concurrent client connections; excess ones are closed (0 = unlimited)")
+	deadLetter := flag.String("dead-letter", "", "append writes whose forward failed in lenient mode to this file as JSON lines")
+	dedupTTL := flag.Duration("dedup-ttl", 0, "forget duplicate-filter entries for clients idle this long; must exceed client retry windows (0 = never)")
+	tombstoneGrace := flag.Duration("tombstone-grace", 0, "keep soft-delete tombstones for deleted keys this long before reaping (0 = hard deletes)")
+	maxMsgBytes := flag.Int64("max-msg-bytes", 0, "close connections that send a single RPC message larger than this (0 = unlimited)")
+	slowRPC := flag.Duration("slow-rpc", 0, "log RPC handlers that run longer than this (0 = never)")
+	flag.Parse()
+
+	codec, ok := kvservice.CodecByName(*snapFormat)
+	if !ok {
+		log.Fatalf("unknown snapshot format %q", *snapFormat)
+	}
+
+	var store kvservice.Store = kvservice.NewMapStore()
+	if *dataDir != "" {
+		fs, err := kvservice.NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatal("opening file store: ", err)
+		}
+		store = fs
+	}
+	if *listen == "" {
+		*listen = *addr
+	}
+	kv := kvservice.StartServerWithTransport(*vs, *addr, *listen, clock.Real(), store, transport.Network(*network))
+	kv.SetAdminSecret(*secret)
+	kv.SetMaxKeys(*maxKeys)
+	kv.SetSnapshotCodec(codec)
+	kv.SetCompressionThreshold(*compressAbove)
+	kv.SetIdleTimeout(*idleTimeout)
+	kv.SetVerifyInterval(*verifyInterval)
+	kv.SetPriority(*priority)
+	kv.SetBackupOnly(*backupOnly)
+	kv.SetRateLimit(*rateLimit)
+	kv.SetRequireBackup(*requireBackup)
+	kv.SetMaxConns(*maxConns)
+	if err := kv.SetDeadLetterPath(*deadLetter); err != nil {
+		log.Fatal("opening dead-letter file: ", err)
+	}
+	kv.SetDedupTTL(*dedupTTL)
+	kv.SetTombstoneGrace(*tombstoneGrace)
+	kv.SetMaxMessageBytes(*maxMsgBytes)
+	kv.SetSlowRPCThreshold(*slowRPC)
+	log.Printf("kvserver %s reporting to viewservice %s", *addr, *vs)
+	select {}
+}
@@ -0,0 +1,39 @@
+// Command standalone runs a view service and a single KV server in
+// one process, for local development: the lone server is promoted to
+// primary immediately, so a client pointed at -vs works without
+// setting up a cluster.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"dsdemo/clock"
+	"dsdemo/kvservice"
+	"dsdemo/viewservice"
+)
+
+func main() {
+	vsAddr := flag.String("vs", "127.0.0.1:9000", "address for the view service")
+	kvAddr := flag.String("addr", "127.0.0.1:9001", "address for the KV server")
+	dataDir := flag.String("data", "", "directory for on-disk storage (empty keeps data in memory)")
+	secret := flag.String("admin-secret", "", "shared secret for admin RPCs (empty leaves them open)")
+	flag.Parse()
+
+	vs := viewservice.StartServer(*vsAddr)
+	vs.SetAdminSecret(*secret)
+
+	var store kvservice.Store = kvservice.NewMapStore()
+	if *dataDir != "" {
+		fs, err := kvservice.NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatal("opening file store: ", err)
+		}
+		store = fs
+	}
+	kv := kvservice.StartServerWithStore(*vsAddr, *kvAddr, clock.Real(), store)
+	kv.SetAdminSecret(*secret)
+
+	log.Printf("standalone: viewservice on %s, kvserver on %s", *vsAddr, *kvAddr)
+	select {}
+}
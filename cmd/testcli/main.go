@@ -0,0 +1,215 @@
+// Command testcli is a small command-line client for poking at a
+// running cluster: get/put keys, dump the view, probe server health.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"dsdemo/kvservice"
+	"dsdemo/viewservice"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: testcli [-vs addr] [-json] <command> [args]
+
+commands:
+  get <key>            fetch a value from the primary
+  put <key> <value>    store a value
+  inspect <key>        print when a key was last modified
+  view                 print the current view
+  history              print recent view changes with reasons
+  servers              list all servers known to the view service
+  health <addr>        probe a KV server's health RPC
+  stats <addr>         print a KV server's key count and byte size
+  verify               compare primary and backup state checksums
+`)
+	os.Exit(2)
+}
+
+// emitJSON prints v as one JSON object per line on stdout, for shell
+// pipelines and CI checks.
+func emitJSON(v interface{}) {
+	if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, "encoding json:", err)
+		os.Exit(1)
+	}
+}
+
+// fail reports an error and exits non-zero. In JSON mode the error
+// goes to stdout as {"error": ...} so pipelines see it in-band.
+func fail(jsonOut bool, context string, err error) {
+	if jsonOut {
+		emitJSON(map[string]string{"error": context + ": " + err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, context+":", err)
+	}
+	os.Exit(1)
+}
+
+func main() {
+	vsAddr := flag.String("vs", "127.0.0.1:9000", "view service address")
+	jsonOut := flag.Bool("json", false, "emit JSON instead of free-form text (get, put, view, servers)")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	ck := kvservice.MakeClient(*vsAddr)
+
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			usage()
+		}
+		if *jsonOut {
+			value, exists, err := ck.GetOK(args[1])
+			if err != nil {
+				fail(true, "get", err)
+			}
+			emitJSON(struct {
+				Key    string `json:"key"`
+				Value  string `json:"value"`
+				Exists bool   `json:"exists"`
+			}{args[1], value, exists})
+			return
+		}
+		fmt.Println(ck.Get(args[1]))
+	case "put":
+		if len(args) != 3 {
+			usage()
+		}
+		if err := ck.Put(args[1], args[2]); err != nil {
+			fail(*jsonOut, "put", err)
+		}
+		if *jsonOut {
+			emitJSON(struct {
+				Key string `json:"key"`
+				OK  bool   `json:"ok"`
+			}{args[1], true})
+			return
+		}
+		fmt.Println("OK")
+	case "inspect":
+		if len(args) != 2 {
+			usage()
+		}
+		meta, exists, err := ck.Inspect(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "inspect:", err)
+			os.Exit(1)
+		}
+		if !exists {
+			fmt.Fprintln(os.Stderr, "no such key")
+			os.Exit(1)
+		}
+		fmt.Printf("mod_view=%d mod_time=%s\n", meta.ModView, meta.ModTime.Format(time.RFC3339Nano))
+	case "view":
+		vck := viewservice.MakeClerk("", *vsAddr)
+		v, ok := vck.Get()
+		if !ok {
+			fail(*jsonOut, "view", fmt.Errorf("view service unreachable"))
+		}
+		if *jsonOut {
+			emitJSON(struct {
+				ViewNum uint   `json:"view_num"`
+				Primary string `json:"primary"`
+				Backup  string `json:"backup"`
+			}{v.ViewNum, v.Primary, v.Backup})
+			return
+		}
+		fmt.Printf("view %d: primary=%q backup=%q\n", v.ViewNum, v.Primary, v.Backup)
+	case "history":
+		vck := viewservice.MakeClerk("", *vsAddr)
+		entries, err := vck.GetViewHistory()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "history:", err)
+			os.Exit(1)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s view %d: primary=%q backup=%q — %s\n",
+				e.Time.Format(time.RFC3339), e.View.ViewNum, e.View.Primary, e.View.Backup, e.Reason)
+		}
+	case "servers":
+		servers, err := ck.ListServers()
+		if err != nil {
+			fail(*jsonOut, "servers", err)
+		}
+		if *jsonOut {
+			type server struct {
+				Name      string `json:"name"`
+				Role      string `json:"role"`
+				Shard     int    `json:"shard"`
+				Alive     bool   `json:"alive"`
+				PingAgeMS int64  `json:"ping_age_ms"`
+			}
+			out := make([]server, 0, len(servers))
+			for _, s := range servers {
+				out = append(out, server{s.Name, s.Role, s.Shard, s.Alive, s.PingAge.Milliseconds()})
+			}
+			emitJSON(out)
+			return
+		}
+		for _, s := range servers {
+			fmt.Printf("%-30s role=%-8s alive=%-5v ping_age=%s\n", s.Name, s.Role, s.Alive, s.PingAge.Round(time.Millisecond))
+		}
+	case "verify":
+		vck := viewservice.MakeClerk("", *vsAddr)
+		v, ok := vck.Get()
+		if !ok {
+			fmt.Fprintln(os.Stderr, "view service unreachable")
+			os.Exit(1)
+		}
+		if v.Primary == "" || v.Backup == "" {
+			fmt.Fprintln(os.Stderr, "need both a primary and a backup to verify")
+			os.Exit(1)
+		}
+		p, err := ck.VerifyState(v.Primary)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "primary verify failed:", err)
+			os.Exit(1)
+		}
+		b, err := ck.VerifyState(v.Backup)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "backup verify failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("primary %016x (%d keys)\nbackup  %016x (%d keys)\n", p.Checksum, p.Keys, b.Checksum, b.Keys)
+		if p.Checksum != b.Checksum {
+			fmt.Println("MISMATCH")
+			os.Exit(1)
+		}
+		fmt.Println("match")
+	case "stats":
+		if len(args) != 2 {
+			usage()
+		}
+		s, err := ck.Stats(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "stats failed:", err)
+			os.Exit(1)
+		}
+		limit := "unlimited"
+		if s.MaxKeys > 0 {
+			limit = fmt.Sprint(s.MaxKeys)
+		}
+		fmt.Printf("keys=%d approx_bytes=%d max_keys=%s\n", s.Keys, s.ApproxBytes, limit)
+	case "health":
+		if len(args) != 2 {
+			usage()
+		}
+		h, err := ck.Ping(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "health probe failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("role=%s alive=%v view=%d\n", h.Role, h.Alive, h.ViewNum)
+	default:
+		usage()
+	}
+}
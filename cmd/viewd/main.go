@@ -0,0 +1,33 @@
+// Command viewd runs the view service.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"dsdemo/clock"
+	"dsdemo/transport"
+	"dsdemo/viewservice"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "address to listen on (a socket path with -network unix)")
+	network := flag.String("network", "tcp", "listen network: tcp or unix; all servers and clients must agree")
+	adminSecret := flag.String("admin-secret", "", "shared secret for admin RPCs (empty leaves them open)")
+	shards := flag.Int("shards", 1, "number of primary/backup pairs to split the key space over")
+	idleTimeout := flag.Duration("idle-timeout", 0, "drop client connections idle for this long (0 = never)")
+	maxConns := flag.Int("max-conns", 0, "maximum concurrent client connections; excess ones are closed (0 = unlimited)")
+	maxMsgBytes := flag.Int64("max-msg-bytes", 0, "close connections that send a single RPC message larger than this (0 = unlimited)")
+	flag.Parse()
+
+	vs := viewservice.StartServerWithTransport(*addr, clock.Real(), transport.Network(*network))
+	if err := vs.SetNumShards(*shards); err != nil {
+		log.Fatal("configuring shards: ", err)
+	}
+	vs.SetAdminSecret(*adminSecret)
+	vs.SetIdleTimeout(*idleTimeout)
+	vs.SetMaxConns(*maxConns)
+	vs.SetMaxMessageBytes(*maxMsgBytes)
+	log.Printf("viewservice listening on %s (%s)", *addr, *network)
+	select {}
+}
@@ -0,0 +1,3 @@
+module dsdemo
+
+go 1.21
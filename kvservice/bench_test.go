@@ -0,0 +1,120 @@
+package kvservice
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"dsdemo/viewservice"
+)
+
+// reserveAddr picks an ephemeral port for a benchmark server. The
+// listener is closed again so the server can bind the same address;
+// the small reuse race doesn't matter for local benchmarks.
+func reserveAddr(b *testing.B) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("reserve port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// startBenchCluster spins up a view service and one or two KV
+// servers on ephemeral ports, waits for a stable view (backup synced
+// if requested) and returns a ready client. Benchmarks run against
+// real wall-clock servers, so setup takes a few ping intervals.
+func startBenchCluster(b *testing.B, withBackup bool) *Client {
+	vsAddr := reserveAddr(b)
+	vs := viewservice.StartServer(vsAddr)
+	b.Cleanup(vs.Kill)
+
+	n := 1
+	if withBackup {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		kv := StartServer(vsAddr, reserveAddr(b))
+		b.Cleanup(kv.Kill)
+	}
+
+	vck := viewservice.MakeClerk("", vsAddr)
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		if v, ok := vck.Get(); ok && v.Primary != "" && (!withBackup || v.Backup != "") {
+			break
+		}
+		if time.Now().After(deadline) {
+			b.Fatal("view never stabilized")
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	ck := MakeClient(vsAddr)
+	// A successful warm-up write proves the primary holds its lease
+	// and any state transfer has finished.
+	if err := ck.Put("bench-warmup", "1"); err != nil {
+		b.Fatalf("warm-up Put: %v", err)
+	}
+	return ck
+}
+
+// runTimed measures op b.N times and reports throughput and p99
+// latency alongside the usual ns/op.
+func runTimed(b *testing.B, op func(i int)) {
+	lat := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		t0 := time.Now()
+		op(i)
+		lat = append(lat, time.Since(t0))
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	p99 := lat[len(lat)*99/100]
+	if len(lat)*99/100 >= len(lat) {
+		p99 = lat[len(lat)-1]
+	}
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "ops/s")
+	b.ReportMetric(float64(p99.Nanoseconds()), "p99-ns")
+}
+
+// Benchmark_Put measures writes against a lone primary.
+func Benchmark_Put(b *testing.B) {
+	ck := startBenchCluster(b, false)
+	runTimed(b, func(i int) {
+		if err := ck.Put("bench-key", fmt.Sprint(i)); err != nil {
+			b.Fatalf("Put: %v", err)
+		}
+	})
+}
+
+// Benchmark_Get measures reads against a lone primary.
+func Benchmark_Get(b *testing.B) {
+	ck := startBenchCluster(b, false)
+	if err := ck.Put("bench-key", "v"); err != nil {
+		b.Fatalf("Put: %v", err)
+	}
+	runTimed(b, func(i int) {
+		ck.Get("bench-key")
+	})
+}
+
+// Benchmark_PutWithBackup measures writes when every Put is also
+// forwarded to a backup, making the per-write forwarding cost (and
+// any regression back to dial-per-write) stand out against
+// Benchmark_Put.
+func Benchmark_PutWithBackup(b *testing.B) {
+	ck := startBenchCluster(b, true)
+	runTimed(b, func(i int) {
+		if err := ck.Put("bench-key", fmt.Sprint(i)); err != nil {
+			b.Fatalf("Put: %v", err)
+		}
+	})
+}
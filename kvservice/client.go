@@ -0,0 +1,1541 @@
+package kvservice
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"dsdemo/transport"
+	"dsdemo/viewservice"
+)
+
+// DefaultCallTimeout bounds each individual RPC attempt, so a hung
+// (but not dead) server can't stall a caller indefinitely. A timed
+// out attempt counts as a retryable transport failure.
+const DefaultCallTimeout = 3 * time.Second
+
+var errCallTimeout = errors.New("kvservice: rpc call timed out")
+
+// ErrClosed is returned by operations issued after Close, and by
+// in-flight operations whose retry loop Close interrupted.
+var ErrClosed = errors.New("kvservice: client is closed")
+
+// ErrUnsupported is returned when the server answers that it does
+// not implement the requested RPC — typically a newer client talking
+// to an older binary. The server is healthy, so retrying the same
+// call would loop forever; the caller gets the error immediately.
+var ErrUnsupported = errors.New("kvservice: server does not implement this RPC")
+
+// errNoPrimary is the retryable "no primary connection" failure.
+var errNoPrimary = errors.New("kvservice: no primary known")
+
+// ErrViewService reports that no configured view service address
+// answered a view refresh.
+var ErrViewService = errors.New("kvservice: view service unreachable")
+
+// ErrCircuitOpen is returned while the client's circuit breaker is
+// open: the cluster has failed too many calls in a row and the
+// client is waiting out a cooldown instead of hammering it.
+var ErrCircuitOpen = errors.New("kvservice: circuit breaker is open")
+
+// DefaultBreakerCooldown is how long an opened circuit breaker waits
+// before letting a probe through.
+const DefaultBreakerCooldown = 5 * time.Second
+
+// ClientConfig tunes a Client beyond the defaults. The zero value of
+// each field keeps the default behavior.
+type ClientConfig struct {
+	// CallTimeout bounds each RPC attempt; DefaultCallTimeout if 0.
+	CallTimeout time.Duration
+	// BreakerThreshold is how many consecutive failed calls open the
+	// circuit breaker. 0 disables the breaker, keeping the classic
+	// retry-forever behavior.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a
+	// single probe is allowed; DefaultBreakerCooldown if 0.
+	BreakerCooldown time.Duration
+	// Transport is how the client dials servers; nil means TCP.
+	// Tests substitute transporttest.Network to run without real
+	// sockets.
+	Transport transport.Transport
+	// CacheSize enables a client-side LRU read cache holding up to
+	// this many keys; 0 (the default) disables caching. Cached reads
+	// can be stale: the cache reflects this client's own writes but
+	// not other clients', until the entry is evicted or the view
+	// changes. Every view change drops the whole cache, since a
+	// failover may have lost writes the cache still remembers. Use
+	// GetLinearizable for reads that must not be stale.
+	CacheSize int
+}
+
+// isUnsupported reports whether err is net/rpc's reply for a method
+// the server doesn't implement. It is a ServerError (the server
+// answered), not a transport failure, so the connection is fine but
+// no retry can succeed. A dropped connection (rpc.ErrShutdown)
+// deliberately stays retryable: it says nothing about what the
+// server implements.
+func isUnsupported(err error) bool {
+	se, ok := err.(rpc.ServerError)
+	if !ok {
+		return false
+	}
+	s := string(se)
+	return strings.Contains(s, "can't find method") || strings.Contains(s, "can't find service")
+}
+
+// dialTimeout dials an RPC server over tr with a bounded connect
+// time.
+func dialTimeout(tr transport.Transport, srv string, d time.Duration) (*rpc.Client, error) {
+	conn, err := tr.Dial(srv, d)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// callWithTimeout issues one RPC and abandons it after d. The caller
+// should drop the connection after a timeout, since the abandoned
+// call may still complete on it later.
+func callWithTimeout(c *rpc.Client, rpcname string, args interface{}, reply interface{}, d time.Duration) error {
+	call := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case done := <-call.Done:
+		return done.Error
+	case <-t.C:
+		return errCallTimeout
+	}
+}
+
+// Client is the application-facing handle on the key/value service.
+// It tracks the current primary and retries operations through view
+// changes until they succeed.
+type Client struct {
+	mu      sync.Mutex
+	vsAddrs []string    // view service addresses, tried in rotation
+	vsIndex int         // index of the address ck.vs points at
+	vs      *rpc.Client // cached connection to the view service
+	// view is the full view the last refresh returned; the primary
+	// and backup the client routes to live here.
+	view viewservice.View
+	// primaryClient is a cached connection to the primary, redialed
+	// lazily; a transient call failure retries it once before the
+	// client falls back to a view refresh.
+	primaryClient *rpc.Client
+	id            int64
+	seq           int64
+	callTimeout   time.Duration
+	lastView      uint // view number reported by the last successful op
+	tr            transport.Transport
+	// shard is which shard's view this client follows; 0 (the whole
+	// key space) unless the client belongs to a ShardedClient.
+	shard int
+
+	// onViewChange, when set, is told whenever a view refresh returns
+	// a view number not seen before; see SetOnViewChange.
+	onViewChange func(viewservice.View)
+
+	// done is closed by Close; retry loops and in-flight calls select
+	// on it so they return ErrClosed promptly instead of retrying
+	// forever against a cluster the caller has given up on.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Circuit breaker state (configured via ClientConfig): after
+	// breakerThreshold consecutive failed calls the breaker opens for
+	// breakerCooldown and operations fail fast with ErrCircuitOpen;
+	// then a single probe (probing) tests whether the cluster is
+	// back. breakerThreshold 0 disables the breaker.
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	failures         int
+	openUntil        time.Time
+	probing          bool
+
+	// Read cache (configured via ClientConfig.CacheSize): an LRU map
+	// of recently fetched values, dropped wholesale whenever the
+	// reported view number moves. cacheSize 0 disables it.
+	cacheSize int
+	cache     map[string]*list.Element
+	cacheLRU  *list.List // front is most recently used
+}
+
+// cacheEntry is one LRU element: the key rides along so eviction can
+// find the map entry.
+type cacheEntry struct {
+	key   string
+	value string
+}
+
+// nrand picks a random client ID for duplicate detection.
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+// MakeClient returns a client that discovers the primary through the
+// view service. Several view service addresses may be given (e.g.
+// when discovery sits behind rotating DNS); the client fails over
+// between them.
+func MakeClient(vsAddrs ...string) *Client {
+	return &Client{
+		vsAddrs:     vsAddrs,
+		id:          nrand(),
+		callTimeout: DefaultCallTimeout,
+		done:        make(chan struct{}),
+		tr:          transport.Real(),
+	}
+}
+
+// MakeClientWithConfig is MakeClient with explicit tuning, e.g. to
+// enable the circuit breaker.
+func MakeClientWithConfig(cfg ClientConfig, vsAddrs ...string) *Client {
+	ck := MakeClient(vsAddrs...)
+	if cfg.CallTimeout > 0 {
+		ck.callTimeout = cfg.CallTimeout
+	}
+	ck.breakerThreshold = cfg.BreakerThreshold
+	ck.breakerCooldown = cfg.BreakerCooldown
+	if ck.breakerCooldown <= 0 {
+		ck.breakerCooldown = DefaultBreakerCooldown
+	}
+	if cfg.Transport != nil {
+		ck.tr = cfg.Transport
+	}
+	if cfg.CacheSize > 0 {
+		ck.cacheSize = cfg.CacheSize
+		ck.cache = make(map[string]*list.Element, cfg.CacheSize)
+		ck.cacheLRU = list.New()
+	}
+	return ck
+}
+
+// cacheGet returns the cached value for key, refreshing its LRU
+// position. The second result is false on a miss or when caching is
+// disabled.
+func (ck *Client) cacheGet(key string) (string, bool) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	e, ok := ck.cache[key]
+	if !ok {
+		return "", false
+	}
+	ck.cacheLRU.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// cachePut stores or refreshes a cached value, evicting the least
+// recently used entry when full. No-op when caching is disabled.
+func (ck *Client) cachePut(key, value string) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.cacheSize == 0 {
+		return
+	}
+	if e, ok := ck.cache[key]; ok {
+		e.Value.(*cacheEntry).value = value
+		ck.cacheLRU.MoveToFront(e)
+		return
+	}
+	if ck.cacheLRU.Len() >= ck.cacheSize {
+		oldest := ck.cacheLRU.Back()
+		ck.cacheLRU.Remove(oldest)
+		delete(ck.cache, oldest.Value.(*cacheEntry).key)
+	}
+	ck.cache[key] = ck.cacheLRU.PushFront(&cacheEntry{key: key, value: value})
+}
+
+// cacheDelete drops one key from the cache.
+func (ck *Client) cacheDelete(key string) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if e, ok := ck.cache[key]; ok {
+		ck.cacheLRU.Remove(e)
+		delete(ck.cache, key)
+	}
+}
+
+// cacheClearLocked empties the cache; called on view changes, since
+// a failover may have lost writes the cache still remembers. Caller
+// must hold ck.mu.
+func (ck *Client) cacheClearLocked() {
+	if ck.cacheSize == 0 || len(ck.cache) == 0 {
+		return
+	}
+	ck.cache = make(map[string]*list.Element, ck.cacheSize)
+	ck.cacheLRU.Init()
+}
+
+// breakerCheck gates an operation on the circuit breaker: nil when
+// the call may proceed (including the single half-open probe once
+// the cooldown has passed), ErrCircuitOpen while it is open.
+func (ck *Client) breakerCheck() error {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.breakerThreshold <= 0 || ck.failures < ck.breakerThreshold {
+		return nil
+	}
+	if time.Now().Before(ck.openUntil) || ck.probing {
+		return ErrCircuitOpen
+	}
+	// Half-open: this caller probes; everyone else keeps failing
+	// fast until the probe's outcome is known.
+	ck.probing = true
+	return nil
+}
+
+// breakerRecord feeds one call outcome into the circuit breaker.
+func (ck *Client) breakerRecord(ok bool) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.breakerThreshold <= 0 {
+		return
+	}
+	if ok {
+		ck.failures = 0
+		ck.probing = false
+		return
+	}
+	ck.failures++
+	if ck.failures >= ck.breakerThreshold {
+		ck.openUntil = time.Now().Add(ck.breakerCooldown)
+		ck.probing = false
+	}
+}
+
+// Close releases the client's cached connections and cancels
+// in-flight operations, which return ErrClosed. The client must not
+// be used afterwards.
+func (ck *Client) Close() {
+	ck.closeOnce.Do(func() { close(ck.done) })
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.vs != nil {
+		ck.vs.Close()
+		ck.vs = nil
+	}
+	if ck.primaryClient != nil {
+		ck.primaryClient.Close()
+		ck.primaryClient = nil
+	}
+}
+
+// closed reports whether Close has been called.
+func (ck *Client) closed() bool {
+	select {
+	case <-ck.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep pauses between retries, cut short when the client is closed.
+func (ck *Client) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ck.done:
+	case <-t.C:
+	}
+}
+
+// SetCallTimeout adjusts how long each individual RPC attempt may
+// take before it is abandoned and retried.
+func (ck *Client) SetCallTimeout(d time.Duration) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.callTimeout = d
+}
+
+func (ck *Client) timeout() time.Duration {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.callTimeout
+}
+
+// call dials srv over tr, issues a single RPC and hangs up. Both the
+// dial and the call are bounded by DefaultCallTimeout. It returns
+// false if anything went wrong.
+func call(tr transport.Transport, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	c, err := dialTimeout(tr, srv, DefaultCallTimeout)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	return callWithTimeout(c, rpcname, args, reply, DefaultCallTimeout) == nil
+}
+
+// ensureVSClient returns a live connection to a view service,
+// dialing the configured addresses in rotation until one answers.
+// Caller must hold ck.mu.
+func (ck *Client) ensureVSClient() *rpc.Client {
+	if ck.vs != nil {
+		return ck.vs
+	}
+	for i := 0; i < len(ck.vsAddrs); i++ {
+		ck.vsIndex = (ck.vsIndex + 1) % len(ck.vsAddrs)
+		c, err := dialTimeout(ck.tr, ck.vsAddrs[ck.vsIndex], ck.callTimeout)
+		if err == nil {
+			ck.vs = c
+			return c
+		}
+	}
+	return nil
+}
+
+// RefreshView makes the client re-discover the primary right now
+// instead of waiting for a failed call to trigger it — useful when
+// the application knows a failover just happened, say after a
+// planned maintenance event. It returns ErrViewService when no view
+// service answered; a nil return means the client's view is current,
+// though the cluster may still be between primaries.
+func (ck *Client) RefreshView() error {
+	return ck.refreshPrimary()
+}
+
+// refreshPrimary asks the view service who the primary is now. It
+// returns ErrViewService when no configured address answered.
+func (ck *Client) refreshPrimary() error {
+	ck.mu.Lock()
+	// The view-change callback fires after the mutex is released, so
+	// it can call back into the client without deadlocking.
+	var notify func(viewservice.View)
+	var newView viewservice.View
+	defer func() {
+		if notify != nil {
+			notify(newView)
+		}
+	}()
+	defer ck.mu.Unlock()
+
+	c := ck.ensureVSClient()
+	if c == nil {
+		return ErrViewService
+	}
+	var reply viewservice.GetReply
+	if err := callWithTimeout(c, "ViewServer.Get", &viewservice.GetArgs{}, &reply, ck.callTimeout); err != nil {
+		// The cached connection may predate a view service restart —
+		// under a stable DNS name the address often points at a new
+		// process or host now. Dialing afresh re-resolves it, so try
+		// once more on a new connection instead of assuming the old
+		// one can be revived.
+		ck.vs.Close()
+		ck.vs = nil
+		if c = ck.ensureVSClient(); c == nil {
+			return ErrViewService
+		}
+		if err := callWithTimeout(c, "ViewServer.Get", &viewservice.GetArgs{}, &reply, ck.callTimeout); err != nil {
+			ck.vs.Close()
+			ck.vs = nil
+			return ErrViewService
+		}
+	}
+	v := reply.View
+	if ck.shard > 0 && ck.shard < len(reply.Shards) {
+		v = reply.Shards[ck.shard]
+	}
+	if v.Primary != ck.view.Primary && ck.primaryClient != nil {
+		ck.primaryClient.Close()
+		ck.primaryClient = nil
+	}
+	if v.ViewNum != ck.view.ViewNum {
+		// A failover may have lost writes the cache still remembers;
+		// reads must go back to the new primary rather than serve
+		// values from the old world.
+		ck.cacheClearLocked()
+		if ck.onViewChange != nil {
+			notify, newView = ck.onViewChange, v
+		}
+	}
+	ck.view = v
+	return nil
+}
+
+// CurrentView returns the view the client most recently learned from
+// the view service — a cached copy, possibly behind the cluster. Call
+// RefreshView first for a fresh one.
+func (ck *Client) CurrentView() viewservice.View {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.view
+}
+
+// SetOnViewChange installs a hook that is told whenever a view
+// refresh observes a view number the client has not seen before. It
+// runs on whichever goroutine triggered the refresh, with the
+// client's mutex released, so it may call back into the client. nil
+// removes the hook.
+func (ck *Client) SetOnViewChange(f func(viewservice.View)) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.onViewChange = f
+}
+
+// WaitForPrimary blocks until the view service reports a primary,
+// polling once per ping interval, so applications starting alongside
+// the cluster can hold off serving traffic until the store is
+// usable. It returns ctx's error if the context ends first, or
+// ErrClosed if the client is closed while waiting.
+func (ck *Client) WaitForPrimary(ctx context.Context) error {
+	t := time.NewTicker(viewservice.PingInterval)
+	defer t.Stop()
+	for {
+		ck.refreshPrimary()
+		if ck.currentPrimary() != "" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ck.done:
+			return ErrClosed
+		case <-t.C:
+		}
+	}
+}
+
+// WaitForStableView is WaitForPrimary with a stricter bar: the
+// primary must also have acked its view. During an unacked
+// transition the listed primary may be about to be replaced, so
+// cautious applications hold writes until this returns.
+func (ck *Client) WaitForStableView(ctx context.Context) error {
+	t := time.NewTicker(viewservice.PingInterval)
+	defer t.Stop()
+	for {
+		if ck.stableView() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ck.done:
+			return ErrClosed
+		case <-t.C:
+		}
+	}
+}
+
+// stableView asks the view service whether the current view has a
+// primary that has acked it.
+func (ck *Client) stableView() bool {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	c := ck.ensureVSClient()
+	if c == nil {
+		return false
+	}
+	var reply viewservice.GetReply
+	if err := callWithTimeout(c, "ViewServer.Get", &viewservice.GetArgs{}, &reply, ck.callTimeout); err != nil {
+		ck.vs.Close()
+		ck.vs = nil
+		return false
+	}
+	return reply.View.Primary != "" && reply.PrimaryAcked
+}
+
+// primaryConn returns the cached connection to the primary, dialing
+// one if needed. It returns nil when no primary is known.
+func (ck *Client) primaryConn() *rpc.Client {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.primaryClient == nil && ck.view.Primary != "" {
+		if c, err := dialTimeout(ck.tr, ck.view.Primary, ck.callTimeout); err == nil {
+			ck.primaryClient = c
+		}
+	}
+	return ck.primaryClient
+}
+
+// dropPrimaryConn discards a connection that produced an error, if
+// it is still the cached one.
+func (ck *Client) dropPrimaryConn(c *rpc.Client) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.primaryClient == c {
+		c.Close()
+		ck.primaryClient = nil
+	}
+}
+
+// callPrimary issues an RPC on the cached primary connection. On a
+// transport error it redials the same primary once before giving up,
+// so a dropped connection doesn't cost a GetView round trip; only a
+// genuine role error (reported in the reply) should make callers
+// refresh the view. It returns nil on success, ErrClosed or
+// ErrUnsupported for failures retrying cannot fix, and some other
+// error for retryable transport failures.
+func (ck *Client) callPrimary(rpcname string, args interface{}, reply interface{}) error {
+	err := errNoPrimary
+	for attempt := 0; attempt < 2; attempt++ {
+		c := ck.primaryConn()
+		if c == nil {
+			ck.breakerRecord(false)
+			return errNoPrimary
+		}
+		// Like callWithTimeout, but also abandoned when the client is
+		// closed so Close cancels a call already in flight.
+		call := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+		t := time.NewTimer(ck.timeout())
+		select {
+		case done := <-call.Done:
+			err = done.Error
+		case <-t.C:
+			err = errCallTimeout
+		case <-ck.done:
+			err = ErrClosed
+		}
+		t.Stop()
+		if err == nil {
+			ck.breakerRecord(true)
+			return nil
+		}
+		if isUnsupported(err) {
+			// The server answered, so the cluster is reachable; the
+			// breaker only cares about transport-level failures.
+			ck.breakerRecord(true)
+			return ErrUnsupported
+		}
+		ck.dropPrimaryConn(c)
+		if err == ErrClosed || ck.closed() {
+			return ErrClosed
+		}
+	}
+	ck.breakerRecord(false)
+	return err
+}
+
+// LastView returns the view number the server reported for this
+// client's most recent successful Get or Put, so an application can
+// detect a failover between two operations.
+func (ck *Client) LastView() uint {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.lastView
+}
+
+func (ck *Client) setLastView(v uint) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if v != ck.lastView {
+		ck.cacheClearLocked()
+	}
+	ck.lastView = v
+}
+
+func (ck *Client) currentPrimary() string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.view.Primary
+}
+
+func (ck *Client) currentBackup() string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.view.Backup
+}
+
+// get fetches the value for key, from the read cache when one is
+// configured and holds the key, else from the primary with retries
+// through failures and view changes. It returns OK or ErrNoKey, or
+// ErrClosed if the client was closed while retrying.
+func (ck *Client) get(key string) (string, Err, error) {
+	if value, ok := ck.cacheGet(key); ok {
+		return value, OK, nil
+	}
+	reply, err := ck.getWith(&GetArgs{Key: key})
+	if err != nil {
+		return "", "", err
+	}
+	if reply.Err == OK {
+		ck.cachePut(key, reply.Value)
+	}
+	return reply.Value, reply.Err, nil
+}
+
+func (ck *Client) getWith(args *GetArgs) (*GetReply, error) {
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return nil, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return nil, err
+		}
+		var reply GetReply
+		err := ck.callPrimary("KVServer.Get", args, &reply)
+		if err == nil && (reply.Err == OK || reply.Err == ErrNoKey) {
+			ck.setLastView(reply.ViewNum)
+			return &reply, nil
+		}
+		if err == nil && reply.Err == ErrRateLimited {
+			// The primary is healthy, just shedding load; back off
+			// without a pointless view refresh.
+			ck.sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		if err == ErrUnsupported {
+			return nil, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// Get fetches the value for key, retrying through failures and view
+// changes until it gets an answer. A missing key reads as ""; use
+// GetOK to tell the two apart.
+func (ck *Client) Get(key string) string {
+	value, _, _ := ck.get(key)
+	return value
+}
+
+// GetOK is Get but reports whether the key existed: exists is false
+// only when the primary answered ErrNoKey, so a key explicitly set
+// to "" is distinguishable from a missing one.
+func (ck *Client) GetOK(key string) (value string, exists bool, err error) {
+	value, e, err := ck.get(key)
+	if err != nil {
+		return "", false, err
+	}
+	if e == ErrNoKey {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+// GetLinearizable is GetOK with a read barrier: the primary must
+// re-confirm its leadership with the view service before answering,
+// so the value can never come from a deposed primary still inside
+// its fencing window.
+func (ck *Client) GetLinearizable(key string) (value string, exists bool, err error) {
+	reply, err := ck.getWith(&GetArgs{Key: key, Linearizable: true})
+	if err != nil {
+		return "", false, err
+	}
+	if reply.Err == ErrNoKey {
+		return "", false, nil
+	}
+	return reply.Value, true, nil
+}
+
+// GetBytes is GetOK for binary values: the reply carries the value
+// in ValueBytes, which gob decodes without the copy a string
+// conversion costs on large blobs. It bypasses the read cache, which
+// holds strings.
+func (ck *Client) GetBytes(key string) ([]byte, bool, error) {
+	reply, err := ck.getWith(&GetArgs{Key: key, Bytes: true})
+	if err != nil {
+		return nil, false, err
+	}
+	if reply.Err == ErrNoKey {
+		return nil, false, nil
+	}
+	if reply.ValueBytes != nil {
+		return reply.ValueBytes, true, nil
+	}
+	// A server from before ValueBytes answered in Value.
+	return []byte(reply.Value), true, nil
+}
+
+// GetVersioned fetches key's value together with its per-key
+// sequence number, for use with PutIfVersion. A missing key returns
+// ("", 0, nil) — passing that sequence to PutIfVersion makes the
+// write succeed only if the key is still absent. It bypasses the
+// read cache, since a cached value's sequence is unknown.
+func (ck *Client) GetVersioned(key string) (string, uint64, error) {
+	args := &GetVersionedArgs{Key: key}
+	for {
+		if ck.closed() {
+			return "", 0, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return "", 0, err
+		}
+		var reply GetVersionedReply
+		err := ck.callPrimary("KVServer.GetVersioned", args, &reply)
+		if err == nil && (reply.Err == OK || reply.Err == ErrNoKey) {
+			ck.setLastView(reply.ViewNum)
+			return reply.Value, reply.Seq, nil
+		}
+		if err == ErrUnsupported {
+			return "", 0, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// Exists reports whether key is set without fetching its value — the
+// cheap way to probe for large values. It retries through failures
+// and view changes like Get, and bypasses the read cache.
+func (ck *Client) Exists(key string) (bool, error) {
+	args := &ExistsArgs{Key: key}
+	for {
+		if ck.closed() {
+			return false, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return false, err
+		}
+		var reply ExistsReply
+		err := ck.callPrimary("KVServer.Exists", args, &reply)
+		if err == nil && reply.Err == OK {
+			ck.setLastView(reply.ViewNum)
+			return reply.Exists, nil
+		}
+		if err == ErrUnsupported {
+			return false, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// GetMany fetches several keys in one round trip, retrying through
+// failures and view changes. Absent keys are omitted from the result
+// map; the present ones form a consistent point-in-time read.
+func (ck *Client) GetMany(keys []string) (map[string]string, error) {
+	args := &GetManyArgs{Keys: keys}
+	for {
+		if ck.closed() {
+			return nil, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return nil, err
+		}
+		var reply GetManyReply
+		err := ck.callPrimary("KVServer.GetMany", args, &reply)
+		if err == nil && reply.Err == OK {
+			ck.setLastView(reply.ViewNum)
+			return reply.Values, nil
+		}
+		if err == ErrUnsupported {
+			return nil, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// DefaultGetConcurrency is how many Gets GetParallel keeps in flight
+// when the caller doesn't specify a limit.
+const DefaultGetConcurrency = 8
+
+// GetParallel fetches several keys with concurrent Gets, at most
+// limit in flight at once (DefaultGetConcurrency if limit <= 0).
+// Unlike GetMany it needs no server-side batch support — each key is
+// an ordinary Get, multiplexed over the primary connection — but the
+// reads are independent, not a single point-in-time view. Absent
+// keys are omitted from the result map; the first non-retryable
+// failure aborts the result.
+func (ck *Client) GetParallel(keys []string, limit int) (map[string]string, error) {
+	if limit <= 0 {
+		limit = DefaultGetConcurrency
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		values   = make(map[string]string, len(keys))
+	)
+	sem := make(chan struct{}, limit)
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			value, e, err := ck.get(key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if e == OK {
+				values[key] = value
+			}
+		}(key)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return values, nil
+}
+
+// rejectedError turns an ErrRejected reply into an error that keeps
+// the interceptor's message while still matching IsRejected.
+func rejectedError(reply *PutReply) error {
+	if reply.Message != "" {
+		return fmt.Errorf("%w: %s", ErrRejected, reply.Message)
+	}
+	return ErrRejected
+}
+
+// Put stores value under key, retrying until the primary accepts it.
+// Retransmissions carry the same sequence number so the servers can
+// filter duplicates. It returns an error only for rejections that
+// retrying cannot fix, like an oversized key or value.
+func (ck *Client) Put(key string, value string) error {
+	_, err := ck.PutWithResult(key, value)
+	return err
+}
+
+// PutResult reports how the primary handled a Put. Duplicate is true
+// when the dedup table answered from its recorded outcome instead of
+// executing the write again — the request, or a retransmission of
+// it, had already been applied. That makes create-once flows
+// observable: a fresh write and an absorbed retry look the same to
+// plain Put.
+type PutResult struct {
+	Duplicate bool
+}
+
+// PutWithResult is Put plus the server's report of how the write was
+// handled.
+func (ck *Client) PutWithResult(key string, value string) (PutResult, error) {
+	ck.mu.Lock()
+	ck.seq++
+	args := &PutArgs{Key: key, Value: value, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+	return ck.put(args, value)
+}
+
+// PutBytes is Put for binary values: the payload travels in the
+// args' ValueBytes field, which gob encodes without the copy a
+// string conversion costs on large blobs.
+func (ck *Client) PutBytes(key string, value []byte) error {
+	ck.mu.Lock()
+	ck.seq++
+	args := &PutArgs{Key: key, ValueBytes: value, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+	_, err := ck.put(args, string(value))
+	return err
+}
+
+// put runs the Put retry loop. cached is what goes into the read
+// cache once the primary confirms the write.
+func (ck *Client) put(args *PutArgs, cached string) (PutResult, error) {
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return PutResult{}, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return PutResult{}, err
+		}
+		var reply PutReply
+		err := ck.callPrimary("KVServer.Put", args, &reply)
+		if err == nil {
+			if reply.Err == OK {
+				ck.setLastView(reply.ViewNum)
+				ck.cachePut(args.Key, cached)
+				return PutResult{Duplicate: reply.Duplicate}, nil
+			}
+			if reply.Err == ErrTooLarge {
+				return PutResult{}, ErrTooLarge
+			}
+			if reply.Err == ErrFull {
+				return PutResult{}, ErrFull
+			}
+			if reply.Err == ErrRejected {
+				return PutResult{}, rejectedError(&reply)
+			}
+			if reply.Err == ErrBusy || reply.Err == ErrRateLimited {
+				// The primary is mid state transfer with a full
+				// queue, or shedding load; back off instead of
+				// hammering it.
+				ck.sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+		if err == ErrUnsupported {
+			return PutResult{}, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// PutIfAbsent stores value under key only if the key is not already
+// set, and reports whether the write happened. Retransmissions get
+// the servers' recorded answer, so the result is stable even if the
+// key is deleted between retries.
+func (ck *Client) PutIfAbsent(key string, value string) (bool, error) {
+	ck.mu.Lock()
+	ck.seq++
+	args := &PutArgs{Key: key, Value: value, IfNotExists: true, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return false, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return false, err
+		}
+		var reply PutReply
+		err := ck.callPrimary("KVServer.Put", args, &reply)
+		if err == nil {
+			if reply.Err == OK || reply.Err == ErrExists {
+				ck.setLastView(reply.ViewNum)
+				if reply.Err == OK {
+					ck.cachePut(key, value)
+				}
+				return reply.Err == OK, nil
+			}
+			if reply.Err == ErrTooLarge {
+				return false, ErrTooLarge
+			}
+			if reply.Err == ErrFull {
+				return false, ErrFull
+			}
+			if reply.Err == ErrRejected {
+				return false, rejectedError(&reply)
+			}
+			if reply.Err == ErrBusy || reply.Err == ErrRateLimited {
+				ck.sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+		if err == ErrUnsupported {
+			return false, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// PutIfVersion stores value under key only if the key's per-key
+// sequence still equals expectedSeq (as returned by GetVersioned;
+// 0 for a key that doesn't exist yet), and reports whether the write
+// happened. A false result means someone else wrote the key in
+// between: the caller re-reads and decides. Retransmissions get the
+// servers' recorded answer, so the result is stable across retries.
+func (ck *Client) PutIfVersion(key, value string, expectedSeq uint64) (bool, error) {
+	ck.mu.Lock()
+	ck.seq++
+	args := &PutArgs{Key: key, Value: value, IfVersion: true, ExpectedSeq: expectedSeq, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return false, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return false, err
+		}
+		var reply PutReply
+		err := ck.callPrimary("KVServer.Put", args, &reply)
+		if err == nil {
+			if reply.Err == OK || reply.Err == ErrVersion {
+				ck.setLastView(reply.ViewNum)
+				if reply.Err == OK {
+					ck.cachePut(key, value)
+				}
+				return reply.Err == OK, nil
+			}
+			if reply.Err == ErrTooLarge {
+				return false, ErrTooLarge
+			}
+			if reply.Err == ErrFull {
+				return false, ErrFull
+			}
+			if reply.Err == ErrRejected {
+				return false, rejectedError(&reply)
+			}
+			if reply.Err == ErrBusy || reply.Err == ErrRateLimited {
+				ck.sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+		if err == ErrUnsupported {
+			return false, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// Delete removes key, retrying until the primary accepts it.
+// Deleting a missing key is a no-op that still succeeds.
+func (ck *Client) Delete(key string) error {
+	ck.mu.Lock()
+	ck.seq++
+	args := &PutArgs{Key: key, Delete: true, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return err
+		}
+		var reply PutReply
+		err := ck.callPrimary("KVServer.Put", args, &reply)
+		if err == nil {
+			if reply.Err == OK {
+				ck.setLastView(reply.ViewNum)
+				ck.cacheDelete(key)
+				return nil
+			}
+			if reply.Err == ErrTooLarge {
+				return ErrTooLarge
+			}
+			if reply.Err == ErrBusy || reply.Err == ErrRateLimited {
+				ck.sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+		if err == ErrUnsupported {
+			return err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// Txn applies puts and deletes as one atomic unit: after it returns
+// nil, either every mutation is visible on both replicas or (on an
+// error) none is — a failover can't surface half of the set. The
+// batch shares one dedup slot, so retransmissions are filtered as a
+// unit. An empty transaction succeeds trivially.
+func (ck *Client) Txn(puts map[string]string, deletes []string) error {
+	ck.mu.Lock()
+	ck.seq++
+	args := &TxnArgs{Puts: puts, Deletes: deletes, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return err
+		}
+		var reply TxnReply
+		err := ck.callPrimary("KVServer.Txn", args, &reply)
+		if err == nil {
+			if reply.Err == OK {
+				ck.setLastView(reply.ViewNum)
+				for k, v := range puts {
+					ck.cachePut(k, v)
+				}
+				for _, k := range deletes {
+					ck.cacheDelete(k)
+				}
+				return nil
+			}
+			if reply.Err == ErrTooLarge {
+				return ErrTooLarge
+			}
+			if reply.Err == ErrFull {
+				return ErrFull
+			}
+			if reply.Err == ErrRejected {
+				return ErrRejected
+			}
+			if reply.Err == ErrBusy || reply.Err == ErrRateLimited {
+				ck.sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+		if err == ErrUnsupported {
+			return err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// nextBackoff doubles a retry delay, capped at a few seconds.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > 4*time.Second {
+		d = 4 * time.Second
+	}
+	return d
+}
+
+// WatchEvent is one key change delivered by Watch.
+type WatchEvent struct {
+	Key string
+	Seq uint64
+}
+
+// Watch long-polls the primary for changes to keys under prefix,
+// starting from the time of the call, and delivers them on the
+// returned channel. The watch is best-effort: a watcher that falls
+// far behind, or a failover to a new primary, can drop events. Call
+// stop to end the watch; the channel is then closed.
+func (ck *Client) Watch(prefix string) (<-chan WatchEvent, func()) {
+	events := make(chan WatchEvent)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+
+	go func() {
+		defer close(events)
+		var since uint64
+		var c *rpc.Client
+		var connected string // the primary c is dialed to
+		defer func() {
+			if c != nil {
+				c.Close()
+			}
+		}()
+		pause := func() bool {
+			t := time.NewTimer(viewservice.PingInterval)
+			defer t.Stop()
+			select {
+			case <-done:
+				return false
+			case <-ck.done:
+				return false
+			case <-t.C:
+				return true
+			}
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ck.done:
+				// Closing the client ends its watches too.
+				return
+			default:
+			}
+			primary := ck.currentPrimary()
+			if primary == "" {
+				ck.refreshPrimary()
+				if !pause() {
+					return
+				}
+				continue
+			}
+			if c == nil || connected != primary {
+				if c != nil {
+					c.Close()
+				}
+				var err error
+				if c, err = dialTimeout(ck.tr, primary, ck.timeout()); err != nil {
+					c = nil
+					ck.refreshPrimary()
+					if !pause() {
+						return
+					}
+					continue
+				}
+				connected = primary
+				// A new primary numbers changes from its own
+				// sequence; restart from "now" rather than replay.
+				since = 0
+			}
+			args := &WaitForChangeArgs{Prefix: prefix, SinceSeq: since}
+			var reply WaitForChangeReply
+			// Allow the server its full poll window plus call slack.
+			err := callWithTimeout(c, "KVServer.WaitForChange", args, &reply, watchPollTimeout+ck.timeout())
+			if err != nil || reply.Err != OK {
+				c.Close()
+				c = nil
+				ck.refreshPrimary()
+				if !pause() {
+					return
+				}
+				continue
+			}
+			if reply.Seq > since {
+				since = reply.Seq
+			}
+			if reply.Timeout {
+				// An empty window is the moment to re-check the view: a
+				// deposed primary keeps answering polls — all empty,
+				// since writes now land on its successor — and only a
+				// refresh moves the watch over to the new primary.
+				ck.refreshPrimary()
+				continue
+			}
+			select {
+			case events <- WatchEvent{Key: reply.Key, Seq: reply.Seq}:
+			case <-done:
+				return
+			case <-ck.done:
+				return
+			}
+		}
+	}()
+	return events, stop
+}
+
+// GetStale fetches the value for key from the current backup,
+// relieving the primary of read load. The result may be slightly
+// behind the primary, since the backup applies a write before the
+// primary does but learns of view changes asynchronously; callers
+// must tolerate stale values. If the view has no backup, the read
+// falls back to the primary.
+func (ck *Client) GetStale(key string) string {
+	args := &GetArgs{Key: key, AllowStale: true}
+	for {
+		if backup := ck.currentBackup(); backup != "" {
+			var reply GetReply
+			ok := call(ck.tr, backup, "KVServer.Get", args, &reply)
+			if ok && reply.Err == OK {
+				return reply.Value
+			}
+			if ok && reply.Err == ErrNoKey {
+				return ""
+			}
+		} else if ck.currentPrimary() != "" {
+			return ck.Get(key)
+		}
+		if ck.closed() {
+			return ""
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// Incr atomically adds delta to the integer stored under key (a
+// missing or empty value counts as 0) and returns the new value. It
+// returns an error if the stored value is not a valid integer.
+// Retries are filtered by the servers' dedup table, so the increment
+// is applied exactly once.
+func (ck *Client) Incr(key string, delta int64) (int64, error) {
+	ck.mu.Lock()
+	ck.seq++
+	args := &IncrArgs{Key: key, Delta: delta, ClientID: ck.id, Seq: ck.seq}
+	ck.mu.Unlock()
+
+	backoff := viewservice.PingInterval
+	for {
+		if ck.closed() {
+			return 0, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return 0, err
+		}
+		var reply IncrReply
+		err := ck.callPrimary("KVServer.Incr", args, &reply)
+		if err == nil {
+			if reply.Err == OK {
+				ck.cacheDelete(key)
+				return reply.Value, nil
+			}
+			if reply.Err == ErrNotInteger {
+				return 0, ErrNotInteger
+			}
+			if reply.Err == ErrTooLarge {
+				return 0, ErrTooLarge
+			}
+			if reply.Err == ErrFull {
+				return 0, ErrFull
+			}
+			if reply.Err == ErrBusy || reply.Err == ErrRateLimited {
+				ck.sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+		if err == ErrUnsupported {
+			return 0, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// Inspect reports when key was last modified: the view number and
+// wall time of the write, as stamped by the primary. exists is false
+// when the key is not set. It retries through failures and view
+// changes like Get.
+func (ck *Client) Inspect(key string) (KeyMeta, bool, error) {
+	args := &InspectArgs{Key: key}
+	for {
+		if ck.closed() {
+			return KeyMeta{}, false, ErrClosed
+		}
+		if err := ck.breakerCheck(); err != nil {
+			return KeyMeta{}, false, err
+		}
+		var reply InspectReply
+		err := ck.callPrimary("KVServer.Inspect", args, &reply)
+		if err == nil {
+			if reply.Err == OK {
+				return reply.Meta, true, nil
+			}
+			if reply.Err == ErrNoKey {
+				return KeyMeta{}, false, nil
+			}
+		}
+		if err == ErrUnsupported {
+			return KeyMeta{}, false, err
+		}
+		ck.refreshPrimary()
+		ck.sleep(viewservice.PingInterval)
+	}
+}
+
+// ListServers reports every server the view service knows about,
+// including idle spares, with roles and last ping ages.
+func (ck *Client) ListServers() ([]viewservice.ServerStatus, error) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	c := ck.ensureVSClient()
+	if c == nil {
+		return nil, errors.New("kvservice: view service unreachable")
+	}
+	var reply viewservice.GetServersReply
+	if err := callWithTimeout(c, "ViewServer.GetServers", &viewservice.GetServersArgs{}, &reply, ck.callTimeout); err != nil {
+		ck.vs.Close()
+		ck.vs = nil
+		return nil, err
+	}
+	return reply.Servers, nil
+}
+
+// VerifyState fetches a checksum of the contents of the KV server at
+// addr, so callers can compare replicas for divergence.
+func (ck *Client) VerifyState(addr string) (VerifyStateReply, error) {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return VerifyStateReply{}, err
+	}
+	defer c.Close()
+	var reply VerifyStateReply
+	err = callWithTimeout(c, "KVServer.VerifyState", &VerifyStateArgs{}, &reply, ck.timeout())
+	return reply, err
+}
+
+// SnapshotTo asks the KV server at addr to serialize its contents to
+// path on its own host. It returns the number of keys written.
+func (ck *Client) SnapshotTo(addr, path, secret string) (int, error) {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	var reply SnapshotToReply
+	args := &SnapshotToArgs{Secret: secret, Path: path}
+	err = callWithTimeout(c, "KVServer.SnapshotTo", args, &reply, ck.timeout())
+	return reply.Keys, err
+}
+
+// RestoreFrom asks the idle KV server at addr to load a snapshot file
+// from path on its own host. It returns the number of keys loaded.
+func (ck *Client) RestoreFrom(addr, path, secret string) (int, error) {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	var reply RestoreFromReply
+	args := &RestoreFromArgs{Secret: secret, Path: path}
+	err = callWithTimeout(c, "KVServer.RestoreFrom", args, &reply, ck.timeout())
+	return reply.Keys, err
+}
+
+// Flush asks the primary to wipe the entire store and dedup table,
+// for test environments. secret is the servers' admin secret.
+func (ck *Client) Flush(secret string) error {
+	if ck.currentPrimary() == "" {
+		ck.refreshPrimary()
+	}
+	primary := ck.currentPrimary()
+	if primary == "" {
+		return errors.New("kvservice: no primary known")
+	}
+	c, err := dialTimeout(ck.tr, primary, ck.timeout())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var reply FlushReply
+	return callWithTimeout(c, "KVServer.Flush", &FlushArgs{Secret: secret}, &reply, ck.timeout())
+}
+
+// Stats fetches capacity figures from the KV server at addr.
+func (ck *Client) Stats(addr string) (StatsReply, error) {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return StatsReply{}, err
+	}
+	defer c.Close()
+	var reply StatsReply
+	err = callWithTimeout(c, "KVServer.Stats", &StatsArgs{}, &reply, ck.timeout())
+	return reply, err
+}
+
+// Resync asks the primary at addr to re-stream its full state to the
+// current backup immediately. It returns ErrBusy (see IsBusy) when a
+// transfer is already in flight.
+func (ck *Client) Resync(addr, secret string) error {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var reply AdminResyncReply
+	// The full stream can take a while on a large dataset; allow
+	// extra time, like StepDown does.
+	args := &AdminResyncArgs{Secret: secret}
+	if err := callWithTimeout(c, "KVServer.AdminResync", args, &reply, 4*ck.timeout()); err != nil {
+		return err
+	}
+	if reply.Err != OK {
+		return reply.Err
+	}
+	return nil
+}
+
+// StepDown asks the primary at addr to hand its role to the backup
+// for a rolling restart. It returns the resulting view.
+func (ck *Client) StepDown(addr, secret string) (StepDownReply, error) {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return StepDownReply{}, err
+	}
+	defer c.Close()
+	var reply StepDownReply
+	// A lagging backup may need a full re-sync first; allow extra time.
+	err = callWithTimeout(c, "KVServer.StepDown", &StepDownArgs{Secret: secret}, &reply, 4*ck.timeout())
+	return reply, err
+}
+
+// Ping probes the KV server at addr via its Health RPC. It is meant
+// for monitoring tools and does not consult the view service.
+func (ck *Client) Ping(addr string) (HealthReply, error) {
+	c, err := dialTimeout(ck.tr, addr, ck.timeout())
+	if err != nil {
+		return HealthReply{}, err
+	}
+	defer c.Close()
+	var reply HealthReply
+	err = callWithTimeout(c, "KVServer.Health", &HealthArgs{}, &reply, ck.timeout())
+	return reply, err
+}
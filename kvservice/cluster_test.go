@@ -0,0 +1,3012 @@
+package kvservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dsdemo/clock"
+	"dsdemo/clock/clocktest"
+	"dsdemo/transport/transporttest"
+	"dsdemo/viewservice"
+)
+
+// TestClusterOverMemoryTransport wires a view service, two KV servers
+// and a client together over the in-memory transport — no TCP ports —
+// and checks that a write reaches both replicas. It is the template
+// for replication tests that want a whole cluster inside one process.
+func TestClusterOverMemoryTransport(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	// Wait for the view service to settle on a primary and a backup.
+	vck := viewservice.MakeClerkWithTransport("", "vs", net)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if v, ok := vck.Get(); ok && v.Primary != "" && v.Backup != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "v" {
+		t.Fatalf("Get(k) = %q, want %q", got, "v")
+	}
+	// The forwarded write must be visible on the backup too.
+	if got := ck.GetStale("k"); got != "v" {
+		t.Fatalf("GetStale(k) = %q, want %q", got, "v")
+	}
+}
+
+// TestShardedClusterOverMemoryTransport runs two single-server
+// shards and checks that a sharded client reads back what it wrote
+// regardless of which shard owns each key.
+func TestShardedClusterOverMemoryTransport(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	if err := vs.SetNumShards(2); err != nil {
+		t.Fatalf("SetNumShards: %v", err)
+	}
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	// Wait until both shards have a primary.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			len(reply.Shards) == 2 &&
+			reply.Shards[0].Primary != "" && reply.Shards[1].Primary != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards never both got a primary")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	sc := MakeShardedClientWithConfig(ClientConfig{Transport: net}, 2, "vs")
+	defer sc.Close()
+	keys := []string{"alpha", "bravo", "charlie", "delta", "echo"}
+	for _, k := range keys {
+		if err := sc.Put(k, "v-"+k); err != nil {
+			t.Fatalf("Put(%s): %v", k, err)
+		}
+	}
+	for _, k := range keys {
+		if got := sc.Get(k); got != "v-"+k {
+			t.Fatalf("Get(%s) = %q, want %q", k, got, "v-"+k)
+		}
+	}
+}
+
+// TestWaitForPrimary checks both sides of the startup helper: it
+// gives up when no primary ever appears and returns once one does.
+func TestWaitForPrimary(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ck.WaitForPrimary(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitForPrimary with no servers = %v, want deadline exceeded", err)
+	}
+
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel2()
+	if err := ck.WaitForPrimary(ctx2); err != nil {
+		t.Fatalf("WaitForPrimary: %v", err)
+	}
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put after WaitForPrimary: %v", err)
+	}
+}
+
+// TestSyncBeginRejectsWrongSender checks that a backup only accepts
+// a state transfer from its view's primary.
+func TestSyncBeginRejectsWrongSender(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var view viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			view = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	backup := kv2
+	if view.Backup == "kv1" {
+		backup = kv1
+	}
+	// The sender check compares against the backup's own view, so
+	// wait for its ping loop to catch up with the view service.
+	for {
+		var hr HealthReply
+		if backup.Health(&HealthArgs{}, &hr) == nil && hr.ViewNum == view.ViewNum {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backup never learned the current view")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+	var r SyncBeginReply
+	args := &SyncBeginArgs{WireHeader: wireHeader(), TransferID: 1, ViewNum: view.ViewNum, Sender: "rogue"}
+	if err := backup.SyncBegin(args, &r); err != nil {
+		t.Fatalf("SyncBegin: %v", err)
+	}
+	if r.Err != ErrNotPrimary {
+		t.Fatalf("SyncBegin from a rogue sender = %v, want %v", r.Err, ErrNotPrimary)
+	}
+
+	args.Sender = view.Primary
+	if err := backup.SyncBegin(args, &r); err != nil {
+		t.Fatalf("SyncBegin: %v", err)
+	}
+	if r.Err != OK {
+		t.Fatalf("SyncBegin from the primary = %v, want OK", r.Err)
+	}
+}
+
+// TestVerifyIntervalRepairsDivergedBackup corrupts a backup behind
+// the primary's back and checks the periodic checksum comparison
+// re-streams the state.
+func TestVerifyIntervalRepairsDivergedBackup(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+	kv1.SetVerifyInterval(2 * viewservice.PingInterval)
+	kv2.SetVerifyInterval(2 * viewservice.PingInterval)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Corrupt the backup directly, as a missed forward would.
+	var primary, backup *KVServer
+	for _, kv := range []*KVServer{kv1, kv2} {
+		kv.mu.Lock()
+		if kv.view.Primary == kv.me {
+			primary = kv
+		} else {
+			backup = kv
+		}
+		kv.mu.Unlock()
+	}
+	if primary == nil || backup == nil {
+		t.Fatal("could not identify primary and backup")
+	}
+	backup.mu.Lock()
+	backup.store.Put("k", "bogus")
+	backup.mu.Unlock()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		backup.mu.Lock()
+		v, _ := backup.store.Get("k")
+		backup.mu.Unlock()
+		if v == "v" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backup still diverged: %q", v)
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+}
+
+// TestGetParallel checks the client-side fan-out returns the same
+// answers as serial Gets, with absent keys omitted.
+func TestGetParallel(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	for _, k := range keys {
+		if err := ck.Put(k, "v-"+k); err != nil {
+			t.Fatalf("Put(%s): %v", k, err)
+		}
+	}
+
+	got, err := ck.GetParallel(append(keys, "missing"), 3)
+	if err != nil {
+		t.Fatalf("GetParallel: %v", err)
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("GetParallel returned %d values, want %d: %v", len(got), len(keys), got)
+	}
+	for _, k := range keys {
+		if got[k] != "v-"+k {
+			t.Fatalf("GetParallel[%s] = %q, want %q", k, got[k], "v-"+k)
+		}
+	}
+}
+
+// TestPromotedIncompleteReplicaRejectsWrites pins the promotion race:
+// a server handed the primary role before it ever held a full copy of
+// the state must answer ErrBusy — retryable — rather than apply
+// writes against a partial dataset.
+func TestPromotedIncompleteReplicaRejectsWrites(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Simulate the race: the view service promotes this server into a
+	// later view while its state transfer never completed.
+	kv.mu.Lock()
+	kv.stateComplete = false
+	view := kv.view
+	kv.mu.Unlock()
+
+	var pr PutReply
+	if err := kv.Put(&PutArgs{Key: "k2", Value: "v2", ClientID: 1, Seq: 1}, &pr); err != nil {
+		t.Fatalf("Put RPC: %v", err)
+	}
+	if pr.Err != ErrBusy {
+		t.Fatalf("Put on incomplete primary = %v, want %v", pr.Err, ErrBusy)
+	}
+	var gr GetReply
+	if err := kv.Get(&GetArgs{Key: "k"}, &gr); err != nil {
+		t.Fatalf("Get RPC: %v", err)
+	}
+	if gr.Err != ErrBusy {
+		t.Fatalf("Get on incomplete primary = %v, want %v", gr.Err, ErrBusy)
+	}
+
+	// Once the state is whole again the same view serves normally.
+	kv.mu.Lock()
+	kv.stateComplete = true
+	kv.view = view
+	kv.mu.Unlock()
+	if got := ck.Get("k"); got != "v" {
+		t.Fatalf("Get(k) after completion = %q, want %q", got, "v")
+	}
+}
+
+// TestPutInterceptor checks an interceptor's veto reaches the client
+// as ErrRejected with the reason, runs before forwarding so the
+// backup never stores the rejected value, and that accepted writes
+// still replicate.
+func TestPutInterceptor(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+	veto := func(key, value string) error {
+		if strings.HasPrefix(value, "bad") {
+			return errors.New("value must not start with bad")
+		}
+		return nil
+	}
+	kv1.SetPutInterceptor(veto)
+	kv2.SetPutInterceptor(veto)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "good"); err != nil {
+		t.Fatalf("Put(good): %v", err)
+	}
+	err := ck.Put("k", "bad value")
+	if !IsRejected(err) {
+		t.Fatalf("Put(bad) = %v, want ErrRejected", err)
+	}
+	if !strings.Contains(err.Error(), "must not start with bad") {
+		t.Fatalf("rejection lost the interceptor's message: %v", err)
+	}
+	if got := ck.Get("k"); got != "good" {
+		t.Fatalf("Get(k) = %q, want %q", got, "good")
+	}
+	if got := ck.GetStale("k"); got != "good" {
+		t.Fatalf("GetStale(k) = %q, want %q", got, "good")
+	}
+}
+
+// TestClientReadCache covers the LRU read cache: a cached Get skips
+// the server (and so can be stale against another client's write),
+// the owner's own writes refresh the entry, and a view-number change
+// drops the cache entirely.
+func TestClientReadCache(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net, CacheSize: 4}, "vs")
+	defer ck.Close()
+	other := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer other.Close()
+
+	if err := ck.Put("k", "v1"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "v1" {
+		t.Fatalf("Get(k) = %q, want v1", got)
+	}
+
+	// Another client's write is invisible while the entry is cached.
+	if err := other.Put("k", "v2"); err != nil {
+		t.Fatalf("other.Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "v1" {
+		t.Fatalf("cached Get(k) = %q, want stale v1", got)
+	}
+
+	// The owner's own write refreshes the cache.
+	if err := ck.Put("k", "v3"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "v3" {
+		t.Fatalf("Get(k) after own Put = %q, want v3", got)
+	}
+
+	// A view change invalidates everything cached.
+	if err := other.Put("k", "v4"); err != nil {
+		t.Fatalf("other.Put: %v", err)
+	}
+	ck.setLastView(ck.LastView() + 1)
+	if got := ck.Get("k"); got != "v4" {
+		t.Fatalf("Get(k) after view change = %q, want v4", got)
+	}
+
+	// Eviction: filling the cache past its size pushes out the
+	// least recently used key, so it is re-fetched.
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := other.Put(k, "x"); err != nil {
+			t.Fatalf("other.Put(%s): %v", k, err)
+		}
+		ck.Get(k)
+	}
+	if err := other.Put("k", "v5"); err != nil {
+		t.Fatalf("other.Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "v5" {
+		t.Fatalf("Get(k) after eviction = %q, want v5", got)
+	}
+}
+
+// TestShutdownDrainsAndForces covers both shutdown outcomes: with no
+// connections open it returns promptly and cleanly, and with a
+// connection that never drains it force-closes at the deadline and
+// says so.
+func TestShutdownDrainsAndForces(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	if err := kv1.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown with no connections: %v", err)
+	}
+
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+	conn, err := net.Dial("kv2", time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	// Wait until the server is actually serving the connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		kv2.connMu.Lock()
+		open := len(kv2.conns)
+		kv2.connMu.Unlock()
+		if open == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server never registered the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = kv2.Shutdown(ctx)
+	if err == nil {
+		t.Fatal("Shutdown with a held-open connection should report a forced stop")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("forced Shutdown error = %v, want wrapped deadline exceeded", err)
+	}
+	// The straggler really was closed.
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after forced shutdown")
+	}
+}
+
+// TestExists checks the value-free existence probe against present,
+// absent and deleted keys.
+func TestExists(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if ok, err := ck.Exists("k"); err != nil || !ok {
+		t.Fatalf("Exists(k) = %v, %v, want true", ok, err)
+	}
+	if ok, err := ck.Exists("nope"); err != nil || ok {
+		t.Fatalf("Exists(nope) = %v, %v, want false", ok, err)
+	}
+	if err := ck.Delete("k"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ok, err := ck.Exists("k"); err != nil || ok {
+		t.Fatalf("Exists after delete = %v, %v, want false", ok, err)
+	}
+}
+
+// TestVersionedPuts drives the optimistic-concurrency loop: read a
+// key with its sequence, write conditionally on it, and lose cleanly
+// when another writer got there first.
+func TestVersionedPuts(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	// A missing key reads as sequence 0, and that sequence creates it.
+	value, seq, err := ck.GetVersioned("k")
+	if err != nil {
+		t.Fatalf("GetVersioned(missing): %v", err)
+	}
+	if value != "" || seq != 0 {
+		t.Fatalf("GetVersioned(missing) = (%q, %d), want (\"\", 0)", value, seq)
+	}
+	if ok, err := ck.PutIfVersion("k", "v1", seq); err != nil || !ok {
+		t.Fatalf("PutIfVersion(create) = (%v, %v), want (true, nil)", ok, err)
+	}
+
+	value, seq, err = ck.GetVersioned("k")
+	if err != nil {
+		t.Fatalf("GetVersioned: %v", err)
+	}
+	if value != "v1" || seq == 0 {
+		t.Fatalf("GetVersioned = (%q, %d), want (\"v1\", > 0)", value, seq)
+	}
+
+	// Another writer bumps the sequence; the stale conditional loses.
+	if err := ck.Put("k", "v2"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if ok, err := ck.PutIfVersion("k", "stale", seq); err != nil || ok {
+		t.Fatalf("PutIfVersion(stale) = (%v, %v), want (false, nil)", ok, err)
+	}
+	if got := ck.Get("k"); got != "v2" {
+		t.Fatalf("stale conditional overwrote the value: got %q", got)
+	}
+
+	// Re-reading yields the fresh sequence, and that one wins.
+	_, seq, err = ck.GetVersioned("k")
+	if err != nil {
+		t.Fatalf("GetVersioned: %v", err)
+	}
+	if ok, err := ck.PutIfVersion("k", "v3", seq); err != nil || !ok {
+		t.Fatalf("PutIfVersion(fresh) = (%v, %v), want (true, nil)", ok, err)
+	}
+	if got := ck.Get("k"); got != "v3" {
+		t.Fatalf("Get after conditional write = %q, want %q", got, "v3")
+	}
+}
+
+// TestStableClientSkipsViewLookups verifies that a client keeps using
+// its cached primary connection while the view is stable: after the
+// first operation finds the primary, further operations must not ask
+// the view service for the view again.
+func TestStableClientSkipsViewLookups(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	before := vs.GetRPCCounts()
+	for i := 0; i < 20; i++ {
+		if err := ck.Put("k", "v"); err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+		ck.Get("k")
+	}
+	after := vs.GetRPCCounts()
+	// The in-memory transport doesn't drop calls, so a stable primary
+	// means not a single view lookup across all 40 operations.
+	if after.Get != before.Get {
+		t.Fatalf("stable client looked up the view %d times", after.Get-before.Get)
+	}
+}
+
+// TestRateLimiter exhausts the server's token bucket with direct RPCs
+// and checks both halves of the contract: the server answers
+// ErrRateLimited once the bucket is empty, and the client rides the
+// limit out with backoff instead of surfacing an error.
+func TestRateLimiter(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Two tokens of burst: the third direct read must be turned away.
+	kv.SetRateLimit(2)
+	for i := 0; i < 2; i++ {
+		var reply GetReply
+		if err := kv.Get(&GetArgs{Key: "k"}, &reply); err != nil || reply.Err != OK {
+			t.Fatalf("Get %d within the limit = (%v, %v), want OK", i, reply.Err, err)
+		}
+	}
+	var reply GetReply
+	if err := kv.Get(&GetArgs{Key: "k"}, &reply); err != nil || reply.Err != ErrRateLimited {
+		t.Fatalf("Get past the limit = (%v, %v), want ErrRateLimited", reply.Err, err)
+	}
+
+	// The client treats the rejection as retryable: with the bucket
+	// refilling at 2/s, a few operations still all succeed.
+	for i := 0; i < 3; i++ {
+		if err := ck.Put("k", "v2"); err != nil {
+			t.Fatalf("rate-limited Put %d: %v", i, err)
+		}
+	}
+	if got := ck.Get("k"); got != "v2" {
+		t.Fatalf("Get = %q, want %q", got, "v2")
+	}
+}
+
+// TestTxnAtomicReplication applies a mixed batch of puts and a delete
+// through Txn and checks that the whole unit is visible on the
+// primary and on the backup.
+func TestTxnAtomicReplication(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	vck := viewservice.MakeClerkWithTransport("", "vs", net)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if v, ok := vck.Get(); ok && v.Primary != "" && v.Backup != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("old", "x"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	err := ck.Txn(map[string]string{"a": "1", "b": "2"}, []string{"old"})
+	if err != nil {
+		t.Fatalf("Txn: %v", err)
+	}
+
+	for _, check := range []struct {
+		key, want string
+		exists    bool
+	}{{"a", "1", true}, {"b", "2", true}, {"old", "", false}} {
+		value, exists, err := ck.GetOK(check.key)
+		if err != nil {
+			t.Fatalf("GetOK(%s): %v", check.key, err)
+		}
+		if exists != check.exists || value != check.want {
+			t.Fatalf("GetOK(%s) = (%q, %v), want (%q, %v)",
+				check.key, value, exists, check.want, check.exists)
+		}
+	}
+	// The backup received the batch via ForwardTxn.
+	if got := ck.GetStale("a"); got != "1" {
+		t.Fatalf("GetStale(a) = %q, want %q", got, "1")
+	}
+	if got := ck.GetStale("old"); got != "" {
+		t.Fatalf("GetStale(old) = %q, want deleted", got)
+	}
+}
+
+// TestClientReconnectsToRestartedViewService restarts the view
+// service under the same address — the in-memory analogue of a pod
+// rescheduled behind a stable DNS name — and checks that a single
+// view refresh recovers: the client must redial the address instead
+// of giving up on its dead cached connection.
+func TestClientReconnectsToRestartedViewService(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Replace the view service; the old connection the client cached
+	// is now a dead end. Wait until the KV server has re-registered
+	// with the replacement.
+	vs.Kill()
+	vs2 := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs2.Kill)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs2.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Primary == "kv1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("kv1 never re-registered with the restarted view service")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	// Forget the primary, then refresh exactly once: the answer can
+	// only come from the replacement view service.
+	ck.mu.Lock()
+	ck.view.Primary = ""
+	ck.mu.Unlock()
+	ck.refreshPrimary()
+	if got := ck.currentPrimary(); got != "kv1" {
+		t.Fatalf("primary after one refresh = %q, want %q", got, "kv1")
+	}
+	if got := ck.Get("k"); got != "v" {
+		t.Fatalf("Get after view service restart = %q, want %q", got, "v")
+	}
+}
+
+// TestAdminResync corrupts the backup directly and checks that an
+// operator-triggered resync repairs it on the spot, and that a
+// resync arriving during a transfer answers ErrBusy.
+func TestAdminResync(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	var primary, backup *KVServer
+	for _, kv := range []*KVServer{kv1, kv2} {
+		kv.mu.Lock()
+		if kv.view.Primary == kv.me {
+			primary = kv
+		} else {
+			backup = kv
+		}
+		kv.mu.Unlock()
+	}
+	if primary == nil || backup == nil {
+		t.Fatal("could not identify primary and backup")
+	}
+
+	backup.mu.Lock()
+	backup.store.Put("k", "bogus")
+	backup.mu.Unlock()
+
+	if err := ck.Resync(primary.me, ""); err != nil {
+		t.Fatalf("Resync: %v", err)
+	}
+	backup.mu.Lock()
+	v, _ := backup.store.Get("k")
+	backup.mu.Unlock()
+	if v != "v" {
+		t.Fatalf("backup still diverged after resync: %q", v)
+	}
+
+	// A resync during an in-flight transfer is refused, not queued.
+	primary.mu.Lock()
+	primary.transferring = true
+	primary.mu.Unlock()
+	err := ck.Resync(primary.me, "")
+	primary.mu.Lock()
+	primary.transferring = false
+	primary.transferCond.Broadcast()
+	primary.mu.Unlock()
+	if !IsBusy(err) {
+		t.Fatalf("Resync during transfer = %v, want ErrBusy", err)
+	}
+}
+
+// TestRequireBackup runs a primary configured to refuse unreplicated
+// writes: alone it answers ErrNoBackup, and the same client write
+// goes through once a backup joins the view.
+func TestRequireBackup(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv1.SetRequireBackup(true)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ck.WaitForPrimary(ctx); err != nil {
+		t.Fatalf("WaitForPrimary: %v", err)
+	}
+
+	var reply PutReply
+	args := &PutArgs{Key: "k", Value: "v", ClientID: 1, Seq: 1}
+	if err := kv1.Put(args, &reply); err != nil || reply.Err != ErrNoBackup {
+		t.Fatalf("lone Put = (%v, %v), want ErrNoBackup", reply.Err, err)
+	}
+
+	// Reads are unaffected: durability only gates mutations.
+	var gr GetReply
+	if err := kv1.Get(&GetArgs{Key: "k"}, &gr); err != nil || gr.Err != ErrNoKey {
+		t.Fatalf("lone Get = (%v, %v), want ErrNoKey", gr.Err, err)
+	}
+
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	// The client retries through the refusals and succeeds once the
+	// view service recruits the newcomer as backup.
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put with backup: %v", err)
+	}
+	if got := ck.GetStale("k"); got != "v" {
+		t.Fatalf("GetStale = %q, want %q", got, "v")
+	}
+}
+
+// TestForwardFencing sends forged forwards at both replicas: the
+// primary must refuse to play backup, and the backup must refuse a
+// forward for its own view from anyone but that view's primary.
+func TestForwardFencing(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var view viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			view = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+	primary, backup := kv1, kv2
+	if view.Primary == "kv2" {
+		primary, backup = kv2, kv1
+	}
+	// The fencing compares against each server's own view, so wait
+	// for both ping loops to catch up with the view service.
+	for _, kv := range []*KVServer{primary, backup} {
+		for {
+			var hr HealthReply
+			if kv.Health(&HealthArgs{}, &hr) == nil && hr.ViewNum == view.ViewNum {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("server never learned the current view")
+			}
+			time.Sleep(viewservice.PingInterval / 2)
+		}
+	}
+
+	update := PutArgs{Key: "k", Value: "forged", ClientID: 1, Seq: 1}
+	var pr PutReply
+	args := &ForwardArgs{WireHeader: wireHeader(), ViewNum: view.ViewNum, Sender: backup.me, Update: update}
+	if err := primary.ForwardUpdate(args, &pr); err != nil {
+		t.Fatalf("ForwardUpdate: %v", err)
+	}
+	if pr.Err != ErrNotBackup {
+		t.Fatalf("forward at the primary = %v, want %v", pr.Err, ErrNotBackup)
+	}
+
+	args.Sender = "rogue"
+	if err := backup.ForwardUpdate(args, &pr); err != nil {
+		t.Fatalf("ForwardUpdate: %v", err)
+	}
+	if pr.Err != ErrNotPrimary {
+		t.Fatalf("forward from a rogue sender = %v, want %v", pr.Err, ErrNotPrimary)
+	}
+
+	var tr TxnReply
+	targs := &ForwardTxnArgs{WireHeader: wireHeader(), ViewNum: view.ViewNum, Sender: "rogue",
+		Update: TxnArgs{Puts: map[string]string{"k": "forged"}, ClientID: 1, Seq: 1}}
+	if err := backup.ForwardTxn(targs, &tr); err != nil {
+		t.Fatalf("ForwardTxn: %v", err)
+	}
+	if tr.Err != ErrNotPrimary {
+		t.Fatalf("txn forward from a rogue sender = %v, want %v", tr.Err, ErrNotPrimary)
+	}
+
+	// Nothing forged landed anywhere.
+	for _, kv := range []*KVServer{primary, backup} {
+		kv.mu.Lock()
+		_, exists := kv.store.Get("k")
+		kv.mu.Unlock()
+		if exists {
+			t.Fatalf("forged forward was applied on %s", kv.me)
+		}
+	}
+}
+
+// TestMaxConns checks that a server over its connection cap sheds
+// newcomers immediately, reports the open count through Stats, and
+// accepts again once a slot frees up.
+func TestMaxConns(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	vck := viewservice.MakeClerkWithTransport("", "vs", net)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if v, ok := vck.Get(); ok && v.Primary == "kv1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("kv1 never became primary")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	kv.SetMaxConns(1)
+
+	// The first connection fits under the cap and stays open.
+	c1, err := net.Dial("kv1", time.Second)
+	if err != nil {
+		t.Fatal("dial kv1: ", err)
+	}
+	defer c1.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for kv.openConns() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("server never registered the first connection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var stats StatsReply
+	if err := kv.Stats(&StatsArgs{}, &stats); err != nil {
+		t.Fatal("Stats: ", err)
+	}
+	if stats.OpenConns != 1 {
+		t.Fatalf("Stats.OpenConns = %d, want 1", stats.OpenConns)
+	}
+
+	// The second connection is over the cap: the server accepts it
+	// and closes it without serving, so the client reads EOF rather
+	// than ever getting an RPC response.
+	c2, err := net.Dial("kv1", time.Second)
+	if err != nil {
+		t.Fatal("dial kv1: ", err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read on over-cap connection = %v, want EOF", err)
+	}
+
+	// Dropping the first connection frees the slot and normal client
+	// traffic flows again.
+	c1.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for kv.openConns() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server never released the first connection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatal("Put after freeing a slot: ", err)
+	}
+}
+
+// TestObservabilityHooks checks that the server reports role changes
+// and the client reports view changes through the optional callbacks.
+func TestObservabilityHooks(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	var mu sync.Mutex
+	var roles [][2]string
+	kv.SetOnRoleChange(func(old, new string) {
+		mu.Lock()
+		roles = append(roles, [2]string{old, new})
+		mu.Unlock()
+	})
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	var views []viewservice.View
+	ck.SetOnViewChange(func(v viewservice.View) {
+		mu.Lock()
+		views = append(views, v)
+		mu.Unlock()
+	})
+
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		gotRole := len(roles) > 0
+		gotView := len(views) > 0
+		mu.Unlock()
+		if gotRole && gotView {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hooks never fired: roles=%v views=%v", roles, views)
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if roles[0] != [2]string{"idle", "primary"} {
+		t.Fatalf("first role change = %v, want idle -> primary", roles[0])
+	}
+	if views[0].Primary != "kv1" {
+		t.Fatalf("first observed view has primary %q, want kv1", views[0].Primary)
+	}
+}
+
+// TestSyncChunkResume drives a chunked transfer by hand and checks
+// the backup's resume contract: a resent chunk under the same
+// session is acknowledged without double-merging, and the transfer
+// still completes with the right contents.
+func TestSyncChunkResume(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var view viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			view = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+	backup := kv2
+	if view.Backup == "kv1" {
+		backup = kv1
+	}
+	for {
+		var hr HealthReply
+		if backup.Health(&HealthArgs{}, &hr) == nil && hr.ViewNum == view.ViewNum {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backup never learned the current view")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	data := map[string]string{"a": "1", "b": "2", "c": "3"}
+	var br SyncBeginReply
+	begin := &SyncBeginArgs{WireHeader: wireHeader(), TransferID: 7, ViewNum: view.ViewNum, Sender: view.Primary}
+	if err := backup.SyncBegin(begin, &br); err != nil || br.Err != OK {
+		t.Fatalf("SyncBegin = %v, %v", br.Err, err)
+	}
+	sendChunk := func(seq int, key string) {
+		args := &SyncChunkArgs{WireHeader: wireHeader(), TransferID: 7, Seq: seq,
+			Data: map[string]string{key: data[key]}, Meta: map[string]KeyMeta{}}
+		var cr SyncChunkReply
+		if err := backup.SyncChunk(args, &cr); err != nil || cr.Err != OK {
+			t.Fatalf("SyncChunk(seq=%d) = %v, %v", seq, cr.Err, err)
+		}
+	}
+	sendChunk(1, "a")
+	sendChunk(2, "b")
+	// The retried chunk, as sent after a lost reply, must be
+	// acknowledged so the primary can move on to chunk 3.
+	sendChunk(2, "b")
+	sendChunk(3, "c")
+
+	var er SyncEndReply
+	end := &SyncEndArgs{WireHeader: wireHeader(), TransferID: 7, Checksum: stateChecksum(data)}
+	if err := backup.SyncEnd(end, &er); err != nil || er.Err != OK {
+		t.Fatalf("SyncEnd = %v, %v", er.Err, err)
+	}
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	for k, want := range data {
+		if got, _ := backup.store.Get(k); got != want {
+			t.Fatalf("after resumed transfer, %s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+// TestDeadLetterLog kills the backup under lenient forwarding and
+// checks that the write which failed to forward is recorded in the
+// dead-letter file with its key, value and view number.
+func TestDeadLetterLog(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var view viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			view = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+	primary, backup := kv1, kv2
+	if view.Primary == "kv2" {
+		primary, backup = kv2, kv1
+	}
+
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	primary.SetStrictForwarding(false)
+	if err := primary.SetDeadLetterPath(path); err != nil {
+		t.Fatalf("SetDeadLetterPath: %v", err)
+	}
+
+	// With the backup dead but still in the primary's view, the
+	// forward fails and lenient mode applies the write anyway.
+	backup.Kill()
+	var pr PutReply
+	if err := primary.Put(&PutArgs{Key: "k", Value: "v", ClientID: 1, Seq: 1}, &pr); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if pr.Err != OK {
+		t.Fatalf("Put = %v, want OK", pr.Err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading dead-letter file: %v", err)
+	}
+	var rec deadLetterRecord
+	if err := json.Unmarshal([]byte(strings.TrimSpace(string(b))), &rec); err != nil {
+		t.Fatalf("decoding dead-letter record %q: %v", b, err)
+	}
+	if rec.Key != "k" || rec.Value != "v" || rec.Delete {
+		t.Fatalf("dead-letter record = %+v, want key k value v", rec)
+	}
+	if rec.ViewNum == 0 {
+		t.Fatalf("dead-letter record has no view number: %+v", rec)
+	}
+}
+
+// TestBytesAPI round-trips a binary value through PutBytes and
+// GetBytes and checks it agrees with the string API.
+func TestBytesAPI(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	blob := []byte{0x00, 0xff, 'g', 'o', 0x01, 0x80}
+	if err := ck.PutBytes("blob", blob); err != nil {
+		t.Fatalf("PutBytes: %v", err)
+	}
+	got, exists, err := ck.GetBytes("blob")
+	if err != nil || !exists {
+		t.Fatalf("GetBytes = exists=%v, %v", exists, err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Fatalf("GetBytes = %x, want %x", got, blob)
+	}
+	// The string API sees the same bytes.
+	if s := ck.Get("blob"); s != string(blob) {
+		t.Fatalf("Get = %x, want %x", s, blob)
+	}
+	if _, exists, err := ck.GetBytes("absent"); err != nil || exists {
+		t.Fatalf("GetBytes(absent) = exists=%v, %v", exists, err)
+	}
+}
+
+// TestWaitForStableView checks the stricter startup helper: it keeps
+// waiting while no acked view exists and returns once the primary
+// has confirmed its view.
+func TestWaitForStableView(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ck.WaitForStableView(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitForStableView with no servers = %v, want deadline exceeded", err)
+	}
+
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel2()
+	if err := ck.WaitForStableView(ctx2); err != nil {
+		t.Fatalf("WaitForStableView: %v", err)
+	}
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put after WaitForStableView: %v", err)
+	}
+}
+
+// TestDedupTTLEviction checks that a client idle beyond the dedup
+// TTL is dropped from the table and that writes still work after.
+func TestDedupTTLEviction(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	kv.mu.Lock()
+	entries := len(kv.lastSeq)
+	kv.mu.Unlock()
+	if entries == 0 {
+		t.Fatal("no dedup entry recorded for the client")
+	}
+
+	kv.SetDedupTTL(2 * viewservice.PingInterval)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		kv.mu.Lock()
+		entries = len(kv.lastSeq)
+		kv.mu.Unlock()
+		if entries == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dedup table still has %d entries after the TTL", entries)
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	// A fresh write from the same client re-registers it.
+	if err := ck.Put("k2", "v2"); err != nil {
+		t.Fatalf("Put after eviction: %v", err)
+	}
+	if got := ck.Get("k2"); got != "v2" {
+		t.Fatalf("Get(k2) = %q, want %q", got, "v2")
+	}
+}
+
+// TestRefreshView checks the explicit view refresh: it discovers the
+// primary without any Get or Put, and reports an unreachable view
+// service as an error.
+func TestRefreshView(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Primary != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no primary ever appeared")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.RefreshView(); err != nil {
+		t.Fatalf("RefreshView: %v", err)
+	}
+	if got := ck.currentPrimary(); got != "kv1" {
+		t.Fatalf("primary after RefreshView = %q, want kv1", got)
+	}
+
+	// A fresh client can't dial the killed view service at all.
+	vs.Kill()
+	ck2 := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck2.Close()
+	if err := ck2.RefreshView(); !errors.Is(err, ErrViewService) {
+		t.Fatalf("RefreshView with dead view service = %v, want ErrViewService", err)
+	}
+}
+
+// TestCurrentView checks that the client keeps the full view it
+// routes by, not just the primary's address.
+func TestCurrentView(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if v := ck.CurrentView(); v != (viewservice.View{}) {
+		t.Fatalf("view before any refresh = %+v, want zero", v)
+	}
+	if err := ck.RefreshView(); err != nil {
+		t.Fatalf("RefreshView: %v", err)
+	}
+	// Either server may have registered first; the cached view must
+	// name both, whichever way around, with a nonzero number.
+	v := ck.CurrentView()
+	both := (v.Primary == "kv1" && v.Backup == "kv2") || (v.Primary == "kv2" && v.Backup == "kv1")
+	if !both || v.ViewNum == 0 {
+		t.Fatalf("CurrentView = %+v, want kv1 and kv2 with a nonzero number", v)
+	}
+}
+
+// TestTombstones exercises soft deletes: a delete under a grace
+// period plants a tombstone on both replicas, the tombstone masks
+// resurrected bytes, a rewrite clears it, and the reaper drops it
+// once the grace period has passed.
+func TestTombstones(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv1.SetTombstoneGrace(time.Hour)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+	kv2.SetTombstoneGrace(time.Hour)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := ck.Delete("k"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, exists, err := ck.GetOK("k"); err != nil || exists {
+		t.Fatalf("GetOK after delete = exists=%v, %v", exists, err)
+	}
+
+	// The forwarded delete planted a tombstone on both replicas.
+	for _, kv := range []*KVServer{kv1, kv2} {
+		kv.mu.Lock()
+		_, dead := kv.tombstones["k"]
+		kv.mu.Unlock()
+		if !dead {
+			t.Fatalf("%s holds no tombstone for k", kv.me)
+		}
+	}
+
+	// The tombstone masks bytes slipped back into the store behind
+	// the delete, as a stale restore would.
+	kv1.mu.Lock()
+	kv2.mu.Lock()
+	primary := kv1
+	if kv2.view.Primary == "kv2" {
+		primary = kv2
+	}
+	primary.store.Put("k", "zombie")
+	kv2.mu.Unlock()
+	kv1.mu.Unlock()
+	if _, exists, err := ck.GetOK("k"); err != nil || exists {
+		t.Fatalf("tombstoned key resurfaced: exists=%v, %v", exists, err)
+	}
+
+	// A rewrite clears the tombstone and the key reads normally.
+	if err := ck.Put("k", "v2"); err != nil {
+		t.Fatalf("Put after delete: %v", err)
+	}
+	if got := ck.Get("k"); got != "v2" {
+		t.Fatalf("Get after rewrite = %q, want %q", got, "v2")
+	}
+
+	// A short grace period lets the reaper (one tick later) drop the
+	// marker.
+	primary.SetTombstoneGrace(10 * time.Millisecond)
+	if err := ck.Delete("k"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		primary.mu.Lock()
+		_, dead := primary.tombstones["k"]
+		primary.mu.Unlock()
+		if !dead {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tombstone never reaped")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+}
+
+// prefixPartitioner routes keys starting with "a" to shard 0 and the
+// rest to shard 1, for pinning routing in tests.
+type prefixPartitioner struct{}
+
+func (prefixPartitioner) ShardFor(key string, shards int) int {
+	if strings.HasPrefix(key, "a") {
+		return 0
+	}
+	return 1
+}
+
+// TestPartitioner checks that a custom partitioner decides the shard
+// every routed operation goes to, and that reads come back through
+// the same mapping.
+func TestPartitioner(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	if err := vs.SetNumShards(2); err != nil {
+		t.Fatalf("SetNumShards: %v", err)
+	}
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			len(reply.Shards) == 2 &&
+			reply.Shards[0].Primary != "" && reply.Shards[1].Primary != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shards never both got a primary")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	sc := MakeShardedClientWithConfig(ClientConfig{Transport: net}, 2, "vs")
+	defer sc.Close()
+	sc.SetPartitioner(prefixPartitioner{})
+
+	if got := sc.ShardFor("apple"); got != 0 {
+		t.Fatalf("ShardFor(apple) = %d, want 0", got)
+	}
+	if got := sc.ShardFor("zebra"); got != 1 {
+		t.Fatalf("ShardFor(zebra) = %d, want 1", got)
+	}
+
+	for _, k := range []string{"apple", "avocado", "zebra", "melon"} {
+		if err := sc.Put(k, "v-"+k); err != nil {
+			t.Fatalf("Put(%s): %v", k, err)
+		}
+		if got := sc.Get(k); got != "v-"+k {
+			t.Fatalf("Get(%s) = %q, want %q", k, got, "v-"+k)
+		}
+	}
+
+	// nil restores the default hash mapping.
+	sc.SetPartitioner(nil)
+	if got := sc.ShardFor("apple"); got != viewservice.ShardFor("apple", 2) {
+		t.Fatalf("ShardFor after reset = %d, want the default hash", got)
+	}
+}
+
+// TestConcurrentWritersConverge hammers one key from several writers
+// and checks the replicas agree afterwards: the forward to the backup
+// and the local apply happen under one lock acquisition, so writes
+// cannot forward in one order and apply in another.
+func TestConcurrentWritersConverge(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	const writers = 8
+	const writes = 25
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+			defer ck.Close()
+			for i := 0; i < writes; i++ {
+				if err := ck.Put("hot", "w"+string(rune('a'+w))+"-"+string(rune('0'+i%10))); err != nil {
+					t.Errorf("writer %d Put %d: %v", w, i, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	kv1.mu.Lock()
+	v1, _ := kv1.store.Get("hot")
+	kv1.mu.Unlock()
+	kv2.mu.Lock()
+	v2, _ := kv2.store.Get("hot")
+	kv2.mu.Unlock()
+	if v1 != v2 {
+		t.Fatalf("replicas diverged on the contested key: primary %q != backup %q", v1, v2)
+	}
+}
+
+// TestLeaveFastFailover checks that a killed primary's Leave makes
+// the view service fail over on the spot, instead of waiting out
+// DeadInterval of missed pings.
+func TestLeaveFastFailover(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	// Wait for a full, acked primary/backup view; promotion past an
+	// unacked one would be held regardless of how the primary dies.
+	var v viewservice.View
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" && reply.PrimaryAcked {
+			v = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached an acked primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	backup := v.Backup
+	if v.Primary == "kv1" {
+		kv1.Kill()
+	} else {
+		kv2.Kill()
+	}
+
+	// Kill sends Leave, and Leave runs a repair pass before replying,
+	// so the backup holds the primary role by the time Kill returns.
+	var reply viewservice.GetReply
+	if err := vs.Get(&viewservice.GetArgs{}, &reply); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if reply.View.Primary != backup {
+		t.Fatalf("after primary left, view = %+v, want primary %s", reply.View, backup)
+	}
+}
+
+// TestPutDuplicateObservable checks that a dedup short-circuit is
+// visible: the cached reply carries Duplicate, and the client
+// surfaces it through PutWithResult.
+func TestPutDuplicateObservable(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	// A fresh write is not a duplicate.
+	res, err := ck.PutWithResult("k", "v")
+	if err != nil {
+		t.Fatalf("PutWithResult: %v", err)
+	}
+	if res.Duplicate {
+		t.Fatal("fresh Put reported Duplicate")
+	}
+
+	// Replay the same request directly, as a lost-reply retransmission
+	// would: the dedup table answers and says so.
+	args := &PutArgs{Key: "k2", Value: "v2", ClientID: 7, Seq: 1}
+	var first, second PutReply
+	if err := kv.Put(args, &first); err != nil {
+		t.Fatalf("Put RPC: %v", err)
+	}
+	if first.Err != OK || first.Duplicate {
+		t.Fatalf("first Put = %v dup=%v, want OK and not duplicate", first.Err, first.Duplicate)
+	}
+	if err := kv.Put(args, &second); err != nil {
+		t.Fatalf("Put RPC retransmission: %v", err)
+	}
+	if second.Err != OK || !second.Duplicate {
+		t.Fatalf("retransmitted Put = %v dup=%v, want OK and duplicate", second.Err, second.Duplicate)
+	}
+}
+
+// syncBuffer is a goroutine-safe log sink for tests that inspect
+// server log output.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestSlowRPCLogging checks that handlers running past the threshold
+// are logged with the method name, and that the logging is off by
+// default.
+func TestSlowRPCLogging(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// Disabled by default: nothing is slow.
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if strings.Contains(buf.String(), "slow RPC") {
+		t.Fatalf("slow-RPC log with logging disabled:\n%s", buf.String())
+	}
+
+	// A nanosecond threshold makes every handler slow.
+	kv.SetSlowRPCThreshold(time.Nanosecond)
+	if err := ck.Put("k2", "v2"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(buf.String(), "slow RPC KVServer.Put") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no slow-RPC log for the Put; log:\n%s", buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTransferDoesNotStallPings pins the transfer/ping decoupling: a
+// state transfer grinding through its RPC timeouts must not silence
+// the primary's pings, or the view service would declare it dead
+// mid-transfer and promote the half-synced backup.
+func TestTransferDoesNotStallPings(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// A black-hole backup: it pings like a server, but its listener
+	// swallows the sync stream without ever replying, so the primary's
+	// transfer spends many call timeouts going nowhere.
+	l, err := net.Listen("b1")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		bk := viewservice.MakeClerkWithTransport("b1", "vs", net)
+		vn := uint(0)
+		for {
+			if v, err := bk.Ping(vn); err == nil {
+				vn = v.ViewNum
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(viewservice.PingInterval / 2):
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Backup == "b1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b1 never recruited as backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	// The primary is now streaming into the black hole. Well past the
+	// dead deadline it must still be pinging.
+	time.Sleep(2 * viewservice.DeadInterval)
+	var sr viewservice.GetServersReply
+	if err := vs.GetServers(&viewservice.GetServersArgs{}, &sr); err != nil {
+		t.Fatalf("GetServers: %v", err)
+	}
+	for _, s := range sr.Servers {
+		if s.Name == "kv1" {
+			if !s.Alive {
+				t.Fatalf("primary went silent during the transfer: %+v", s)
+			}
+			return
+		}
+	}
+	t.Fatal("kv1 missing from the server list")
+}
+
+// TestDataLossPromotedPrimaryServes checks the data-loss promotion is
+// not a dead end: the empty server promoted after the only replica
+// died must start serving once the loss-ack reaches it, rather than
+// answering ErrBusy forever while waiting for a transfer that cannot
+// come.
+func TestDataLossPromotedPrimaryServes(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The only replica dies; the shard's data dies with it. The empty
+	// newcomer is promoted via the data-loss path.
+	kv1.Kill()
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	ck2 := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck2.Close()
+	done := make(chan error, 1)
+	go func() { done <- ck2.Put("k2", "v2") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Put on promoted primary: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Put never completed; the promoted primary is still refusing writes")
+	}
+
+	// The old key went down with kv1.
+	if _, exists, err := ck2.GetOK("k"); err != nil {
+		t.Fatalf("GetOK: %v", err)
+	} else if exists {
+		t.Fatal("lost key still reported as existing")
+	}
+}
+
+// TestCacheClearedByFailover exercises view-change invalidation
+// through a real failover: a client that refreshes its view after the
+// primary died must re-read from the new primary, not keep serving
+// the value it cached in the old world.
+func TestCacheClearedByFailover(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var v viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" && reply.PrimaryAcked {
+			v = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached an acked primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net, CacheSize: 4}, "vs")
+	defer ck.Close()
+	other := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer other.Close()
+
+	if err := ck.Put("k", "old"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := ck.Get("k"); got != "old" {
+		t.Fatalf("Get(k) = %q, want old", got)
+	}
+	// Another client's write lands on both replicas but not in ck's
+	// cache.
+	if err := other.Put("k", "new"); err != nil {
+		t.Fatalf("other.Put: %v", err)
+	}
+
+	// Fail the primary over; the Leave makes the backup take over at
+	// once.
+	if v.Primary == "kv1" {
+		kv1.Kill()
+	} else {
+		kv2.Kill()
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Primary == v.Backup {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backup never promoted")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	// Refreshing the view — without any intervening operation — must
+	// drop the cache, so the next read goes to the new primary.
+	if err := ck.RefreshView(); err != nil {
+		t.Fatalf("RefreshView: %v", err)
+	}
+	if got := ck.Get("k"); got != "new" {
+		t.Fatalf("Get(k) after failover = %q, want new", got)
+	}
+}
+
+// stallBackup is a hand-rolled backup for TestForwardDoesNotStallReads:
+// it accepts a state transfer instantly but sits on every forward for
+// stall, simulating a backup that is alive yet slow to acknowledge
+// writes.
+type stallBackup struct {
+	stall time.Duration
+}
+
+func (b *stallBackup) SyncBegin(args *SyncBeginArgs, reply *SyncBeginReply) error {
+	reply.Err = OK
+	return nil
+}
+
+func (b *stallBackup) SyncChunk(args *SyncChunkArgs, reply *SyncChunkReply) error {
+	reply.Err = OK
+	return nil
+}
+
+func (b *stallBackup) SyncEnd(args *SyncEndArgs, reply *SyncEndReply) error {
+	reply.Err = OK
+	return nil
+}
+
+func (b *stallBackup) ForwardUpdate(args *ForwardArgs, reply *PutReply) error {
+	time.Sleep(b.stall)
+	reply.Err = OK
+	return nil
+}
+
+// TestForwardDoesNotStallReads pins the per-key locking around
+// forwards: while a Put is waiting out a slow backup's round trip, a
+// Get on the primary must answer immediately instead of queueing
+// behind the forward on the global lock.
+func TestForwardDoesNotStallReads(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("warm", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The slow backup: sync completes instantly, forwards take 2s
+	// (inside the call timeout, so they succeed — just slowly).
+	stall := 2 * time.Second
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("KVServer", &stallBackup{stall: stall}); err != nil {
+		t.Fatalf("RegisterName: %v", err)
+	}
+	l, err := net.Listen("b1")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(c)
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		bk := viewservice.MakeClerkWithTransport("b1", "vs", net)
+		vn := uint(0)
+		for {
+			if v, err := bk.Ping(vn); err == nil {
+				vn = v.ViewNum
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(viewservice.PingInterval / 2):
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Backup == "b1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b1 never recruited as backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	// One write end to end confirms the transfer finished and forwards
+	// reach the stub, so the next Put is squarely in its forward when
+	// the read below is timed.
+	if err := ck.Put("k0", "v0"); err != nil {
+		t.Fatalf("Put through slow backup: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- ck.Put("k1", "v1") }()
+	time.Sleep(stall / 4)
+
+	start := time.Now()
+	if v, _, err := ck.GetOK("warm"); err != nil || v != "v" {
+		t.Fatalf("GetOK during forward: %q, %v", v, err)
+	}
+	if elapsed := time.Since(start); elapsed > stall/2 {
+		t.Fatalf("Get took %v; reads are stalling behind the forward", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Put through slow backup: %v", err)
+	}
+}
+
+// TestBreakerOpensAfterThreshold walks the circuit breaker to its
+// threshold: failures below it leave calls flowing, the Nth
+// consecutive failure opens the circuit, and an open circuit makes
+// operations fail fast with ErrCircuitOpen instead of dialing.
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	ck := MakeClientWithConfig(ClientConfig{
+		Transport:        transporttest.New(),
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Minute,
+	}, "vs")
+	defer ck.Close()
+
+	for i := 0; i < 2; i++ {
+		ck.breakerRecord(false)
+		if err := ck.breakerCheck(); err != nil {
+			t.Fatalf("breaker opened after %d failures, threshold is 3: %v", i+1, err)
+		}
+	}
+	ck.breakerRecord(false)
+	if err := ck.breakerCheck(); err != ErrCircuitOpen {
+		t.Fatalf("breakerCheck after threshold: %v, want ErrCircuitOpen", err)
+	}
+
+	// An operation must surface the open breaker immediately, not
+	// retry against the unreachable cluster.
+	if _, _, err := ck.GetOK("k"); err != ErrCircuitOpen {
+		t.Fatalf("GetOK with open breaker: %v, want ErrCircuitOpen", err)
+	}
+}
+
+// TestBreakerFailsFastEndToEnd accumulates the failures the honest
+// way: a client pointed at a network with no view service on it keeps
+// failing its calls, and once the threshold is crossed the retry loop
+// exits with ErrCircuitOpen rather than retrying forever.
+func TestBreakerFailsFastEndToEnd(t *testing.T) {
+	ck := MakeClientWithConfig(ClientConfig{
+		Transport:        transporttest.New(),
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	}, "vs")
+	defer ck.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := ck.GetOK("k")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrCircuitOpen {
+			t.Fatalf("GetOK: %v, want ErrCircuitOpen", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetOK still retrying; the breaker never tripped")
+	}
+}
+
+// TestBreakerHalfOpenSingleProbe pins the half-open protocol: once
+// the cooldown passes exactly one caller gets through to probe, every
+// other caller keeps failing fast, and a failed probe re-opens the
+// circuit for another full cooldown.
+func TestBreakerHalfOpenSingleProbe(t *testing.T) {
+	ck := MakeClientWithConfig(ClientConfig{
+		Transport:        transporttest.New(),
+		BreakerThreshold: 1,
+		BreakerCooldown:  50 * time.Millisecond,
+	}, "vs")
+	defer ck.Close()
+
+	ck.breakerRecord(false)
+	if err := ck.breakerCheck(); err != ErrCircuitOpen {
+		t.Fatalf("breakerCheck while open: %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := ck.breakerCheck(); err != nil {
+		t.Fatalf("probe after cooldown refused: %v", err)
+	}
+	// The probe is out; a second caller must not slip through.
+	if err := ck.breakerCheck(); err != ErrCircuitOpen {
+		t.Fatalf("second caller during probe: %v, want ErrCircuitOpen", err)
+	}
+	// The probe fails: fully open again, even past the old deadline.
+	ck.breakerRecord(false)
+	if err := ck.breakerCheck(); err != ErrCircuitOpen {
+		t.Fatalf("breakerCheck after failed probe: %v, want ErrCircuitOpen", err)
+	}
+}
+
+// TestBreakerResetOnSuccess pins recovery: a successful probe closes
+// the circuit and zeroes the failure count, so the next lone failure
+// starts a fresh run toward the threshold instead of re-opening at
+// once.
+func TestBreakerResetOnSuccess(t *testing.T) {
+	ck := MakeClientWithConfig(ClientConfig{
+		Transport:        transporttest.New(),
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+	}, "vs")
+	defer ck.Close()
+
+	ck.breakerRecord(false)
+	ck.breakerRecord(false)
+	if err := ck.breakerCheck(); err != ErrCircuitOpen {
+		t.Fatalf("breakerCheck while open: %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := ck.breakerCheck(); err != nil {
+		t.Fatalf("probe after cooldown refused: %v", err)
+	}
+	ck.breakerRecord(true)
+	if err := ck.breakerCheck(); err != nil {
+		t.Fatalf("breakerCheck after successful probe: %v", err)
+	}
+	// One failure on a closed breaker is below the threshold again.
+	ck.breakerRecord(false)
+	if err := ck.breakerCheck(); err != nil {
+		t.Fatalf("breaker re-opened on a single post-recovery failure: %v", err)
+	}
+}
+
+// TestWatchNotifiesOnChange covers the watch happy path: a watcher on
+// a prefix sees a write under it, and writes outside the prefix never
+// surface as events.
+func TestWatchNotifiesOnChange(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("seed", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	events, stop := ck.Watch("w/")
+	defer stop()
+
+	// The watch subscribes from "now", so a write racing the first
+	// poll can be missed; keep writing — noise outside the prefix and
+	// a key under it — until an event lands.
+	writer := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer writer.Close()
+	stopWrites := make(chan struct{})
+	defer close(stopWrites)
+	go func() {
+		for i := 0; ; i++ {
+			writer.Put("noise", "n")
+			writer.Put("w/a", "v")
+			select {
+			case <-stopWrites:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	select {
+	case ev := <-events:
+		if ev.Key != "w/a" {
+			t.Fatalf("event for %q leaked past the prefix filter", ev.Key)
+		}
+		if ev.Seq == 0 {
+			t.Fatalf("event carries no sequence: %+v", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event for a write under the watched prefix")
+	}
+}
+
+// TestWaitForChangeTimeoutAndResume drives the poll window from a
+// fake clock: an expired poll reports Timeout with the sequence it
+// scanned up to, and a follow-up poll resuming from that sequence
+// sees only newer changes under the prefix.
+func TestWaitForChangeTimeoutAndResume(t *testing.T) {
+	net := transporttest.New()
+	clk := clocktest.New(time.Unix(1000, 0))
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	// The change log, not the replication machinery, is under test;
+	// feed it directly.
+	record := func(key string) {
+		kv.mu.Lock()
+		kv.recordChangeLocked(key)
+		kv.mu.Unlock()
+	}
+	record("a/1") // seq 1, already seen by the watcher below
+
+	done := make(chan WaitForChangeReply, 1)
+	go func() {
+		var reply WaitForChangeReply
+		if err := kv.WaitForChange(&WaitForChangeArgs{Prefix: "a/", SinceSeq: 1}, &reply); err != nil {
+			t.Errorf("WaitForChange: %v", err)
+		}
+		done <- reply
+	}()
+
+	// Advance until the poll's timer (created once the goroutine is
+	// parked) comes due.
+	deadline := time.Now().Add(5 * time.Second)
+	var reply WaitForChangeReply
+poll:
+	for {
+		clk.Advance(watchPollTimeout)
+		select {
+		case reply = <-done:
+			break poll
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WaitForChange never timed out on the fake clock")
+		}
+	}
+	if !reply.Timeout || reply.Err != OK {
+		t.Fatalf("expired poll: %+v, want Timeout", reply)
+	}
+	if reply.Seq != 1 {
+		t.Fatalf("expired poll resumes at seq %d, want 1", reply.Seq)
+	}
+
+	// Changes land while the watcher is away; resuming from the
+	// returned sequence must deliver the newer match and skip both
+	// the old change and the one outside the prefix.
+	record("b/x") // seq 2
+	record("a/2") // seq 3
+	var next WaitForChangeReply
+	if err := kv.WaitForChange(&WaitForChangeArgs{Prefix: "a/", SinceSeq: reply.Seq}, &next); err != nil {
+		t.Fatalf("WaitForChange: %v", err)
+	}
+	if next.Key != "a/2" || next.Seq != 3 || next.Timeout {
+		t.Fatalf("resumed poll: %+v, want a/2 at seq 3", next)
+	}
+}
+
+// TestWatchResubscribesAfterFailover kills the primary under a live
+// watch: the watch loop must notice, re-subscribe on the promoted
+// backup and keep delivering events, rather than going quiet.
+func TestWatchResubscribesAfterFailover(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var v viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" && reply.PrimaryAcked {
+			v = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached an acked primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	events, stop := ck.Watch("hb/")
+	defer stop()
+
+	// A steady heartbeat of writes; the watch must deliver before and
+	// after the failover.
+	writer := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer writer.Close()
+	stopWrites := make(chan struct{})
+	defer close(stopWrites)
+	go func() {
+		for {
+			writer.Put("hb/beat", "v")
+			select {
+			case <-stopWrites:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	select {
+	case <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event before the failover")
+	}
+
+	if v.Primary == "kv1" {
+		kv1.Kill()
+	} else {
+		kv2.Kill()
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Primary == v.Backup {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backup never promoted")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	// Drain anything buffered from the old primary, then require a
+	// fresh event sourced from the new one.
+	drained := time.After(2 * time.Second)
+drain:
+	for {
+		select {
+		case <-events:
+		case <-drained:
+			break drain
+		}
+	}
+	// The watch may sit out one full poll window against the deposed
+	// primary before its view refresh moves it over.
+	select {
+	case ev := <-events:
+		if ev.Key != "hb/beat" {
+			t.Fatalf("unexpected event after failover: %+v", ev)
+		}
+	case <-time.After(watchPollTimeout + 10*time.Second):
+		t.Fatal("watch went quiet after the failover")
+	}
+}
+
+// TestLeaseExpiryFencesPrimary pins the lease self-fencing: a primary
+// that cannot reach the view service for DeadInterval must refuse
+// reads and writes, because by then the view service may have given
+// its role away and answering would split the brain.
+func TestLeaseExpiryFencesPrimary(t *testing.T) {
+	net := transporttest.New()
+	clk := clocktest.New(time.Unix(1000, 0))
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	// Tick the cluster forward until kv holds a fresh lease and
+	// serves; each advance fires the ping ticker, each sleep lets the
+	// tick goroutine run it.
+	deadline := time.Now().Add(5 * time.Second)
+	seq := int64(1)
+	for {
+		clk.Advance(viewservice.PingInterval)
+		time.Sleep(10 * time.Millisecond)
+		var reply PutReply
+		if err := kv.Put(&PutArgs{Key: "k", Value: "v", ClientID: 1, Seq: seq}, &reply); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if reply.Err == OK {
+			break
+		}
+		seq++
+		if time.Now().After(deadline) {
+			t.Fatalf("kv never became a serving primary; last Err %v", reply.Err)
+		}
+	}
+
+	// The view service goes dark. DeadInterval later the lease has
+	// lapsed without a confirming ping, and the primary must fence
+	// itself — whether or not its own ping loop has run yet.
+	vs.Kill()
+	clk.Advance(viewservice.DeadInterval + time.Millisecond)
+
+	var pr PutReply
+	if err := kv.Put(&PutArgs{Key: "k", Value: "v2", ClientID: 1, Seq: seq + 1}, &pr); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if pr.Err != ErrNotPrimary {
+		t.Fatalf("Put with lapsed lease: %v, want ErrNotPrimary", pr.Err)
+	}
+	var gr GetReply
+	if err := kv.Get(&GetArgs{Key: "k"}, &gr); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if gr.Err != ErrNotPrimary {
+		t.Fatalf("Get with lapsed lease: %v, want ErrNotPrimary", gr.Err)
+	}
+}
+
+// TestIncrSemantics pins Incr's contract: a missing key counts as
+// zero, non-integer contents are refused with ErrNotInteger, and a
+// retransmission replays the originally computed value out of the
+// dedup table instead of incrementing twice.
+func TestIncrSemantics(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	if n, err := ck.Incr("n", 5); err != nil || n != 5 {
+		t.Fatalf("Incr on a missing key: %d, %v, want 5", n, err)
+	}
+	if n, err := ck.Incr("n", -2); err != nil || n != 3 {
+		t.Fatalf("Incr: %d, %v, want 3", n, err)
+	}
+
+	if err := ck.Put("s", "abc"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := ck.Incr("s", 1); err != ErrNotInteger {
+		t.Fatalf("Incr on non-integer contents: %v, want ErrNotInteger", err)
+	}
+
+	// A client retry is the same ClientID/Seq twice; the second call
+	// must answer the recorded value, and the store must show one
+	// increment, not two.
+	args := &IncrArgs{Key: "n", Delta: 10, ClientID: 99, Seq: 1}
+	var first, second IncrReply
+	if err := kv.Incr(args, &first); err != nil || first.Err != OK || first.Value != 13 {
+		t.Fatalf("Incr: %+v, %v, want value 13", first, err)
+	}
+	if err := kv.Incr(args, &second); err != nil || second.Err != OK {
+		t.Fatalf("replayed Incr: %+v, %v", second, err)
+	}
+	if second.Value != 13 {
+		t.Fatalf("replayed Incr returned %d, want the recorded 13", second.Value)
+	}
+	if got := ck.Get("n"); got != "13" {
+		t.Fatalf("store holds %q after replay, want 13", got)
+	}
+
+	// The replay parses DedupEntry.Value; an entry recorded by a
+	// non-numeric Put under the same ClientID/Seq must answer
+	// ErrNotInteger, not nonsense.
+	var pr PutReply
+	if err := kv.Put(&PutArgs{Key: "s2", Value: "xyz", ClientID: 100, Seq: 7}, &pr); err != nil || pr.Err != OK {
+		t.Fatalf("Put: %+v, %v", pr, err)
+	}
+	var ir IncrReply
+	if err := kv.Incr(&IncrArgs{Key: "s2", Delta: 1, ClientID: 100, Seq: 7}, &ir); err != nil {
+		t.Fatalf("Incr: %v", err)
+	}
+	if ir.Err != ErrNotInteger {
+		t.Fatalf("replay over a non-numeric dedup entry: %v, want ErrNotInteger", ir.Err)
+	}
+}
+
+// TestSnapshotRestore round-trips the admin snapshot: SnapshotTo
+// writes the primary's contents to a file, a role-holder refuses to
+// be overwritten by RestoreFrom, and an idle server restored from the
+// file ends up bit-identical to the source.
+func TestSnapshotRestore(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	for _, kv := range []struct{ k, v string }{{"a", "1"}, {"b", "2"}} {
+		if err := ck.Put(kv.k, kv.v); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "snap")
+	var sr SnapshotToReply
+	if err := kv1.SnapshotTo(&SnapshotToArgs{Path: path}, &sr); err != nil {
+		t.Fatalf("SnapshotTo: %v", err)
+	}
+	if sr.Keys != 2 {
+		t.Fatalf("snapshot reports %d keys, want 2", sr.Keys)
+	}
+
+	// Restoring onto a live replica would diverge it from its peer.
+	var rr RestoreFromReply
+	if err := kv1.RestoreFrom(&RestoreFromArgs{Path: path}, &rr); err == nil {
+		t.Fatal("RestoreFrom onto the primary did not refuse")
+	}
+
+	// An idle server — its own network, so the view service never
+	// recruits it — accepts the restore.
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), transporttest.New())
+	t.Cleanup(kv2.Kill)
+	if err := kv2.RestoreFrom(&RestoreFromArgs{Path: path}, &rr); err != nil {
+		t.Fatalf("RestoreFrom: %v", err)
+	}
+	if rr.Keys != 2 {
+		t.Fatalf("restore reports %d keys, want 2", rr.Keys)
+	}
+
+	var v1, v2 VerifyStateReply
+	if err := kv1.VerifyState(&VerifyStateArgs{}, &v1); err != nil {
+		t.Fatalf("VerifyState: %v", err)
+	}
+	if err := kv2.VerifyState(&VerifyStateArgs{}, &v2); err != nil {
+		t.Fatalf("VerifyState: %v", err)
+	}
+	if v1.Checksum != v2.Checksum || v2.Keys != 2 {
+		t.Fatalf("restored state diverges: %+v vs %+v", v1, v2)
+	}
+}
+
+// TestPutIfAbsent pins the write-once contract: the first writer
+// wins, later attempts report false without clobbering the value, and
+// a retransmission gets its recorded answer even if the key has been
+// deleted in between.
+func TestPutIfAbsent(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	if created, err := ck.PutIfAbsent("k", "first"); err != nil || !created {
+		t.Fatalf("PutIfAbsent on a fresh key: %v, %v, want created", created, err)
+	}
+	if created, err := ck.PutIfAbsent("k", "second"); err != nil || created {
+		t.Fatalf("PutIfAbsent on a set key: %v, %v, want refused", created, err)
+	}
+	if got := ck.Get("k"); got != "first" {
+		t.Fatalf("value clobbered: %q, want first", got)
+	}
+
+	// A retry after the key was deleted must keep its original
+	// answer: the dedup table, not the store, decides.
+	args := &PutArgs{Key: "w", Value: "once", IfNotExists: true, ClientID: 7, Seq: 1}
+	var first PutReply
+	if err := kv.Put(args, &first); err != nil || first.Err != OK {
+		t.Fatalf("Put: %+v, %v", first, err)
+	}
+	if err := ck.Delete("w"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	var replay PutReply
+	if err := kv.Put(args, &replay); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if replay.Err != OK || !replay.Duplicate {
+		t.Fatalf("replay: %+v, want the recorded OK via the dedup table", replay)
+	}
+	if _, exists, err := ck.GetOK("w"); err != nil || exists {
+		t.Fatalf("replay re-applied the write: exists=%v, %v", exists, err)
+	}
+}
+
+// TestGetMany covers the batch read: one round trip returns exactly
+// the keys that exist, silently omitting the missing ones.
+func TestGetMany(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	for _, p := range []struct{ k, v string }{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		if err := ck.Put(p.k, p.v); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	values, err := ck.GetMany([]string{"a", "c", "missing"})
+	if err != nil {
+		t.Fatalf("GetMany: %v", err)
+	}
+	want := map[string]string{"a": "1", "c": "3"}
+	if len(values) != len(want) {
+		t.Fatalf("GetMany returned %v, want %v", values, want)
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Fatalf("GetMany[%q] = %q, want %q", k, values[k], v)
+		}
+	}
+	if _, ok := values["missing"]; ok {
+		t.Fatal("GetMany invented a value for a missing key")
+	}
+}
+
+// TestSizeLimits pins the key/value bounds: an oversized key or value
+// answers ErrTooLarge — surfaced by the client rather than retried —
+// while writes within the limits keep flowing.
+func TestSizeLimits(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+	kv.SetSizeLimits(8, 16)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	if err := ck.Put("fits", strings.Repeat("v", 16)); err != nil {
+		t.Fatalf("Put within limits: %v", err)
+	}
+	if err := ck.Put(strings.Repeat("k", 9), "v"); !IsTooLarge(err) {
+		t.Fatalf("Put with oversized key: %v, want ErrTooLarge", err)
+	}
+	if err := ck.Put("fits", strings.Repeat("v", 17)); !IsTooLarge(err) {
+		t.Fatalf("Put with oversized value: %v, want ErrTooLarge", err)
+	}
+	// The refusal left the stored value alone.
+	if got := ck.Get("fits"); got != strings.Repeat("v", 16) {
+		t.Fatalf("stored value changed by a refused Put: %q", got)
+	}
+	// Incr is bounded on the key too.
+	if _, err := ck.Incr(strings.Repeat("n", 9), 1); !IsTooLarge(err) {
+		t.Fatalf("Incr with oversized key: %v, want ErrTooLarge", err)
+	}
+}
+
+// TestStepDownHandsOver exercises the graceful handover: StepDown on
+// the primary promotes the backup, the data survives the swap, and
+// the old primary fences itself immediately instead of serving on a
+// view it just gave away.
+func TestStepDownHandsOver(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var v viewservice.View
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" && reply.PrimaryAcked {
+			v = reply.View
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached an acked primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, err := ck.StepDown(v.Primary, ""); err != nil {
+		t.Fatalf("StepDown: %v", err)
+	}
+
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil && reply.View.Primary == v.Backup {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backup never took over after StepDown")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	if got := ck.Get("k"); got != "v" {
+		t.Fatalf("Get after handover: %q, want v", got)
+	}
+
+	// The deposed primary dropped its lease in StepDown, so it
+	// refuses reads at once — no window where both ends answer.
+	old := kv1
+	if v.Primary == "kv2" {
+		old = kv2
+	}
+	var gr GetReply
+	if err := old.Get(&GetArgs{Key: "k"}, &gr); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if gr.Err != ErrNotPrimary {
+		t.Fatalf("deposed primary answered %v, want ErrNotPrimary", gr.Err)
+	}
+}
+
+// TestGetLinearizable pins the read barrier: a linearizable read
+// answers normally while the view service confirms the caller's
+// role, and refuses — unlike a plain lease-based read — the moment
+// the confirmation cannot be obtained.
+func TestGetLinearizable(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if v, exists, err := ck.GetLinearizable("k"); err != nil || !exists || v != "v" {
+		t.Fatalf("GetLinearizable: %q, %v, %v", v, exists, err)
+	}
+	if _, exists, err := ck.GetLinearizable("missing"); err != nil || exists {
+		t.Fatalf("GetLinearizable on a missing key: exists=%v, %v", exists, err)
+	}
+
+	// With the view service gone the primary cannot confirm its role.
+	// Its lease is still fresh, so a plain read answers, but the
+	// linearizable read must refuse rather than risk answering after
+	// a view it hasn't heard about.
+	vs.Kill()
+	var plain, lin GetReply
+	if err := kv.Get(&GetArgs{Key: "k"}, &plain); err != nil || plain.Err != OK {
+		t.Fatalf("plain Get on a fresh lease: %+v, %v", plain, err)
+	}
+	if err := kv.Get(&GetArgs{Key: "k", Linearizable: true}, &lin); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if lin.Err != ErrNotPrimary {
+		t.Fatalf("unconfirmed linearizable read answered %v, want ErrNotPrimary", lin.Err)
+	}
+}
+
+// TestFlushClearsBothReplicas covers the admin wipe: Flush empties
+// the primary and its backup in one call, and the pair keeps serving
+// fresh writes afterwards.
+func TestFlushClearsBothReplicas(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" && reply.PrimaryAcked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached an acked primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	if err := ck.Put("k", "v"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := ck.Flush(""); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if _, exists, err := ck.GetOK("k"); err != nil || exists {
+		t.Fatalf("key survived the flush: exists=%v, %v", exists, err)
+	}
+	for _, kv := range []*KVServer{kv1, kv2} {
+		var vr VerifyStateReply
+		if err := kv.VerifyState(&VerifyStateArgs{}, &vr); err != nil {
+			t.Fatalf("VerifyState: %v", err)
+		}
+		if vr.Keys != 0 {
+			t.Fatalf("%d keys left on a replica after the flush", vr.Keys)
+		}
+	}
+
+	if err := ck.Put("k2", "v2"); err != nil {
+		t.Fatalf("Put after flush: %v", err)
+	}
+	if got := ck.Get("k2"); got != "v2" {
+		t.Fatalf("Get after flush: %q, want v2", got)
+	}
+}
+
+// TestInspectReportsModification pins the per-key metadata: Inspect
+// reports the stamp of the latest write, the per-key sequence counts
+// each modification, and a missing key reads as absent.
+func TestInspectReportsModification(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv.Kill)
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+
+	if _, exists, err := ck.Inspect("k"); err != nil || exists {
+		t.Fatalf("Inspect on a missing key: exists=%v, %v", exists, err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	if err := ck.Put("k", "v1"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	meta, exists, err := ck.Inspect("k")
+	if err != nil || !exists {
+		t.Fatalf("Inspect: exists=%v, %v", exists, err)
+	}
+	if meta.ModSeq != 1 {
+		t.Fatalf("ModSeq after first write = %d, want 1", meta.ModSeq)
+	}
+	if meta.ModView == 0 {
+		t.Fatal("ModView not stamped")
+	}
+	if meta.ModTime.Before(before) {
+		t.Fatalf("ModTime %v predates the write", meta.ModTime)
+	}
+
+	if err := ck.Put("k", "v2"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	meta2, _, err := ck.Inspect("k")
+	if err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	if meta2.ModSeq != 2 {
+		t.Fatalf("ModSeq after second write = %d, want 2", meta2.ModSeq)
+	}
+	if meta2.ModTime.Before(meta.ModTime) {
+		t.Fatalf("ModTime went backwards: %v then %v", meta.ModTime, meta2.ModTime)
+	}
+}
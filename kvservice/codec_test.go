@@ -0,0 +1,52 @@
+package kvservice
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Both codecs must round-trip a full snapshot: contents, dedup table
+// and per-key metadata.
+func TestCodecsRoundTrip(t *testing.T) {
+	snap := snapshotFile{
+		Data: map[string]string{"a": "1", "b": "", "weird key\n": "x"},
+		LastSeq: map[int64]DedupEntry{
+			7: {Seq: 3, Value: "1", Err: OK},
+			9: {Seq: 5, Err: ErrExists},
+		},
+		Meta: map[string]KeyMeta{
+			"a": {ModView: 2, ModTime: time.Unix(1000, 0).UTC()},
+		},
+	}
+
+	for name, codec := range map[string]Codec{"gob": GobCodec{}, "json": JSONCodec{}} {
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, &snap); err != nil {
+			t.Fatalf("%s: Encode: %v", name, err)
+		}
+		var got snapshotFile
+		if err := codec.Decode(&buf, &got); err != nil {
+			t.Fatalf("%s: Decode: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, snap) {
+			t.Errorf("%s: round trip changed the snapshot:\ngot  %+v\nwant %+v", name, got, snap)
+		}
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	if _, ok := CodecByName("gob"); !ok {
+		t.Error("gob not recognized")
+	}
+	if _, ok := CodecByName("json"); !ok {
+		t.Error("json not recognized")
+	}
+	if _, ok := CodecByName(""); !ok {
+		t.Error("empty name should mean the default codec")
+	}
+	if _, ok := CodecByName("xml"); ok {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,538 @@
+package kvservice
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"dsdemo/viewservice"
+)
+
+// Err is the error code carried in RPC replies. It implements the
+// error interface, so the client can hand codes straight back to
+// callers as typed errors; the Is* helpers below classify them
+// without string comparison. On the wire it stays a plain string.
+type Err string
+
+func (e Err) Error() string {
+	return "kvservice: " + string(e)
+}
+
+// errCode extracts the service error code from err, or "" if err
+// does not carry one (transport failures, client-side errors). It
+// sees through wrapping.
+func errCode(err error) Err {
+	var e Err
+	if errors.As(err, &e) {
+		return e
+	}
+	return ""
+}
+
+// IsNoKey reports whether err says the key does not exist.
+func IsNoKey(err error) bool { return errCode(err) == ErrNoKey }
+
+// IsNotPrimary reports whether err says the addressed server is not
+// the primary.
+func IsNotPrimary(err error) bool { return errCode(err) == ErrNotPrimary }
+
+// IsNotInteger reports whether err says the stored value is not a
+// valid integer.
+func IsNotInteger(err error) bool { return errCode(err) == ErrNotInteger }
+
+// IsExists reports whether err says an IfNotExists Put found the key
+// already set.
+func IsExists(err error) bool { return errCode(err) == ErrExists }
+
+// IsTooLarge reports whether err says a key or value exceeded the
+// server's size limits.
+func IsTooLarge(err error) bool { return errCode(err) == ErrTooLarge }
+
+// IsFull reports whether err says the server is at its key-count
+// limit.
+func IsFull(err error) bool { return errCode(err) == ErrFull }
+
+// IsBusy reports whether err says the server is temporarily unable
+// to serve (state transfer in flight, incomplete replica).
+func IsBusy(err error) bool { return errCode(err) == ErrBusy }
+
+// IsRejected reports whether err says the server's Put interceptor
+// refused the write.
+func IsRejected(err error) bool { return errCode(err) == ErrRejected }
+
+// IsRateLimited reports whether err says the server's rate limiter
+// turned the request away.
+func IsRateLimited(err error) bool { return errCode(err) == ErrRateLimited }
+
+// stateChecksum hashes the full key/value contents (FNV-1a over
+// sorted key/value pairs), so two replicas can be compared cheaply.
+func stateChecksum(data map[string]string) uint64 {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(data[k]))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+const (
+	OK            Err = "OK"
+	ErrNoKey      Err = "ErrNoKey"
+	ErrNotPrimary Err = "ErrNotPrimary"
+	ErrNotBackup  Err = "ErrNotBackup"
+	ErrNotInteger Err = "ErrNotInteger"
+	// ErrExists means a Put with IfNotExists found the key already
+	// set.
+	ErrExists Err = "ErrExists"
+	// ErrTooLarge means a key or value exceeded the server's size
+	// limits. Not retryable: the client reports it to the caller.
+	ErrTooLarge Err = "ErrTooLarge"
+	// ErrFull means the server hit its MaxKeys limit; writes that
+	// would create a new key are rejected until space is freed, while
+	// updates to existing keys still succeed.
+	ErrFull Err = "ErrFull"
+	ErrBusy Err = "ErrBusy"
+	// ErrRejected means the server's Put interceptor refused the
+	// write; the reply's Message carries the reason. Not retryable.
+	ErrRejected Err = "ErrRejected"
+	// ErrRateLimited means the server's rate limiter had no token for
+	// the request. Retryable: clients back off and resend.
+	ErrRateLimited Err = "ErrRateLimited"
+	// ErrVersion means a conditional Put found the key's sequence
+	// different from what the caller expected: someone else wrote in
+	// between. Not retryable as-is; the caller re-reads and decides.
+	ErrVersion Err = "ErrVersion"
+	// ErrNoBackup means the server is configured to require a backup
+	// (SetRequireBackup) and refused a write while serving alone.
+	// Retryable: the view service recruits a backup as soon as a
+	// server is available, and the client resends after it.
+	ErrNoBackup Err = "ErrNoBackup"
+	// ErrForward means the primary could not replicate a write to a
+	// live backup and refused to apply it locally. Retryable: the
+	// client should refresh the view and resend.
+	ErrForward Err = "ErrForward"
+	// ErrBadTransfer means a SyncChunk/SyncEnd referenced a transfer
+	// the backup doesn't have open.
+	ErrBadTransfer Err = "ErrBadTransfer"
+	// ErrChecksum means transferred state didn't hash to what the
+	// primary sent.
+	ErrChecksum Err = "ErrChecksum"
+)
+
+// PutArgs carries a client write. ClientID and Seq let the servers
+// filter duplicate retransmissions of the same Put.
+type PutArgs struct {
+	Key   string
+	Value string
+	// ValueBytes, when non-nil, carries the value instead of Value.
+	// Gob encodes []byte without the copy a string conversion costs,
+	// so byte-oriented callers use it for binary and large values;
+	// the server folds it into Value on arrival.
+	ValueBytes []byte
+	Delete     bool // remove Key instead of storing Value
+	// IfNotExists makes the Put fail with ErrExists if the key is
+	// already set, giving write-once semantics.
+	IfNotExists bool
+	// IfVersion makes the Put fail with ErrVersion unless the key's
+	// per-key sequence (KeyMeta.ModSeq) currently equals ExpectedSeq,
+	// giving compare-and-set on the sequence a GetVersioned returned.
+	// ExpectedSeq 0 matches a key that doesn't exist (or one last
+	// written by a binary from before sequences were stamped).
+	IfVersion   bool
+	ExpectedSeq uint64
+	ClientID    int64
+	Seq         int64
+}
+
+type PutReply struct {
+	Err Err
+	// Message carries detail for ErrRejected: the interceptor's
+	// reason for refusing the write.
+	Message string
+	// ViewNum is the view in which the server handled the request, so
+	// callers can detect a failover between two operations.
+	ViewNum uint
+	// Duplicate is true when the dedup table short-circuited the
+	// request: the write had already been executed and Err repeats its
+	// recorded outcome. Servers from before the field existed never
+	// set it, so it reads false from them.
+	Duplicate bool
+}
+
+type GetArgs struct {
+	Key string
+	// AllowStale lets the backup answer the read directly; the value
+	// may be slightly behind the primary.
+	AllowStale bool
+	// Linearizable makes the primary re-confirm its leadership with
+	// the view service before answering, closing the fencing window
+	// where a deposed primary could still serve within its lease.
+	// Trades a view-service round trip per read for strictness.
+	Linearizable bool
+	// Bytes asks for the value in the reply's ValueBytes instead of
+	// Value, avoiding a string copy for binary and large values.
+	Bytes bool
+}
+
+type GetReply struct {
+	Err   Err
+	Value string
+	// ValueBytes holds the value when the request asked for Bytes;
+	// Value is then left empty.
+	ValueBytes []byte
+	// ViewNum is the view in which the server handled the request.
+	ViewNum uint
+}
+
+// Exists reports whether a key is set without copying its value into
+// the reply, so existence checks on large values cost no bandwidth.
+// Same primary and fencing rules as Get.
+type ExistsArgs struct {
+	Key string
+}
+
+type ExistsReply struct {
+	Err    Err
+	Exists bool
+	// ViewNum is the view in which the server handled the request.
+	ViewNum uint
+}
+
+// GetVersioned is Get plus the key's per-key sequence number, the
+// token a later PutIfVersion conditions on. Same primary and fencing
+// rules as Get.
+type GetVersionedArgs struct {
+	Key string
+}
+
+type GetVersionedReply struct {
+	Err   Err
+	Value string
+	// Seq is the key's current sequence; 0 for a key that doesn't
+	// exist, so Get-then-PutIfVersion also works as create-if-absent.
+	Seq uint64
+	// ViewNum is the view in which the server handled the request.
+	ViewNum uint
+}
+
+// GetMany fetches several keys in one RPC, under a single lock
+// acquisition on the server. Absent keys are simply omitted from the
+// reply, so the result map is a consistent point-in-time read of the
+// keys that exist.
+type GetManyArgs struct {
+	Keys []string
+}
+
+type GetManyReply struct {
+	Err     Err
+	Values  map[string]string
+	ViewNum uint
+}
+
+// WaitForChange is a long poll: it blocks until some key under
+// Prefix changes with a change sequence greater than SinceSeq, or the
+// server's poll window elapses. SinceSeq zero means "from now". The
+// client's Watch wrapper turns repeated polls into a channel.
+type WaitForChangeArgs struct {
+	Prefix   string
+	SinceSeq uint64
+}
+
+type WaitForChangeReply struct {
+	Err Err
+	// Timeout is true when the poll window elapsed with no matching
+	// change; Seq then carries the latest sequence already scanned,
+	// so the next poll can skip it.
+	Timeout bool
+	Key     string
+	Seq     uint64
+}
+
+// IncrArgs asks the primary to add Delta to the integer stored under
+// Key, treating a missing or empty value as 0.
+type IncrArgs struct {
+	Key      string
+	Delta    int64
+	ClientID int64
+	Seq      int64
+}
+
+type IncrReply struct {
+	Err   Err
+	Value int64 // the value after the increment
+}
+
+// Txn applies several puts and deletes as one atomic unit: either
+// every mutation lands on both replicas or none does, so a failover
+// can't expose a half-applied set. The whole transaction shares one
+// dedup slot, so a retransmission is filtered as a unit too.
+type TxnArgs struct {
+	Puts     map[string]string
+	Deletes  []string
+	ClientID int64
+	Seq      int64
+}
+
+type TxnReply struct {
+	Err Err
+	// ViewNum is the view in which the server handled the request.
+	ViewNum uint
+}
+
+// DedupEntry records the last applied request from a client together
+// with the value it wrote and how it resolved, so a retransmission
+// gets the same answer (Incr must not be applied twice, and a failed
+// IfNotExists Put must keep failing even if the key disappears
+// between retries).
+type DedupEntry struct {
+	Seq   int64
+	Value string
+	Err   Err // "" in entries from before this field existed; read as OK
+}
+
+// WireVersion is bumped whenever an inter-server RPC struct changes
+// incompatibly. Gob tolerates added fields silently, which makes
+// mixed-version clusters fail in confusing ways during rolling
+// upgrades; the version lets the receiver notice and say so.
+const WireVersion = 10
+
+// WireHeader rides at the front of inter-server RPC args. A receiver
+// logs a warning when a peer's version differs from its own (a zero
+// version means a binary from before the header existed).
+type WireHeader struct {
+	WireVersion int
+}
+
+// KeyMeta is per-key modification metadata: the view and wall time
+// of the last write that touched the key. The primary stamps both
+// and replicates the stamp, so primary and backup report identical
+// metadata even though their clocks differ.
+type KeyMeta struct {
+	ModView uint
+	ModTime time.Time
+	// ModSeq is the key's per-key sequence: it starts at 1 on the
+	// first write and increments on every later one. GetVersioned
+	// reports it and PutIfVersion conditions on it, so the stamp is
+	// replicated like the rest of the metadata and conditional writes
+	// keep working across a failover. Keys last written by an older
+	// binary read as 0.
+	ModSeq uint64
+	// Compressed marks a value stored gzip-compressed. The stamp
+	// travels with every forward and state transfer, so the backup
+	// holds the same compressed bytes and both replicas know to
+	// decompress on reads.
+	Compressed bool
+}
+
+// ForwardArgs wraps a write the primary replicates to the backup.
+// ViewNum is the view the primary believes it is serving; the backup
+// rejects forwards from an older view so a deposed primary cannot
+// corrupt its successor's backup. Sender is the primary's advertised
+// name: a forward for the backup's own view whose sender isn't that
+// view's primary is rejected too, so mis-roled servers surface as
+// errors instead of writes bouncing between them. Meta is the
+// primary's metadata stamp for the written key.
+type ForwardArgs struct {
+	WireHeader
+	ViewNum uint
+	Sender  string
+	Update  PutArgs
+	Meta    KeyMeta
+}
+
+// ForwardTxn wraps a transaction the primary replicates to the
+// backup as a single unit, under the same view and sender fencing as
+// ForwardArgs. Meta carries the primary's metadata stamps for every
+// key the transaction writes.
+type ForwardTxnArgs struct {
+	WireHeader
+	ViewNum uint
+	Sender  string
+	Update  TxnArgs
+	Meta    map[string]KeyMeta
+}
+
+// State transfer to a freshly assigned backup is chunked so a large
+// dataset doesn't travel as one huge gob message: SyncBegin opens a
+// staging area, SyncChunk appends batches of keys to it, and SyncEnd
+// atomically swaps the staged state in. A transfer that never
+// reaches SyncEnd leaves the backup's data untouched.
+type SyncBeginArgs struct {
+	WireHeader
+	TransferID int64
+	// ViewNum is the view the primary is syncing under. The backup
+	// rejects a transfer from an older view, so a deposed primary
+	// that crashed mid-transfer cannot resume it against the new
+	// regime's backup.
+	ViewNum uint
+	// Sender is the primary's advertised name. The backup also
+	// rejects a transfer whose sender isn't its view's primary; a
+	// rogue or misconfigured server must not be able to overwrite a
+	// replica just by knowing the protocol.
+	Sender string
+}
+
+type SyncBeginReply struct {
+	Err Err
+}
+
+type SyncChunkArgs struct {
+	WireHeader
+	TransferID int64
+	// Seq numbers the chunks within a transfer from 1. A chunk the
+	// backup already merged is acknowledged without re-merging, so
+	// the primary can resend after a dropped reply and resume from
+	// the last acknowledged chunk. 0 (a pre-Seq sender) always
+	// merges.
+	Seq  int
+	Data map[string]string
+	// Meta carries the modification metadata for the keys in Data.
+	Meta map[string]KeyMeta
+}
+
+type SyncChunkReply struct {
+	Err Err
+}
+
+type SyncEndArgs struct {
+	WireHeader
+	TransferID int64
+	LastSeq    map[int64]DedupEntry
+	// Checksum is stateChecksum over the full transferred contents;
+	// the backup recomputes it before swapping the state in.
+	Checksum uint64
+	// Tombstones carries the sender's soft-delete markers, stamped
+	// with the sender's clock; the receiver reaps them by its own
+	// clock. Absent from old senders, which leaves the receiver's
+	// set empty.
+	Tombstones map[string]time.Time
+}
+
+type SyncEndReply struct {
+	Err Err
+}
+
+// SnapshotTo and RestoreFrom are operator RPCs for backup and
+// migration: SnapshotTo serializes the full contents (and dedup
+// table) to a file on the server's host, RestoreFrom loads such a
+// file into an idle server before it joins a view. Both are guarded
+// by the server's admin secret, if one is configured.
+type SnapshotToArgs struct {
+	Secret string
+	Path   string
+}
+
+type SnapshotToReply struct {
+	Keys int // number of keys written
+}
+
+type RestoreFromArgs struct {
+	Secret string
+	Path   string
+}
+
+type RestoreFromReply struct {
+	Keys int // number of keys loaded
+}
+
+// AdminResync asks the primary to re-stream its full state to the
+// current backup immediately, for an operator who suspects the
+// backup has diverged and doesn't want to wait for the periodic
+// verify pass. Guarded by the server's admin secret, if one is
+// configured.
+type AdminResyncArgs struct {
+	Secret string
+}
+
+type AdminResyncReply struct {
+	// Err is ErrBusy when a state transfer is already in flight, OK
+	// once the resync completed.
+	Err Err
+}
+
+// Flush wipes the entire store and dedup table without a restart,
+// for test environments. Guarded by the server's admin secret; the
+// primary forwards the flush to its backup.
+type FlushArgs struct {
+	Secret string
+}
+
+type FlushReply struct {
+}
+
+// StepDown asks the primary to hand its role to the backup for a
+// rolling restart: it verifies the backup is fully synced, asks the
+// view service to demote it, then fences itself so clients get a
+// retryable redirect instead of stale answers. Guarded by the
+// server's admin secret; the same secret is passed on to the view
+// service.
+type StepDownArgs struct {
+	Secret string
+}
+
+type StepDownReply struct {
+	// Queued means the view service deferred the demotion until the
+	// current view is acked; it applies on a later tick.
+	Queued bool
+	View   viewservice.View
+}
+
+// Inspect asks a server when a key was last modified. The metadata
+// is stamped by the primary and replicated with the write, so
+// primary and backup answer identically for a given key.
+type InspectArgs struct {
+	Key string
+}
+
+type InspectReply struct {
+	Err  Err
+	Meta KeyMeta
+}
+
+// VerifyState asks a server for a checksum of its current contents,
+// so an operator can compare primary and backup on demand.
+type VerifyStateArgs struct {
+}
+
+type VerifyStateReply struct {
+	Checksum uint64
+	Keys     int
+}
+
+// Stats reports capacity figures so operators can alert before the
+// server hits its limits.
+type StatsArgs struct {
+}
+
+type StatsReply struct {
+	Keys int
+	// ApproxBytes is the summed key and value lengths, a cheap
+	// approximation of the dataset's memory footprint.
+	ApproxBytes int64
+	MaxKeys     int // 0 means unlimited
+	// Syncing is true while a state transfer to a new backup is in
+	// flight.
+	Syncing bool
+	// OpenConns is how many accepted connections are being served
+	// right now, for alerting against the SetMaxConns cap.
+	OpenConns int
+}
+
+// Health is a read-only liveness probe for monitoring tools. It does
+// not touch RPC counters.
+type HealthArgs struct {
+}
+
+type HealthReply struct {
+	Role    string
+	Alive   bool
+	ViewNum uint
+}
@@ -0,0 +1,39 @@
+package kvservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// compressValue gzips v and reports whether the compressed form is
+// actually smaller. Values that don't shrink (already compressed
+// data, short strings) are returned unchanged with false, so they
+// are stored plain rather than padded by the gzip framing.
+func compressValue(v string) (string, bool) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(v))
+	w.Close()
+	if buf.Len() >= len(v) {
+		return v, false
+	}
+	return buf.String(), true
+}
+
+// decompressValue reverses compressValue. An error means the stored
+// bytes are not valid gzip — corruption, since only compressValue's
+// output is ever stamped Compressed.
+func decompressValue(v string) (string, error) {
+	r, err := gzip.NewReader(strings.NewReader(v))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
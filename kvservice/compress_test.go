@@ -0,0 +1,96 @@
+package kvservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"dsdemo/clock"
+	"dsdemo/transport/transporttest"
+	"dsdemo/viewservice"
+)
+
+func TestCompressValueRoundTrip(t *testing.T) {
+	big := strings.Repeat("large json blob ", 256)
+	c, ok := compressValue(big)
+	if !ok {
+		t.Fatal("repetitive value did not compress")
+	}
+	if len(c) >= len(big) {
+		t.Fatalf("compressed %d bytes into %d", len(big), len(c))
+	}
+	got, err := decompressValue(c)
+	if err != nil {
+		t.Fatalf("decompressValue: %v", err)
+	}
+	if got != big {
+		t.Fatal("round trip changed the value")
+	}
+
+	// Incompressible input is left alone instead of being inflated.
+	if _, ok := compressValue("x"); ok {
+		t.Fatal("one-byte value reported as compressed")
+	}
+	if _, err := decompressValue("not gzip"); err == nil {
+		t.Fatal("decompressing garbage succeeded")
+	}
+}
+
+// TestCompressionReplicates checks that a value over the threshold is
+// stored compressed on both replicas and served plain from either.
+func TestCompressionReplicates(t *testing.T) {
+	net := transporttest.New()
+	clk := clock.Real()
+
+	vs := viewservice.StartServerWithTransport("vs", clk, net)
+	t.Cleanup(vs.Kill)
+	kv1 := StartServerWithTransport("vs", "kv1", "kv1", clk, NewMapStore(), net)
+	t.Cleanup(kv1.Kill)
+	kv2 := StartServerWithTransport("vs", "kv2", "kv2", clk, NewMapStore(), net)
+	t.Cleanup(kv2.Kill)
+	kv1.SetCompressionThreshold(64)
+	kv2.SetCompressionThreshold(64)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reply viewservice.GetReply
+		if vs.Get(&viewservice.GetArgs{}, &reply) == nil &&
+			reply.View.Primary != "" && reply.View.Backup != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("view never reached primary+backup")
+		}
+		time.Sleep(viewservice.PingInterval / 2)
+	}
+
+	ck := MakeClientWithConfig(ClientConfig{Transport: net}, "vs")
+	defer ck.Close()
+	big := strings.Repeat("large json blob ", 256)
+	if err := ck.Put("blob", big); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := ck.Get("blob"); got != big {
+		t.Fatal("Get returned a different value than was put")
+	}
+	if got := ck.GetStale("blob"); got != big {
+		t.Fatal("backup served a different value than was put")
+	}
+
+	// Both replicas hold the same compressed bytes, not the plaintext.
+	for _, kv := range []*KVServer{kv1, kv2} {
+		kv.mu.Lock()
+		stored, ok := kv.store.Get("blob")
+		meta := kv.meta["blob"]
+		kv.mu.Unlock()
+		if !ok {
+			t.Fatalf("%s does not hold the key", kv.me)
+		}
+		if !meta.Compressed {
+			t.Fatalf("%s did not stamp the value compressed", kv.me)
+		}
+		if len(stored) >= len(big) {
+			t.Fatalf("%s stored %d bytes for a %d byte value", kv.me, len(stored), len(big))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package kvservice
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+)
+
+func TestTypedErrorHelpers(t *testing.T) {
+	if !IsNoKey(ErrNoKey) {
+		t.Error("IsNoKey(ErrNoKey) = false")
+	}
+	if !IsTooLarge(fmt.Errorf("put failed: %w", ErrTooLarge)) {
+		t.Error("IsTooLarge does not see through wrapping")
+	}
+	if IsNoKey(ErrNotPrimary) {
+		t.Error("IsNoKey(ErrNotPrimary) = true")
+	}
+	if IsBusy(errors.New("some transport failure")) {
+		t.Error("IsBusy matched a non-code error")
+	}
+	if IsFull(nil) {
+		t.Error("IsFull(nil) = true")
+	}
+	// The codes read sensibly as errors.
+	if got := ErrFull.Error(); got != "kvservice: ErrFull" {
+		t.Errorf("ErrFull.Error() = %q", got)
+	}
+}
+
+// TestUnsupportedClassification pins how a missing server method is
+// told apart from a transport failure: only net/rpc's own "can't
+// find" ServerErrors count, so a dropped connection or an
+// application error stays retryable.
+func TestUnsupportedClassification(t *testing.T) {
+	if !isUnsupported(rpc.ServerError("rpc: can't find method KVServer.Frobnicate")) {
+		t.Error("missing method not classified as unsupported")
+	}
+	if !isUnsupported(rpc.ServerError("rpc: can't find service Nope.Method")) {
+		t.Error("missing service not classified as unsupported")
+	}
+	if isUnsupported(rpc.ErrShutdown) {
+		t.Error("a dropped connection classified as unsupported; it must stay retryable")
+	}
+	if isUnsupported(errors.New("rpc: can't find method KVServer.Get")) {
+		t.Error("a non-ServerError matched; only the server's own answer counts")
+	}
+	if isUnsupported(rpc.ServerError("kvservice: some application error")) {
+		t.Error("an unrelated ServerError classified as unsupported")
+	}
+}
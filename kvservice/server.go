@@ -0,0 +1,2420 @@
+package kvservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dsdemo/clock"
+	"dsdemo/transport"
+	"dsdemo/viewservice"
+)
+
+// KVServer stores key/value data and acts as primary or backup
+// depending on what the view service says. A single binary can play
+// either role; the role can change between views.
+type KVServer struct {
+	mu       sync.Mutex
+	l        net.Listener
+	dead     atomic.Bool
+	left     atomic.Bool // Leave already sent to the view service
+	me       string
+	vs       *viewservice.Clerk
+	rpcCount int32
+
+	view    viewservice.View
+	store   Store
+	lastSeq map[int64]DedupEntry // per-client dedup table
+	// dedupTTL, when positive, evicts dedup entries for clients idle
+	// that long; dedupSeen stamps each client's last activity. See
+	// SetDedupTTL.
+	dedupTTL  time.Duration
+	dedupSeen map[int64]time.Time
+	// meta holds per-key modification metadata, stamped by the
+	// primary and replicated alongside the data.
+	meta map[string]KeyMeta
+
+	// tombstones remembers soft-deleted keys and when they died; see
+	// SetTombstoneGrace. A tombstoned key reads as missing even if a
+	// restore or resync resurrects its bytes, until the grace period
+	// reaps the marker. tombstoneGrace 0 (the default) keeps deletes
+	// hard: no markers are written.
+	tombstones     map[string]time.Time
+	tombstoneGrace time.Duration
+
+	// While a state transfer to a new backup is in flight, incoming
+	// Puts queue on transferCond instead of being applied. At most
+	// maxPending writes queue; beyond that they are rejected with
+	// ErrBusy so a slow transfer cannot buffer unboundedly.
+	transferring bool
+	pending      int
+	maxPending   int
+	transferCond *sync.Cond
+
+	// keyLocks serializes the forward+apply of writes to the same
+	// key, so two writes to one key cannot forward in one order and
+	// apply in the other, while writes to unrelated keys — and every
+	// read — proceed without waiting on a backup round trip. See
+	// lockKeys.
+	keyLocks map[string]*keyLock
+	// inflight counts writes between their forward and their local
+	// apply. A state transfer or checksum comparison waits for it to
+	// reach zero, so a snapshot can never miss a write the backup has
+	// already received.
+	inflight int
+
+	// Size limits enforced on writes; zero means unlimited.
+	maxKeySize   int
+	maxValueSize int
+	// maxKeys caps how many keys the store may hold (0 = unlimited);
+	// approxBytes tracks the summed key/value lengths for Stats.
+	maxKeys     int
+	approxBytes int64
+
+	// staging accumulates an incoming chunked state transfer until
+	// SyncEnd swaps it in. stateComplete records whether this replica
+	// ever held a full copy of the dataset: the bootstrap primary
+	// starts complete, a backup becomes complete when a transfer's
+	// SyncEnd lands. A server promoted with an incomplete copy (the
+	// primary died mid-transfer) refuses to serve rather than present
+	// a partial dataset as the whole truth.
+	staging       map[string]string
+	stagingMeta   map[string]KeyMeta
+	stagingID     int64
+	stagingSeq    int // last chunk sequence number merged into staging
+	stateComplete bool
+
+	// fwd pools persistent connections to the current backup so
+	// forwards don't pay a dial per write; fwdConns is its size.
+	fwd      *fwdPool
+	fwdConns int
+	// backupUnreachable is set when the most recent forward got no
+	// answer from the backup; the ping loop passes it on so the view
+	// service can replace a backup only this server cannot reach.
+	backupUnreachable bool
+
+	// backupSynced records whether the current backup has received a
+	// complete state transfer; until it has, pings report the backup
+	// as syncing so the view service won't promote a partial copy.
+	backupSynced bool
+
+	// deadLetter, when set, records writes whose forward failed in
+	// lenient mode; see SetDeadLetterPath.
+	deadLetter *os.File
+
+	// strictForward makes a failed forward to a live backup fail the
+	// write with ErrForward instead of applying locally anyway, so
+	// the replicas cannot silently diverge. Lenient mode is kept for
+	// setups that prefer availability over the consistency check.
+	strictForward bool
+
+	// requireBackup makes a primary serving without a backup refuse
+	// writes with ErrNoBackup, for deployments that prefer losing
+	// availability over losing an unreplicated write with the primary.
+	// The default accepts writes from a lone primary.
+	requireBackup bool
+
+	// changeSeq numbers every applied write; changes retains the most
+	// recent ones so WaitForChange long-polls can catch up. watchCh is
+	// closed and replaced on every write to wake blocked watchers.
+	changeSeq uint64
+	changes   []changeRecord
+	watchCh   chan struct{}
+
+	lastPingOK time.Time
+	// primaryConfirmed is when the view service last confirmed this
+	// server as primary. Serving is allowed only while that
+	// confirmation is fresher than DeadInterval (a lease): a
+	// partitioned primary fences itself off instead of answering
+	// with stale data until it happens to notice the view change.
+	primaryConfirmed time.Time
+
+	// verifyInterval makes the primary periodically compare state
+	// checksums with its backup and re-stream the full state on a
+	// mismatch, catching divergence from lenient forwarding before
+	// the next backup change would; 0 (the default) disables the
+	// check. lastVerify is when the previous check ran.
+	verifyInterval time.Duration
+	lastVerify     time.Time
+
+	// putInterceptor, when set, can veto writes before they are
+	// forwarded or applied; see SetPutInterceptor.
+	putInterceptor func(key, value string) error
+
+	// onRoleChange, when set, is told whenever this server's role in
+	// the view changes; see SetOnRoleChange.
+	onRoleChange func(old, new string)
+
+	// Rate limiting (see SetRateLimit): a token bucket refilled at
+	// limitRate tokens per second, with one second of burst. Each
+	// served Put, Get or Incr costs one token; an empty bucket answers
+	// ErrRateLimited. The bucket is global to the server for now, but
+	// nothing below depends on that — a per-client extension would
+	// just key several buckets. limitRate 0 disables limiting.
+	limitRate   int
+	limitTokens float64
+	limitLast   time.Time
+
+	// priority is the promotion preference reported with every ping;
+	// the view service prefers higher-priority servers when recruiting
+	// and reinstating primaries. 0 means no preference.
+	priority int
+
+	// backupOnly is reported with every ping and tells the view
+	// service never to give this server the primary role.
+	backupOnly bool
+
+	// compressThreshold makes the primary store and forward values of
+	// at least this many bytes gzip-compressed, decompressing
+	// transparently on reads; 0 disables compression.
+	compressThreshold int
+
+	// adminSecret guards admin RPCs; "" leaves them open (dev mode).
+	adminSecret string
+
+	// codec serializes snapshot files; gob unless configured.
+	codec Codec
+
+	// warnedVersions remembers which mismatched peer wire versions
+	// were already logged, so a chatty old binary warns once.
+	warnedVersions map[int]bool
+
+	// clk is the server's notion of time; tests substitute a fake
+	// clock to make view expiry deterministic.
+	clk clock.Clock
+
+	// tr is how the server listens and dials peers; tests substitute
+	// an in-memory transporttest.Network.
+	tr transport.Transport
+
+	// idleTimeout (nanoseconds) reaps accepted connections whose
+	// peer goes quiet for that long, so abandoned clients don't leak
+	// goroutines and descriptors; 0 keeps connections forever.
+	idleTimeout atomic.Int64
+
+	// connMu guards conns, the accepted connections still being
+	// served; Shutdown waits for them to drain and force-closes the
+	// stragglers when its context expires. connWG counts the same
+	// connections for the drain wait.
+	connMu sync.Mutex
+	conns  map[net.Conn]struct{}
+	connWG sync.WaitGroup
+
+	// maxConns caps how many accepted connections may be served at
+	// once; excess ones are closed straight after the accept, so a
+	// connection storm can't exhaust descriptors or goroutines. 0
+	// (the default) means unlimited.
+	maxConns atomic.Int64
+
+	// maxMsgBytes caps how many bytes a single incoming RPC message
+	// may occupy before decoding gives up and the connection is
+	// closed, so one bad request can't balloon memory. 0 (the
+	// default) means unlimited. Applies to connections accepted
+	// after the change.
+	maxMsgBytes atomic.Int64
+
+	// slowRPC (nanoseconds), when positive, logs any RPC handler that
+	// runs longer than that, with the method name and duration, so
+	// latency spikes — a stalled backup forward, a huge state
+	// transfer — leave a trace. 0 (the default) logs nothing.
+	slowRPC atomic.Int64
+}
+
+// DefaultForwardConns is how many persistent connections the primary
+// keeps to its backup for forwarding writes.
+const DefaultForwardConns = 4
+
+// fwdPool is a fixed-size set of persistent RPC connections to one
+// server, round-robined per call. net/rpc serializes each call's
+// write on its connection, so spreading concurrent forwards over
+// several connections avoids that bottleneck. Dead entries are
+// replaced lazily on next use.
+type fwdPool struct {
+	mu    sync.Mutex
+	addr  string
+	tr    transport.Transport
+	conns []*rpc.Client
+	next  int
+}
+
+func newFwdPool(addr string, n int, tr transport.Transport) *fwdPool {
+	if n < 1 {
+		n = 1
+	}
+	return &fwdPool{addr: addr, tr: tr, conns: make([]*rpc.Client, n)}
+}
+
+// call issues one RPC over the next pool slot, dialing a replacement
+// if the slot is empty and dropping it again on any error.
+func (p *fwdPool) call(rpcname string, args interface{}, reply interface{}) bool {
+	p.mu.Lock()
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	c := p.conns[i]
+	p.mu.Unlock()
+
+	if c == nil {
+		nc, err := dialTimeout(p.tr, p.addr, DefaultCallTimeout)
+		if err != nil {
+			return false
+		}
+		p.mu.Lock()
+		if p.conns[i] == nil {
+			p.conns[i] = nc
+		} else {
+			// Another caller filled the slot first; use ours once.
+			defer nc.Close()
+		}
+		p.mu.Unlock()
+		c = nc
+	}
+
+	if err := callWithTimeout(c, rpcname, args, reply, DefaultCallTimeout); err != nil {
+		p.mu.Lock()
+		if p.conns[i] == c {
+			p.conns[i] = nil
+		}
+		p.mu.Unlock()
+		c.Close()
+		return false
+	}
+	return true
+}
+
+func (p *fwdPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c != nil {
+			c.Close()
+			p.conns[i] = nil
+		}
+	}
+}
+
+// SetForwardConns adjusts the forwarding pool size. The pool is
+// rebuilt on the next forward.
+func (kv *KVServer) SetForwardConns(n int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.fwdConns = n
+	if kv.fwd != nil {
+		kv.fwd.close()
+		kv.fwd = nil
+	}
+}
+
+// keyLock is one entry in the per-key write lock table. refs counts
+// holders and waiters, so the entry is reclaimed once the last one
+// releases.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockKeys takes the write locks for keys — deduplicated, in sorted
+// order so two transactions over overlapping keys cannot deadlock —
+// and returns the locked set for unlockKeys. A key's lock is held
+// across a write's forward and local apply, which is the ordering the
+// replicas must agree on; the global kv.mu is not held across the
+// forward, so reads and writes to other keys don't stall behind a
+// slow backup. Caller must not hold kv.mu.
+func (kv *KVServer) lockKeys(keys ...string) []string {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+
+	kv.mu.Lock()
+	locks := make([]*keyLock, len(sorted))
+	for i, k := range sorted {
+		l := kv.keyLocks[k]
+		if l == nil {
+			l = &keyLock{}
+			kv.keyLocks[k] = l
+		}
+		l.refs++
+		locks[i] = l
+	}
+	kv.mu.Unlock()
+
+	for _, l := range locks {
+		l.mu.Lock()
+	}
+	return sorted
+}
+
+// unlockKeys releases the locks lockKeys returned. Caller must not
+// hold kv.mu.
+func (kv *KVServer) unlockKeys(locked []string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for _, k := range locked {
+		l := kv.keyLocks[k]
+		l.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(kv.keyLocks, k)
+		}
+	}
+}
+
+// fwdPoolLocked returns the forwarding pool for the current backup,
+// rebuilding it if the backup moved. Caller must hold kv.mu.
+func (kv *KVServer) fwdPoolLocked() *fwdPool {
+	if kv.fwd == nil || kv.fwd.addr != kv.view.Backup {
+		if kv.fwd != nil {
+			kv.fwd.close()
+		}
+		kv.fwd = newFwdPool(kv.view.Backup, kv.fwdConns, kv.tr)
+	}
+	return kv.fwd
+}
+
+// forwardLocked sends one update to backup over pool with kv.mu
+// released for the duration of the RPC, then retakes it: the caller's
+// key locks, not the global mutex, keep forward and apply one atomic
+// step per key, so concurrent forwards really do spread over the
+// pool's connections. On return the in-flight count is settled and
+// backup reachability recorded for the ping loop. stillPrimary is
+// false when the view moved on mid-forward; the caller must then
+// abort the write instead of applying it. Caller must hold kv.mu and
+// the keys' write locks.
+func (kv *KVServer) forwardLocked(pool *fwdPool, backup string, rpcname string, args interface{}, reply interface{}) (ok, stillPrimary bool) {
+	kv.inflight++
+	kv.mu.Unlock()
+	ok = pool.call(rpcname, args, reply)
+	kv.mu.Lock()
+	kv.inflight--
+	kv.transferCond.Broadcast()
+	if kv.view.Backup == backup {
+		kv.backupUnreachable = !ok
+	}
+	return ok, kv.view.Primary == kv.me
+}
+
+// SetStrictForwarding toggles whether a failed forward to a live
+// backup fails the write (the default) or is ignored.
+func (kv *KVServer) SetStrictForwarding(strict bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.strictForward = strict
+}
+
+// deadLetterRecord is one line of the dead-letter file: a write that
+// applied on the primary while its forward to the backup failed.
+type deadLetterRecord struct {
+	Time    time.Time `json:"time"`
+	ViewNum uint      `json:"view_num"`
+	Key     string    `json:"key"`
+	Value   string    `json:"value"`
+	Delete  bool      `json:"delete,omitempty"`
+}
+
+// SetDeadLetterPath makes lenient-mode forward failures durable:
+// each write the backup may have missed is appended to the file at
+// path as one JSON line with key, value and view number, so an
+// operator or a reconcile job can replay it after recovery. An empty
+// path turns the log off. Strict forwarding never dead-letters — it
+// fails the write instead.
+func (kv *KVServer) SetDeadLetterPath(path string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.deadLetter != nil {
+		kv.deadLetter.Close()
+		kv.deadLetter = nil
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	kv.deadLetter = f
+	return nil
+}
+
+// deadLetterLocked appends one record for a write whose forward
+// failed while lenient forwarding applied it anyway. Caller must
+// hold kv.mu.
+func (kv *KVServer) deadLetterLocked(key, value string, del bool) {
+	if kv.deadLetter == nil {
+		return
+	}
+	rec := deadLetterRecord{Time: kv.clk.Now(), ViewNum: kv.view.ViewNum, Key: key, Value: value, Delete: del}
+	b, err := json.Marshal(rec)
+	if err == nil {
+		_, err = kv.deadLetter.Write(append(b, '\n'))
+	}
+	if err != nil {
+		log.Printf("kvservice: %s: writing dead-letter record for %q: %v", kv.me, key, err)
+	}
+}
+
+// SetRequireBackup toggles whether a primary with no backup accepts
+// writes. When required, writes answer ErrNoBackup — retryable —
+// until the view service pairs the primary with a backup, so no
+// write ever exists on a single server only. The default (false)
+// keeps the classic behavior of serving alone.
+func (kv *KVServer) SetRequireBackup(require bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.requireBackup = require
+}
+
+// SetVerifyInterval makes the primary compare state checksums with
+// its backup every d and re-stream the full state when they differ,
+// so a backup that silently diverged (e.g. under lenient forwarding)
+// is repaired without waiting for a view change. 0 (the default)
+// disables the check; each check costs a checksum over the full
+// dataset plus one RPC.
+func (kv *KVServer) SetVerifyInterval(d time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.verifyInterval = d
+}
+
+// SetCompressionThreshold makes values of at least n bytes be stored
+// and replicated gzip-compressed; reads decompress transparently and
+// the client API keeps seeing plain strings. 0 (the default)
+// disables compression. Both replicas hold the same compressed
+// bytes, so their checksums still agree; note that compressed values
+// are binary, which the JSON snapshot codec cannot represent.
+func (kv *KVServer) SetCompressionThreshold(n int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.compressThreshold = n
+}
+
+// SetSnapshotCodec selects the serialization used for snapshot files
+// written by SnapshotTo and read by RestoreFrom. Snapshots must be
+// restored with the codec that wrote them.
+func (kv *KVServer) SetSnapshotCodec(c Codec) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.codec = c
+}
+
+// SetIdleTimeout makes the server drop accepted connections that go
+// quiet for d, so abandoned clients don't pin goroutines and file
+// descriptors forever. 0 (the default) keeps connections open
+// indefinitely. Applies to connections accepted after the call.
+func (kv *KVServer) SetIdleTimeout(d time.Duration) {
+	kv.idleTimeout.Store(int64(d))
+}
+
+// SetAdminSecret configures the shared secret required by admin
+// RPCs. An empty secret leaves them open.
+func (kv *KVServer) SetAdminSecret(secret string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.adminSecret = secret
+}
+
+// wireHeader stamps outgoing inter-server args with this binary's
+// wire version.
+func wireHeader() WireHeader {
+	return WireHeader{WireVersion: WireVersion}
+}
+
+// warnWireVersionLocked logs, once per observed version, when a peer
+// speaks a different wire version than this binary — the usual sign
+// of a half-finished rolling upgrade. Caller must hold kv.mu.
+func (kv *KVServer) warnWireVersionLocked(rpcname string, h WireHeader) {
+	if h.WireVersion == WireVersion || kv.warnedVersions[h.WireVersion] {
+		return
+	}
+	if kv.warnedVersions == nil {
+		kv.warnedVersions = map[int]bool{}
+	}
+	kv.warnedVersions[h.WireVersion] = true
+	log.Printf("kvservice: %s from peer with wire version %d, ours is %d; mixed binaries?",
+		rpcname, h.WireVersion, WireVersion)
+}
+
+// isDuplicate reports whether this client request was already
+// applied, returning the recorded entry so the caller can repeat the
+// original reply. Checking counts as client activity for the dedup
+// TTL.
+func (kv *KVServer) isDuplicate(clientID int64, seq int64) (DedupEntry, bool) {
+	kv.touchDedupLocked(clientID)
+	last, ok := kv.lastSeq[clientID]
+	if ok && seq <= last.Seq {
+		return last, true
+	}
+	return DedupEntry{}, false
+}
+
+// SetDedupTTL bounds the duplicate-filtering table: a client with no
+// activity for ttl is forgotten on a later ping tick, so the table
+// stops growing one entry per client forever. Forgetting a client
+// means a retransmission it sends afterwards would re-execute, so
+// ttl must comfortably exceed the longest any client keeps retrying
+// a single request — hours are sensible. 0 (the default) keeps
+// entries forever.
+func (kv *KVServer) SetDedupTTL(ttl time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.dedupTTL = ttl
+}
+
+// SetTombstoneGrace turns deletes into soft deletes: instead of just
+// erasing the key, a delete leaves a tombstone marker that keeps the
+// key reading as missing for the grace period, even if an operator
+// restore or a state resync resurrects stale bytes underneath it.
+// Tombstones replicate like any other write — the forwarded delete
+// plants one on the backup, and state transfers carry the full set —
+// and are reaped once they are older than the grace period and the
+// backup holds a complete copy. 0 (the default) keeps deletes hard.
+func (kv *KVServer) SetTombstoneGrace(d time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.tombstoneGrace = d
+}
+
+// reapTombstonesLocked drops tombstones older than the grace period.
+// A primary holds all of them while its backup is still receiving a
+// state transfer, so the marker always outlives the transfer that
+// replicates it. Caller must hold kv.mu.
+func (kv *KVServer) reapTombstonesLocked(now time.Time) {
+	if kv.tombstoneGrace <= 0 || len(kv.tombstones) == 0 {
+		return
+	}
+	if kv.view.Primary == kv.me && kv.view.Backup != "" && !kv.backupSynced {
+		return
+	}
+	for k, t := range kv.tombstones {
+		if now.Sub(t) >= kv.tombstoneGrace {
+			delete(kv.tombstones, k)
+		}
+	}
+}
+
+// touchDedupLocked stamps a client's dedup activity. Caller must
+// hold kv.mu.
+func (kv *KVServer) touchDedupLocked(clientID int64) {
+	if kv.dedupTTL <= 0 {
+		return
+	}
+	if kv.dedupSeen == nil {
+		kv.dedupSeen = map[int64]time.Time{}
+	}
+	kv.dedupSeen[clientID] = kv.clk.Now()
+}
+
+// evictDedupLocked drops dedup entries for clients idle beyond the
+// TTL. An entry that arrived without an activity stamp (say, via a
+// state transfer) is stamped now and given a full TTL. Caller must
+// hold kv.mu.
+func (kv *KVServer) evictDedupLocked(now time.Time) {
+	if kv.dedupTTL <= 0 {
+		return
+	}
+	if kv.dedupSeen == nil {
+		kv.dedupSeen = map[int64]time.Time{}
+	}
+	for id := range kv.lastSeq {
+		if _, ok := kv.dedupSeen[id]; !ok {
+			kv.dedupSeen[id] = now
+		}
+	}
+	for id, seen := range kv.dedupSeen {
+		if now.Sub(seen) > kv.dedupTTL {
+			delete(kv.lastSeq, id)
+			delete(kv.dedupSeen, id)
+		}
+	}
+}
+
+// DefaultMaxPending is how many writes may queue behind a state
+// transfer before new ones are rejected with ErrBusy.
+const DefaultMaxPending = 1024
+
+// Default size limits for keys and values. A single huge Put would
+// bloat state transfer chunks and replies, so oversized writes are
+// rejected with ErrTooLarge before any forwarding happens.
+const (
+	DefaultMaxKeySize   = 1 << 10 // 1 KiB
+	DefaultMaxValueSize = 1 << 20 // 1 MiB
+)
+
+// SetSizeLimits adjusts the maximum accepted key and value sizes in
+// bytes; zero means unlimited.
+func (kv *KVServer) SetSizeLimits(maxKey, maxValue int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.maxKeySize = maxKey
+	kv.maxValueSize = maxValue
+}
+
+// SetMaxKeys caps how many keys the store may hold; zero means
+// unlimited. When full, writes that would create a new key return
+// ErrFull while updates to existing keys still succeed.
+func (kv *KVServer) SetMaxKeys(n int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.maxKeys = n
+}
+
+// SetPutInterceptor installs a hook that can veto writes with
+// application-level rules (say, values must be valid JSON). A
+// non-nil error rejects the Put with ErrRejected carrying the
+// error's message. The hook runs on the primary before the write is
+// forwarded, so a rejected write never reaches the backup; deletes
+// are not intercepted. It is called with the server's mutex held and
+// must not call back into the server. nil removes the hook.
+func (kv *KVServer) SetPutInterceptor(f func(key, value string) error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.putInterceptor = f
+}
+
+// SetOnRoleChange installs a hook that is told whenever this
+// server's role in the view changes, with the old and new role
+// ("primary", "backup" or "idle"). It runs on the ping loop's
+// goroutine with the server's mutex released, so it may call back
+// into the server; a slow hook delays the next ping. nil removes the
+// hook.
+func (kv *KVServer) SetOnRoleChange(f func(old, new string)) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.onRoleChange = f
+}
+
+// SetPriority sets the promotion preference sent with every ping.
+// The view service recruits higher-priority servers first and swaps
+// a higher-priority backup into the primary role once it is synced,
+// so a preferred node reclaims leadership after recovering.
+func (kv *KVServer) SetPriority(p int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.priority = p
+}
+
+// SetBackupOnly declares that this server must never hold the
+// primary role: the view service still recruits it as a backup but
+// skips it when filling a primary slot. Useful for nodes on weak
+// hardware or in a remote site that should hold a copy of the data
+// without ever taking writes.
+func (kv *KVServer) SetBackupOnly(b bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.backupOnly = b
+}
+
+// SetRateLimit caps how many client operations per second the server
+// serves; excess requests are answered with ErrRateLimited, which
+// clients retry with backoff. Zero (the default) disables the limit.
+func (kv *KVServer) SetRateLimit(rps int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.limitRate = rps
+	kv.limitTokens = float64(rps)
+	kv.limitLast = kv.clk.Now()
+}
+
+// allowRequestLocked takes one token from the rate limiter's bucket,
+// reporting false when the bucket is empty. Caller must hold kv.mu.
+func (kv *KVServer) allowRequestLocked() bool {
+	if kv.limitRate <= 0 {
+		return true
+	}
+	now := kv.clk.Now()
+	kv.limitTokens += now.Sub(kv.limitLast).Seconds() * float64(kv.limitRate)
+	if burst := float64(kv.limitRate); kv.limitTokens > burst {
+		kv.limitTokens = burst
+	}
+	kv.limitLast = now
+	if kv.limitTokens < 1 {
+		return false
+	}
+	kv.limitTokens--
+	return true
+}
+
+// checkCapacityLocked rejects a write that would push the store past
+// MaxKeys. Deletes and updates of existing keys always pass. Caller
+// must hold kv.mu.
+func (kv *KVServer) checkCapacityLocked(key string, del bool) Err {
+	if del || kv.maxKeys <= 0 || kv.store.Len() < kv.maxKeys {
+		return OK
+	}
+	if _, exists := kv.store.Get(key); exists {
+		return OK
+	}
+	return ErrFull
+}
+
+// approxSize sums key and value lengths, the server's cheap notion
+// of a dataset's memory footprint.
+func approxSize(data map[string]string) int64 {
+	var n int64
+	for k, v := range data {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// checkSizeLocked rejects oversized keys and values. Caller must
+// hold kv.mu.
+func (kv *KVServer) checkSizeLocked(key, value string) Err {
+	if kv.maxKeySize > 0 && len(key) > kv.maxKeySize {
+		return ErrTooLarge
+	}
+	if kv.maxValueSize > 0 && len(value) > kv.maxValueSize {
+		return ErrTooLarge
+	}
+	return OK
+}
+
+// SetMaxPending adjusts the pending-write bound, mainly for tests
+// and tuned deployments.
+func (kv *KVServer) SetMaxPending(n int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.maxPending = n
+}
+
+// leaseValidLocked reports whether this server's primary lease is
+// still fresh enough to serve. Caller must hold kv.mu.
+func (kv *KVServer) leaseValidLocked() bool {
+	return kv.clk.Now().Sub(kv.primaryConfirmed) <= viewservice.DeadInterval
+}
+
+// confirmPrimaryLocked asks the view service whether this server is
+// still primary, renewing the lease on success. Caller must hold
+// kv.mu; the round trip happens under the lock, like forwarding.
+func (kv *KVServer) confirmPrimaryLocked() bool {
+	v, ok := kv.vs.Get()
+	if !ok || v.Primary != kv.me {
+		return false
+	}
+	kv.primaryConfirmed = kv.clk.Now()
+	return true
+}
+
+// waitForTransferLocked blocks a write while a state transfer is in
+// flight, returning ErrBusy if too many writes are already queued.
+// Caller must hold kv.mu.
+func (kv *KVServer) waitForTransferLocked() Err {
+	for kv.transferring && kv.view.Primary == kv.me {
+		if kv.pending >= kv.maxPending {
+			return ErrBusy
+		}
+		kv.pending++
+		kv.transferCond.Wait()
+		kv.pending--
+	}
+	return OK
+}
+
+// Get serves a client read. Only the primary answers, unless the
+// caller set AllowStale, in which case the backup may answer with a
+// possibly slightly stale value.
+func (kv *KVServer) Get(args *GetArgs, reply *GetReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	reply.ViewNum = kv.view.ViewNum
+
+	if kv.view.Primary == kv.me {
+		if !kv.leaseValidLocked() {
+			reply.Err = ErrNotPrimary
+			return nil
+		}
+		if args.Linearizable && !kv.confirmPrimaryLocked() {
+			reply.Err = ErrNotPrimary
+			return nil
+		}
+	} else if !(args.AllowStale && kv.view.Backup == kv.me) {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.allowRequestLocked() {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+	if !kv.stateComplete {
+		// Promoted mid-transfer: answering from a partial dataset
+		// would turn missing keys into confident ErrNoKeys. ErrBusy
+		// keeps clients retrying until the state is reconciled (an
+		// operator restore, or eviction by the view service).
+		reply.Err = ErrBusy
+		return nil
+	}
+	value, ok, err := kv.getLocked(args.Key)
+	if err != OK {
+		reply.Err = err
+		return nil
+	}
+	if !ok {
+		reply.Err = ErrNoKey
+		return nil
+	}
+	if args.Bytes {
+		reply.ValueBytes = []byte(value)
+	} else {
+		reply.Value = value
+	}
+	reply.Err = OK
+	return nil
+}
+
+// getLocked reads one key from the store, transparently
+// decompressing a value stored compressed. The bool reports
+// presence; ErrChecksum means the stored bytes claim to be
+// compressed but aren't valid gzip. Caller must hold kv.mu.
+func (kv *KVServer) getLocked(key string) (string, bool, Err) {
+	if _, dead := kv.tombstones[key]; dead {
+		return "", false, OK
+	}
+	v, ok := kv.store.Get(key)
+	if !ok {
+		return "", false, OK
+	}
+	if m, ok := kv.meta[key]; ok && m.Compressed {
+		d, err := decompressValue(v)
+		if err != nil {
+			return "", true, ErrChecksum
+		}
+		v = d
+	}
+	return v, true, OK
+}
+
+// Exists reports whether a key is set without copying the value into
+// the reply, so existence checks on large values stay cheap. Same
+// primary and fencing rules as Get; the stored bytes are never
+// touched, so even a compressed value costs nothing to check.
+func (kv *KVServer) Exists(args *ExistsArgs, reply *ExistsReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	reply.ViewNum = kv.view.ViewNum
+
+	if kv.view.Primary != kv.me || !kv.leaseValidLocked() {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.stateComplete {
+		reply.Err = ErrBusy
+		return nil
+	}
+	if _, dead := kv.tombstones[args.Key]; !dead {
+		_, reply.Exists = kv.store.Get(args.Key)
+	}
+	reply.Err = OK
+	return nil
+}
+
+// GetVersioned is Get plus the key's per-key sequence, the token a
+// later conditional Put compares against. A missing key answers
+// ErrNoKey with sequence 0, which a PutIfVersion with ExpectedSeq 0
+// accepts — so read-modify-write loops also create absent keys.
+func (kv *KVServer) GetVersioned(args *GetVersionedArgs, reply *GetVersionedReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	reply.ViewNum = kv.view.ViewNum
+
+	if kv.view.Primary != kv.me || !kv.leaseValidLocked() {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.stateComplete {
+		reply.Err = ErrBusy
+		return nil
+	}
+	value, ok, err := kv.getLocked(args.Key)
+	if err != OK {
+		reply.Err = err
+		return nil
+	}
+	if !ok {
+		reply.Err = ErrNoKey
+		return nil
+	}
+	reply.Value = value
+	reply.Seq = kv.meta[args.Key].ModSeq
+	reply.Err = OK
+	return nil
+}
+
+// GetMany serves a batched read: all keys are answered under one
+// lock acquisition, so the result is a consistent snapshot of the
+// requested keys. Absent keys are omitted. Only the primary answers.
+func (kv *KVServer) GetMany(args *GetManyArgs, reply *GetManyReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	reply.ViewNum = kv.view.ViewNum
+
+	if kv.view.Primary != kv.me || !kv.leaseValidLocked() {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.stateComplete {
+		reply.Err = ErrBusy
+		return nil
+	}
+	reply.Values = make(map[string]string, len(args.Keys))
+	for _, k := range args.Keys {
+		if v, ok, err := kv.getLocked(k); err != OK {
+			reply.Err = err
+			return nil
+		} else if ok {
+			reply.Values[k] = v
+		}
+	}
+	reply.Err = OK
+	return nil
+}
+
+// Put serves a client write. The primary forwards the update to the
+// backup (if any) before applying it locally, so the backup is never
+// behind the primary.
+func (kv *KVServer) Put(args *PutArgs, reply *PutReply) error {
+	if args.ValueBytes != nil {
+		// A byte-oriented Put; fold the payload into Value so the
+		// size check, forward and store all see one representation.
+		args.Value = string(args.ValueBytes)
+		args.ValueBytes = nil
+	}
+
+	locked := kv.lockKeys(args.Key)
+	defer kv.unlockKeys(locked)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	reply.ViewNum = kv.view.ViewNum
+
+	if err := kv.waitForTransferLocked(); err != OK {
+		reply.Err = err
+		return nil
+	}
+
+	if kv.view.Primary != kv.me || !kv.leaseValidLocked() {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.allowRequestLocked() {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+	if !kv.stateComplete {
+		reply.Err = ErrBusy
+		return nil
+	}
+	if kv.requireBackup && kv.view.Backup == "" {
+		reply.Err = ErrNoBackup
+		return nil
+	}
+	if err := kv.checkSizeLocked(args.Key, args.Value); err != OK {
+		reply.Err = err
+		return nil
+	}
+	if entry, dup := kv.isDuplicate(args.ClientID, args.Seq); dup {
+		reply.Err = entry.Err
+		if reply.Err == "" {
+			reply.Err = OK
+		}
+		reply.Duplicate = true
+		return nil
+	}
+	if err := kv.checkCapacityLocked(args.Key, args.Delete); err != OK {
+		reply.Err = err
+		return nil
+	}
+	if kv.putInterceptor != nil && !args.Delete {
+		if err := kv.putInterceptor(args.Key, args.Value); err != nil {
+			reply.Err = ErrRejected
+			reply.Message = err.Error()
+			return nil
+		}
+	}
+
+	// The primary stamps the modification metadata and replicates the
+	// stamp, so both replicas record the same view, wall time and
+	// per-key sequence.
+	meta := KeyMeta{ModView: kv.view.ViewNum, ModTime: kv.clk.Now(), ModSeq: kv.meta[args.Key].ModSeq + 1}
+	// Large values are compressed here, once, and the compressed
+	// bytes travel through the forward below, so the backup stores
+	// exactly what the primary stores.
+	plainValue := args.Value
+	if !args.Delete && kv.compressThreshold > 0 && len(args.Value) >= kv.compressThreshold {
+		if c, ok := compressValue(args.Value); ok {
+			args.Value = c
+			meta.Compressed = true
+		}
+	}
+	if kv.view.Backup != "" {
+		// The key lock taken at the top keeps forward and local apply
+		// one atomic step per key: two concurrent Puts to the same key
+		// cannot forward in one order and apply in the other, which
+		// would leave the replicas disagreeing on the final value.
+		// kv.mu itself is released for the round trip.
+		var fr PutReply
+		fwd := &ForwardArgs{WireHeader: wireHeader(), ViewNum: kv.view.ViewNum, Sender: kv.me, Update: *args, Meta: meta}
+		pool, backup := kv.fwdPoolLocked(), kv.view.Backup
+		ok, stillPrimary := kv.forwardLocked(pool, backup, "KVServer.ForwardUpdate", fwd, &fr)
+		if !stillPrimary {
+			reply.Err = ErrNotPrimary
+			return nil
+		}
+		// ErrExists and ErrVersion are replicated outcomes, not
+		// forwarding failures: the backup recorded the refusal just
+		// as the primary is about to.
+		if !ok || (fr.Err != OK && fr.Err != ErrExists && fr.Err != ErrVersion) {
+			if kv.strictForward {
+				// Refusing to apply keeps primary and backup identical;
+				// the client retries once the view service has sorted
+				// out the dead or lagging backup.
+				reply.Err = ErrForward
+				return nil
+			}
+			// Lenient mode applies anyway; leave a durable trace of
+			// what the backup may have missed.
+			kv.deadLetterLocked(args.Key, plainValue, args.Delete)
+		}
+	}
+
+	reply.Err = kv.applyLocked(args, meta)
+	return nil
+}
+
+// applyLocked stores (or deletes) a write and records its outcome in
+// the dedup table. An IfNotExists Put that finds the key set records
+// ErrExists without touching the store, so retransmissions keep
+// getting the same answer on both replicas. meta is the primary's
+// metadata stamp for the key. Caller must hold kv.mu.
+func (kv *KVServer) applyLocked(args *PutArgs, meta KeyMeta) Err {
+	kv.touchDedupLocked(args.ClientID)
+	if args.IfNotExists && !args.Delete {
+		if _, exists := kv.store.Get(args.Key); exists {
+			kv.lastSeq[args.ClientID] = DedupEntry{Seq: args.Seq, Err: ErrExists}
+			return ErrExists
+		}
+	}
+	if args.IfVersion && !args.Delete {
+		// Both replicas hold the same replicated ModSeq stamps, so
+		// this check resolves identically on primary and backup.
+		if kv.meta[args.Key].ModSeq != args.ExpectedSeq {
+			kv.lastSeq[args.ClientID] = DedupEntry{Seq: args.Seq, Err: ErrVersion}
+			return ErrVersion
+		}
+	}
+	if args.Delete {
+		if old, ok := kv.store.Get(args.Key); ok {
+			kv.approxBytes -= int64(len(args.Key) + len(old))
+		}
+		kv.store.Delete(args.Key)
+		delete(kv.meta, args.Key)
+		if kv.tombstoneGrace > 0 {
+			kv.tombstones[args.Key] = kv.clk.Now()
+		}
+	} else {
+		if old, ok := kv.store.Get(args.Key); ok {
+			kv.approxBytes += int64(len(args.Value) - len(old))
+		} else {
+			kv.approxBytes += int64(len(args.Key) + len(args.Value))
+		}
+		kv.store.Put(args.Key, args.Value)
+		kv.meta[args.Key] = meta
+		delete(kv.tombstones, args.Key)
+	}
+	kv.lastSeq[args.ClientID] = DedupEntry{Seq: args.Seq, Value: args.Value, Err: OK}
+	kv.recordChangeLocked(args.Key)
+	return OK
+}
+
+// changeRecord is one entry in the bounded change log consumed by
+// WaitForChange.
+type changeRecord struct {
+	Seq uint64
+	Key string
+}
+
+// watchLogSize bounds the change log; a watcher that falls further
+// behind than this silently misses the trimmed changes.
+const watchLogSize = 1024
+
+// watchPollTimeout is how long a WaitForChange poll blocks before
+// returning empty-handed; the client simply polls again.
+const watchPollTimeout = 10 * time.Second
+
+// recordChangeLocked logs a key change and wakes blocked watchers.
+// Caller must hold kv.mu.
+func (kv *KVServer) recordChangeLocked(key string) {
+	kv.changeSeq++
+	kv.changes = append(kv.changes, changeRecord{Seq: kv.changeSeq, Key: key})
+	if len(kv.changes) > watchLogSize {
+		kv.changes = kv.changes[len(kv.changes)-watchLogSize:]
+	}
+	close(kv.watchCh)
+	kv.watchCh = make(chan struct{})
+}
+
+// WaitForChange blocks until a key under args.Prefix changes with a
+// sequence greater than args.SinceSeq, or the poll window elapses.
+// SinceSeq zero means "changes from now on".
+func (kv *KVServer) WaitForChange(args *WaitForChangeArgs, reply *WaitForChangeReply) error {
+	kv.mu.Lock()
+	kv.rpcCount++
+
+	since := args.SinceSeq
+	if since == 0 {
+		since = kv.changeSeq
+	}
+
+	// The poll window runs on kv.clk like every other timeout here,
+	// so tests can expire a poll without waiting it out.
+	deadline := kv.clk.NewTimer(watchPollTimeout)
+	defer deadline.Stop()
+	for {
+		for _, c := range kv.changes {
+			if c.Seq > since && strings.HasPrefix(c.Key, args.Prefix) {
+				reply.Key = c.Key
+				reply.Seq = c.Seq
+				reply.Err = OK
+				kv.mu.Unlock()
+				return nil
+			}
+		}
+		ch := kv.watchCh
+		latest := kv.changeSeq
+		kv.mu.Unlock()
+		select {
+		case <-ch:
+		case <-deadline.C():
+			// Everything up to latest was scanned and didn't match,
+			// so the next poll can safely start past it.
+			reply.Timeout = true
+			reply.Seq = latest
+			reply.Err = OK
+			return nil
+		}
+		kv.mu.Lock()
+	}
+}
+
+// Incr adds Delta to the integer stored under Key (missing or empty
+// reads as 0), replicates the result to the backup and returns the
+// new value. Retransmissions return the originally computed value.
+func (kv *KVServer) Incr(args *IncrArgs, reply *IncrReply) error {
+	locked := kv.lockKeys(args.Key)
+	defer kv.unlockKeys(locked)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	if err := kv.waitForTransferLocked(); err != OK {
+		reply.Err = err
+		return nil
+	}
+
+	if kv.view.Primary != kv.me || !kv.leaseValidLocked() {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.allowRequestLocked() {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+	if !kv.stateComplete {
+		reply.Err = ErrBusy
+		return nil
+	}
+	if kv.requireBackup && kv.view.Backup == "" {
+		reply.Err = ErrNoBackup
+		return nil
+	}
+	if err := kv.checkSizeLocked(args.Key, ""); err != OK {
+		reply.Err = err
+		return nil
+	}
+	if entry, dup := kv.isDuplicate(args.ClientID, args.Seq); dup {
+		v, err := strconv.ParseInt(entry.Value, 10, 64)
+		if err != nil {
+			reply.Err = ErrNotInteger
+			return nil
+		}
+		reply.Value = v
+		reply.Err = OK
+		return nil
+	}
+
+	if err := kv.checkCapacityLocked(args.Key, false); err != OK {
+		reply.Err = err
+		return nil
+	}
+
+	var cur int64
+	s, _, gerr := kv.getLocked(args.Key)
+	if gerr != OK {
+		reply.Err = gerr
+		return nil
+	}
+	if s != "" {
+		var err error
+		cur, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			reply.Err = ErrNotInteger
+			return nil
+		}
+	}
+	next := cur + args.Delta
+	value := strconv.FormatInt(next, 10)
+	fwd := &PutArgs{Key: args.Key, Value: value, ClientID: args.ClientID, Seq: args.Seq}
+	meta := KeyMeta{ModView: kv.view.ViewNum, ModTime: kv.clk.Now(), ModSeq: kv.meta[args.Key].ModSeq + 1}
+
+	if kv.view.Backup != "" {
+		var fr PutReply
+		fargs := &ForwardArgs{WireHeader: wireHeader(), ViewNum: kv.view.ViewNum, Sender: kv.me, Update: *fwd, Meta: meta}
+		// The key lock keeps the read-modify-write atomic per key even
+		// though kv.mu is released for the forward: no other write to
+		// this key can slip between the read of cur and the apply.
+		pool, backup := kv.fwdPoolLocked(), kv.view.Backup
+		ok, stillPrimary := kv.forwardLocked(pool, backup, "KVServer.ForwardUpdate", fargs, &fr)
+		if !stillPrimary {
+			reply.Err = ErrNotPrimary
+			return nil
+		}
+		if !ok || fr.Err != OK {
+			if kv.strictForward {
+				reply.Err = ErrForward
+				return nil
+			}
+			kv.deadLetterLocked(fwd.Key, fwd.Value, false)
+		}
+	}
+
+	kv.applyLocked(fwd, meta)
+	reply.Value = next
+	reply.Err = OK
+	return nil
+}
+
+// Txn applies a set of puts and deletes atomically: the whole batch
+// is validated, forwarded to the backup as one ForwardTxn RPC, and
+// applied under one lock acquisition. In strict forwarding mode a
+// failed forward fails the transaction with nothing applied locally,
+// so the replicas can't end up holding different halves of it.
+func (kv *KVServer) Txn(args *TxnArgs, reply *TxnReply) error {
+	keys := make([]string, 0, len(args.Puts)+len(args.Deletes))
+	for k := range args.Puts {
+		keys = append(keys, k)
+	}
+	keys = append(keys, args.Deletes...)
+	locked := kv.lockKeys(keys...)
+	defer kv.unlockKeys(locked)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	reply.ViewNum = kv.view.ViewNum
+
+	if err := kv.waitForTransferLocked(); err != OK {
+		reply.Err = err
+		return nil
+	}
+
+	if kv.view.Primary != kv.me || !kv.leaseValidLocked() {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if !kv.allowRequestLocked() {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+	if !kv.stateComplete {
+		reply.Err = ErrBusy
+		return nil
+	}
+	if kv.requireBackup && kv.view.Backup == "" {
+		reply.Err = ErrNoBackup
+		return nil
+	}
+	for k, v := range args.Puts {
+		if err := kv.checkSizeLocked(k, v); err != OK {
+			reply.Err = err
+			return nil
+		}
+	}
+	if entry, dup := kv.isDuplicate(args.ClientID, args.Seq); dup {
+		reply.Err = entry.Err
+		if reply.Err == "" {
+			reply.Err = OK
+		}
+		return nil
+	}
+	// Capacity is checked for the batch as a whole: the creations it
+	// adds minus the existing keys it deletes must fit under MaxKeys.
+	if kv.maxKeys > 0 {
+		delta := 0
+		for k := range args.Puts {
+			if _, exists := kv.store.Get(k); !exists {
+				delta++
+			}
+		}
+		for _, k := range args.Deletes {
+			if _, exists := kv.store.Get(k); exists {
+				delta--
+			}
+		}
+		if kv.store.Len()+delta > kv.maxKeys {
+			reply.Err = ErrFull
+			return nil
+		}
+	}
+	if kv.putInterceptor != nil {
+		for k, v := range args.Puts {
+			if err := kv.putInterceptor(k, v); err != nil {
+				reply.Err = ErrRejected
+				return nil
+			}
+		}
+	}
+
+	// Stamp and compress every written key up front, so the backup
+	// receives exactly the bytes and metadata the primary will store.
+	now := kv.clk.Now()
+	meta := make(map[string]KeyMeta, len(args.Puts))
+	for k, v := range args.Puts {
+		m := KeyMeta{ModView: kv.view.ViewNum, ModTime: now, ModSeq: kv.meta[k].ModSeq + 1}
+		if kv.compressThreshold > 0 && len(v) >= kv.compressThreshold {
+			if c, ok := compressValue(v); ok {
+				args.Puts[k] = c
+				m.Compressed = true
+			}
+		}
+		meta[k] = m
+	}
+	if kv.view.Backup != "" {
+		var fr TxnReply
+		fwd := &ForwardTxnArgs{WireHeader: wireHeader(), ViewNum: kv.view.ViewNum, Sender: kv.me, Update: *args, Meta: meta}
+		pool, backup := kv.fwdPoolLocked(), kv.view.Backup
+		ok, stillPrimary := kv.forwardLocked(pool, backup, "KVServer.ForwardTxn", fwd, &fr)
+		if !stillPrimary {
+			reply.Err = ErrNotPrimary
+			return nil
+		}
+		if !ok || fr.Err != OK {
+			if kv.strictForward {
+				reply.Err = ErrForward
+				return nil
+			}
+			// Dead-letter every operation in the batch; the whole
+			// forward failed as one unit.
+			for k, v := range args.Puts {
+				if meta[k].Compressed {
+					// The log holds replayable plain values.
+					if p, err := decompressValue(v); err == nil {
+						v = p
+					}
+				}
+				kv.deadLetterLocked(k, v, false)
+			}
+			for _, k := range args.Deletes {
+				kv.deadLetterLocked(k, "", true)
+			}
+		}
+	}
+
+	kv.applyTxnLocked(args, meta)
+	reply.Err = OK
+	return nil
+}
+
+// applyTxnLocked stores every put, removes every delete and records
+// the transaction's single dedup entry. meta holds the stamps for the
+// written keys. Caller must hold kv.mu.
+func (kv *KVServer) applyTxnLocked(args *TxnArgs, meta map[string]KeyMeta) {
+	kv.touchDedupLocked(args.ClientID)
+	for k, v := range args.Puts {
+		if old, ok := kv.store.Get(k); ok {
+			kv.approxBytes += int64(len(v) - len(old))
+		} else {
+			kv.approxBytes += int64(len(k) + len(v))
+		}
+		kv.store.Put(k, v)
+		kv.meta[k] = meta[k]
+		delete(kv.tombstones, k)
+		kv.recordChangeLocked(k)
+	}
+	for _, k := range args.Deletes {
+		if old, ok := kv.store.Get(k); ok {
+			kv.approxBytes -= int64(len(k) + len(old))
+			kv.store.Delete(k)
+			delete(kv.meta, k)
+			kv.recordChangeLocked(k)
+		}
+		if kv.tombstoneGrace > 0 {
+			kv.tombstones[k] = kv.clk.Now()
+		}
+	}
+	kv.lastSeq[args.ClientID] = DedupEntry{Seq: args.Seq, Err: OK}
+}
+
+// forwardFenceLocked is the backup-side fencing shared by
+// ForwardUpdate and ForwardTxn. A server that isn't the backup in
+// its own view, or a sender that isn't that view's primary, gets a
+// logged rejection: both are split-brain tells — mis-roled servers
+// must surface as errors, never bounce or silently apply a write.
+// Caller must hold kv.mu.
+func (kv *KVServer) forwardFenceLocked(rpcname string, viewnum uint, sender string) Err {
+	if kv.view.Backup != kv.me {
+		log.Printf("kvservice: %s: %s from %q for view %d, but I am not the backup in my view %d (primary %q backup %q)",
+			kv.me, rpcname, sender, viewnum, kv.view.ViewNum, kv.view.Primary, kv.view.Backup)
+		return ErrNotBackup
+	}
+	if viewnum < kv.view.ViewNum {
+		return ErrNotPrimary
+	}
+	// A sender can legitimately be one view ahead (this backup hasn't
+	// pinged yet), but a forward for our own view must come from our
+	// own primary. Senders from before the field existed arrive empty
+	// and are let through; the wire version warning already flags them.
+	if viewnum == kv.view.ViewNum && sender != "" && sender != kv.view.Primary {
+		log.Printf("kvservice: %s: %s from %q which is not view %d's primary %q; rejecting",
+			kv.me, rpcname, sender, viewnum, kv.view.Primary)
+		return ErrNotPrimary
+	}
+	return OK
+}
+
+// ForwardTxn applies a transaction forwarded from the primary, under
+// the same fencing rules as ForwardUpdate. The batch lands in one
+// lock acquisition, so a reader on the backup never sees half of it.
+func (kv *KVServer) ForwardTxn(args *ForwardTxnArgs, reply *TxnReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	kv.warnWireVersionLocked("ForwardTxn", args.WireHeader)
+
+	if err := kv.forwardFenceLocked("ForwardTxn", args.ViewNum, args.Sender); err != OK {
+		reply.Err = err
+		return nil
+	}
+	if _, dup := kv.isDuplicate(args.Update.ClientID, args.Update.Seq); dup {
+		reply.Err = OK
+		return nil
+	}
+	kv.applyTxnLocked(&args.Update, args.Meta)
+	reply.Err = OK
+	return nil
+}
+
+// ForwardUpdate applies a write forwarded from the primary. Only the
+// backup accepts it, and only from a primary whose view is at least
+// as new as its own; a forward from an older view means the sender
+// was deposed and must not touch this replica. The update is applied
+// locally and never forwarded onward, so mis-roled servers cannot
+// bounce a write between each other.
+func (kv *KVServer) ForwardUpdate(args *ForwardArgs, reply *PutReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	kv.warnWireVersionLocked("ForwardUpdate", args.WireHeader)
+
+	if err := kv.forwardFenceLocked("ForwardUpdate", args.ViewNum, args.Sender); err != OK {
+		reply.Err = err
+		return nil
+	}
+	if _, dup := kv.isDuplicate(args.Update.ClientID, args.Update.Seq); dup {
+		reply.Err = OK
+		return nil
+	}
+	reply.Err = kv.applyLocked(&args.Update, args.Meta)
+	return nil
+}
+
+// SyncBegin opens a staging area for an incoming state transfer. A
+// newer transfer replaces any half-finished one.
+func (kv *KVServer) SyncBegin(args *SyncBeginArgs, reply *SyncBeginReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	kv.warnWireVersionLocked("SyncBegin", args.WireHeader)
+
+	if args.ViewNum < kv.view.ViewNum {
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	if args.ViewNum == kv.view.ViewNum && args.Sender != kv.view.Primary {
+		// Right view, wrong sender: only the view's primary may
+		// replace this replica's state.
+		reply.Err = ErrNotPrimary
+		return nil
+	}
+	kv.stagingID = args.TransferID
+	kv.stagingSeq = 0
+	kv.staging = map[string]string{}
+	kv.stagingMeta = map[string]KeyMeta{}
+	reply.Err = OK
+	return nil
+}
+
+// SyncChunk appends one batch of keys to the staging area.
+func (kv *KVServer) SyncChunk(args *SyncChunkArgs, reply *SyncChunkReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	kv.warnWireVersionLocked("SyncChunk", args.WireHeader)
+
+	if kv.staging == nil || kv.stagingID != args.TransferID {
+		reply.Err = ErrBadTransfer
+		return nil
+	}
+	if args.Seq != 0 && args.Seq <= kv.stagingSeq {
+		// A retried chunk whose first attempt landed but whose reply
+		// was lost: acknowledge it again instead of re-merging.
+		reply.Err = OK
+		return nil
+	}
+	kv.stagingSeq = args.Seq
+	for k, v := range args.Data {
+		kv.staging[k] = v
+	}
+	for k, m := range args.Meta {
+		kv.stagingMeta[k] = m
+	}
+	reply.Err = OK
+	return nil
+}
+
+// SyncEnd atomically replaces this server's state with the staged
+// transfer, so a transfer that dies halfway never leaves the backup
+// half-populated.
+func (kv *KVServer) SyncEnd(args *SyncEndArgs, reply *SyncEndReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+	kv.warnWireVersionLocked("SyncEnd", args.WireHeader)
+
+	if kv.staging == nil || kv.stagingID != args.TransferID {
+		reply.Err = ErrBadTransfer
+		return nil
+	}
+	if sum := stateChecksum(kv.staging); sum != args.Checksum {
+		// Something got corrupted or lost in transit; drop the
+		// staged copy so the primary can retry from scratch.
+		kv.staging = nil
+		kv.stagingMeta = nil
+		reply.Err = ErrChecksum
+		return nil
+	}
+	kv.store.Replace(kv.staging)
+	kv.approxBytes = approxSize(kv.staging)
+	kv.meta = kv.stagingMeta
+	kv.staging = nil
+	kv.stagingMeta = nil
+	kv.lastSeq = make(map[int64]DedupEntry, len(args.LastSeq))
+	for c, e := range args.LastSeq {
+		kv.lastSeq[c] = e
+	}
+	kv.tombstones = make(map[string]time.Time, len(args.Tombstones))
+	for k, t := range args.Tombstones {
+		kv.tombstones[k] = t
+	}
+	kv.stateComplete = true
+	reply.Err = OK
+	return nil
+}
+
+// Stats reports key count and approximate byte size so operators can
+// alert before the server hits its capacity limits.
+func (kv *KVServer) Stats(args *StatsArgs, reply *StatsReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	reply.Keys = kv.store.Len()
+	reply.ApproxBytes = kv.approxBytes
+	reply.MaxKeys = kv.maxKeys
+	reply.Syncing = kv.transferring
+	reply.OpenConns = kv.openConns()
+	return nil
+}
+
+// Health reports liveness and role for monitoring tools. It
+// deliberately does not increment rpcCount.
+func (kv *KVServer) Health(args *HealthArgs, reply *HealthReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	reply.Role = kv.roleLocked()
+	reply.Alive = !kv.dead.Load()
+	reply.ViewNum = kv.view.ViewNum
+	return nil
+}
+
+// roleLocked names the role kv currently plays in its view. Caller
+// must hold kv.mu.
+func (kv *KVServer) roleLocked() string {
+	switch kv.me {
+	case kv.view.Primary:
+		return "primary"
+	case kv.view.Backup:
+		return "backup"
+	default:
+		return "idle"
+	}
+}
+
+// tick pings the view service once, adopts the returned view and
+// kicks off a state transfer if a new backup appeared while this
+// server is primary.
+func (kv *KVServer) tick() {
+	kv.mu.Lock()
+	viewnum := kv.view.ViewNum
+	unreachable := kv.backupUnreachable && kv.view.Primary == kv.me && kv.view.Backup != ""
+	priority := kv.priority
+	syncing := kv.view.Primary == kv.me && kv.view.Backup != "" && !kv.backupSynced
+	backupOnly := kv.backupOnly
+	kv.mu.Unlock()
+
+	pr, err := kv.vs.PingReport(viewnum, unreachable, priority, syncing, backupOnly)
+	view := pr.View
+
+	kv.mu.Lock()
+	kv.evictDedupLocked(kv.clk.Now())
+	kv.reapTombstonesLocked(kv.clk.Now())
+	oldRole := kv.roleLocked()
+	// The role-change callback fires after the mutex is released, so
+	// it can call back into the server without deadlocking.
+	var notify func(old, new string)
+	newRole := oldRole
+	defer func() {
+		if notify != nil && newRole != oldRole {
+			notify(oldRole, newRole)
+		}
+	}()
+	defer kv.mu.Unlock()
+	defer func() {
+		newRole = kv.roleLocked()
+		notify = kv.onRoleChange
+	}()
+
+	if err != nil {
+		// If the view service has been unreachable too long our view
+		// has expired; stop serving as primary rather than risk
+		// answering with a stale role.
+		if kv.clk.Now().Sub(kv.lastPingOK) > viewservice.DeadPings*viewservice.PingInterval {
+			kv.view = viewservice.View{}
+		}
+		return
+	}
+	kv.lastPingOK = kv.clk.Now()
+	if view.Primary == kv.me {
+		// The view service just confirmed us as primary; renew the
+		// serving lease.
+		kv.primaryConfirmed = kv.lastPingOK
+	}
+
+	oldBackup := kv.view.Backup
+	if view.ViewNum != kv.view.ViewNum && kv.staging != nil {
+		// A view change invalidates any half-received transfer: its
+		// sender is no longer the primary of record, and a SyncEnd
+		// that never arrived must not be waited for forever.
+		kv.staging = nil
+		kv.stagingMeta = nil
+	}
+	if view.ViewNum == 1 && view.Primary == kv.me {
+		// The bootstrap primary's (empty) state is the dataset by
+		// definition.
+		kv.stateComplete = true
+	}
+	if pr.StateAuthoritative && view.Primary == kv.me {
+		// Promoted through the data-loss path: the loss was accepted,
+		// so whatever this server holds is the dataset now. Without
+		// this an empty promoted primary would answer ErrBusy forever,
+		// waiting for a transfer that cannot come.
+		kv.stateComplete = true
+	}
+	kv.view = view
+
+	if view.Backup != oldBackup {
+		kv.backupUnreachable = false
+		// The new backup holds nothing of ours until a transfer
+		// completes; pings report it as syncing so the view service
+		// won't promote it in the meantime.
+		kv.backupSynced = false
+		if kv.fwd != nil {
+			kv.fwd.close()
+			kv.fwd = nil
+		}
+	}
+	if view.Primary == kv.me && view.Backup != "" && view.Backup != oldBackup {
+		kv.syncToBackupAsyncLocked(view.Backup)
+		return
+	}
+	kv.maybeVerifyBackupLocked()
+}
+
+// maybeVerifyBackupLocked runs the periodic divergence check when one
+// is due: it asks the backup for its state checksum and re-streams
+// the full state on a mismatch. Caller must hold kv.mu; a re-sync
+// drops the lock and queues new writes the same way a backup-change
+// transfer does.
+func (kv *KVServer) maybeVerifyBackupLocked() {
+	if kv.verifyInterval <= 0 || kv.view.Primary != kv.me || kv.view.Backup == "" || kv.transferring {
+		return
+	}
+	now := kv.clk.Now()
+	if now.Sub(kv.lastVerify) < kv.verifyInterval {
+		return
+	}
+	kv.lastVerify = now
+	backup := kv.view.Backup
+	// A write past its forward has reached the backup but not yet the
+	// local store; wait those out so a mismatch really is divergence
+	// and not a race against an in-flight Put.
+	for kv.inflight > 0 {
+		kv.transferCond.Wait()
+	}
+	if kv.view.Primary != kv.me || kv.view.Backup != backup || kv.transferring {
+		return
+	}
+	sum := stateChecksum(kv.store.Snapshot())
+
+	// The RPC runs with the lock held: no new write can pass
+	// validation and reach the backup while the checksums are
+	// compared.
+	var vr VerifyStateReply
+	if !call(kv.tr, backup, "KVServer.VerifyState", &VerifyStateArgs{}, &vr) || vr.Checksum == sum {
+		return
+	}
+	log.Printf("kvservice: %s: backup %s diverged (checksum %x != %x); re-syncing", kv.me, backup, vr.Checksum, sum)
+	kv.syncToBackupAsyncLocked(backup)
+}
+
+// syncToBackupAsyncLocked runs the stream on its own goroutine, for
+// callers on the ping loop: a transfer larger than DeadInterval's
+// worth of RPCs would otherwise silence the primary's pings and get
+// it declared dead mid-transfer, promoting the half-synced backup.
+// transferring is set before the caller's lock is released, so new
+// writes queue from this instant just as with the synchronous form.
+// Caller must hold kv.mu.
+func (kv *KVServer) syncToBackupAsyncLocked(backup string) {
+	kv.transferring = true
+	go func() {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if kv.view.Primary != kv.me || kv.view.Backup != backup {
+			// The view moved on before the stream could start.
+			kv.transferring = false
+			kv.transferCond.Broadcast()
+			return
+		}
+		kv.syncToBackupLocked(backup)
+	}()
+}
+
+// syncChunkSize is how many keys travel per SyncChunk RPC.
+const syncChunkSize = 500
+
+// syncToBackupLocked streams a full state snapshot to backup as a
+// SyncBegin / SyncChunk... / SyncEnd sequence. It is called with
+// kv.mu held; the lock is dropped for the duration of the RPCs while
+// kv.transferring makes new writes queue.
+func (kv *KVServer) syncToBackupLocked(backup string) {
+	kv.transferring = true
+	// Wait out writes already past their forward: the backup has
+	// received them, so the snapshot must include their local apply
+	// or the re-synced backup would end up behind where it was.
+	for kv.inflight > 0 {
+		kv.transferCond.Wait()
+	}
+	viewnum := kv.view.ViewNum
+	data := kv.store.Snapshot()
+	meta := make(map[string]KeyMeta, len(kv.meta))
+	for k, m := range kv.meta {
+		meta[k] = m
+	}
+	lastSeq := make(map[int64]DedupEntry, len(kv.lastSeq))
+	for c, s := range kv.lastSeq {
+		lastSeq[c] = s
+	}
+	tombstones := make(map[string]time.Time, len(kv.tombstones))
+	for k, t := range kv.tombstones {
+		tombstones[k] = t
+	}
+	kv.mu.Unlock()
+
+	// Transient chunk failures are retried inside streamState; a
+	// restart here means the session itself was abandoned (checksum
+	// mismatch, repeated chunk failures, or a lost SyncEnd) and is
+	// worth a couple of fresh attempts before leaving it to the view
+	// service.
+	synced := false
+	for attempt := 0; attempt < 3; attempt++ {
+		if kv.streamState(backup, viewnum, data, meta, lastSeq, tombstones) {
+			synced = true
+			break
+		}
+	}
+
+	kv.mu.Lock()
+	if synced && kv.view.Backup == backup {
+		kv.backupSynced = true
+	}
+	kv.transferring = false
+	kv.transferCond.Broadcast()
+}
+
+// syncChunkRetries is how many times a single chunk is retried
+// against the same transfer session before the session is abandoned
+// and streamState reports failure.
+const syncChunkRetries = 3
+
+// streamState performs the chunked transfer. A chunk lost to a
+// transient disconnect is resent under the same session id, resuming
+// from the last chunk the backup acknowledged instead of restarting
+// the stream. It returns false only once the session is beyond
+// saving; the backup then keeps its previous data and the view
+// service will eventually notice a dead or lagging backup.
+func (kv *KVServer) streamState(backup string, viewnum uint, data map[string]string, meta map[string]KeyMeta, lastSeq map[int64]DedupEntry, tombstones map[string]time.Time) bool {
+	id := nrand()
+
+	var br SyncBeginReply
+	begin := &SyncBeginArgs{WireHeader: wireHeader(), TransferID: id, ViewNum: viewnum, Sender: kv.me}
+	if !call(kv.tr, backup, "KVServer.SyncBegin", begin, &br) || br.Err != OK {
+		return false
+	}
+
+	// Cut the snapshot into numbered chunks up front, so a retry
+	// resends exactly the chunk that failed.
+	type chunk struct {
+		data map[string]string
+		meta map[string]KeyMeta
+	}
+	var chunks []chunk
+	cur := chunk{data: make(map[string]string, syncChunkSize), meta: make(map[string]KeyMeta, syncChunkSize)}
+	for k, v := range data {
+		cur.data[k] = v
+		if m, ok := meta[k]; ok {
+			cur.meta[k] = m
+		}
+		if len(cur.data) >= syncChunkSize {
+			chunks = append(chunks, cur)
+			cur = chunk{data: make(map[string]string, syncChunkSize), meta: make(map[string]KeyMeta, syncChunkSize)}
+		}
+	}
+	if len(cur.data) > 0 {
+		chunks = append(chunks, cur)
+	}
+
+	for i, c := range chunks {
+		args := &SyncChunkArgs{WireHeader: wireHeader(), TransferID: id, Seq: i + 1, Data: c.data, Meta: c.meta}
+		sent := false
+		for attempt := 0; attempt < syncChunkRetries; attempt++ {
+			var cr SyncChunkReply
+			if call(kv.tr, backup, "KVServer.SyncChunk", args, &cr) && cr.Err == OK {
+				sent = true
+				break
+			}
+		}
+		if !sent {
+			return false
+		}
+	}
+
+	var er SyncEndReply
+	args := &SyncEndArgs{WireHeader: wireHeader(), TransferID: id, LastSeq: lastSeq, Checksum: stateChecksum(data), Tombstones: tombstones}
+	return call(kv.tr, backup, "KVServer.SyncEnd", args, &er) && er.Err == OK
+}
+
+// AdminResync re-streams the full state to the current backup on
+// demand, without waiting for a backup change or the periodic verify
+// pass. A transfer already in flight answers ErrBusy rather than
+// stacking a second stream behind it.
+func (kv *KVServer) AdminResync(args *AdminResyncArgs, reply *AdminResyncReply) error {
+	kv.mu.Lock()
+	kv.rpcCount++
+	if kv.adminSecret != "" && args.Secret != kv.adminSecret {
+		kv.mu.Unlock()
+		return errors.New("kvservice: bad admin secret")
+	}
+	if kv.view.Primary != kv.me {
+		kv.mu.Unlock()
+		return errors.New("kvservice: not the primary")
+	}
+	if kv.view.Backup == "" {
+		kv.mu.Unlock()
+		return errors.New("kvservice: no backup to resync")
+	}
+	if kv.transferring {
+		kv.mu.Unlock()
+		reply.Err = ErrBusy
+		return nil
+	}
+	backup := kv.view.Backup
+	kv.syncToBackupLocked(backup)
+	synced := kv.backupSynced && kv.view.Backup == backup
+	kv.mu.Unlock()
+	if !synced {
+		return errors.New("kvservice: resync failed; backup unreachable or view changed")
+	}
+	reply.Err = OK
+	return nil
+}
+
+// StepDown hands the primary role to the backup cleanly, for rolling
+// restarts: it makes sure the backup holds identical state, asks the
+// view service to demote this server, and drops its own lease so
+// in-flight clients get a retryable ErrNotPrimary rather than stale
+// answers or connection resets.
+func (kv *KVServer) StepDown(args *StepDownArgs, reply *StepDownReply) error {
+	kv.mu.Lock()
+	kv.rpcCount++
+	if kv.adminSecret != "" && args.Secret != kv.adminSecret {
+		kv.mu.Unlock()
+		return errors.New("kvservice: bad admin secret")
+	}
+	if kv.view.Primary != kv.me {
+		kv.mu.Unlock()
+		return errors.New("kvservice: not the primary")
+	}
+	if kv.view.Backup == "" {
+		kv.mu.Unlock()
+		return errors.New("kvservice: no backup to hand over to")
+	}
+	if kv.transferring {
+		kv.mu.Unlock()
+		return errors.New("kvservice: state transfer in flight; retry shortly")
+	}
+	backup := kv.view.Backup
+	sum := stateChecksum(kv.store.Snapshot())
+	kv.mu.Unlock()
+
+	var vr VerifyStateReply
+	if !call(kv.tr, backup, "KVServer.VerifyState", &VerifyStateArgs{}, &vr) {
+		return errors.New("kvservice: backup unreachable")
+	}
+	if vr.Checksum != sum {
+		// The backup lagged (e.g. lenient forwarding); re-stream the
+		// full state before handing over.
+		kv.mu.Lock()
+		kv.syncToBackupLocked(backup)
+		sum = stateChecksum(kv.store.Snapshot())
+		kv.mu.Unlock()
+		if !call(kv.tr, backup, "KVServer.VerifyState", &VerifyStateArgs{}, &vr) || vr.Checksum != sum {
+			return errors.New("kvservice: backup is not in sync")
+		}
+	}
+
+	r, err := kv.vs.AdminReassign(&viewservice.AdminReassignArgs{Secret: args.Secret, Action: "demote"})
+	if err != nil {
+		return err
+	}
+
+	kv.mu.Lock()
+	// Fence immediately instead of waiting for the next ping to
+	// deliver the new view.
+	kv.primaryConfirmed = time.Time{}
+	kv.mu.Unlock()
+
+	reply.Queued = r.Queued
+	reply.View = r.View
+	return nil
+}
+
+// Flush wipes the store and dedup table, for test environments. On
+// the primary the flush reaches the backup first, mirroring Put's
+// forward-then-apply order. The change sequence is deliberately not
+// reset: watchers and delta syncs rely on it staying monotonic
+// across a flush.
+func (kv *KVServer) Flush(args *FlushArgs, reply *FlushReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	if kv.adminSecret != "" && args.Secret != kv.adminSecret {
+		return errors.New("kvservice: bad admin secret")
+	}
+	if kv.view.Primary == kv.me && kv.view.Backup != "" {
+		var fr FlushReply
+		if !call(kv.tr, kv.view.Backup, "KVServer.Flush", args, &fr) && kv.strictForward {
+			return errors.New("kvservice: flushing the backup failed")
+		}
+	}
+	kv.store.Replace(map[string]string{})
+	kv.lastSeq = map[int64]DedupEntry{}
+	kv.meta = map[string]KeyMeta{}
+	kv.tombstones = map[string]time.Time{}
+	kv.approxBytes = 0
+	return nil
+}
+
+// snapshotFile is the on-disk layout written by SnapshotTo and read
+// back by RestoreFrom.
+type snapshotFile struct {
+	Data    map[string]string
+	LastSeq map[int64]DedupEntry
+	// Meta is absent in files from before per-key metadata existed;
+	// restoring such a file leaves the metadata empty.
+	Meta map[string]KeyMeta
+}
+
+// SnapshotTo serializes the full contents and dedup table to a file
+// on this server's host, written via rename so a crash mid-snapshot
+// never leaves a truncated file behind.
+func (kv *KVServer) SnapshotTo(args *SnapshotToArgs, reply *SnapshotToReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	if kv.adminSecret != "" && args.Secret != kv.adminSecret {
+		return errors.New("kvservice: bad admin secret")
+	}
+
+	snap := snapshotFile{Data: kv.store.Snapshot(), LastSeq: kv.lastSeq, Meta: kv.meta}
+	tmp := args.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = kv.codec.Encode(f, &snap)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, args.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	reply.Keys = len(snap.Data)
+	return nil
+}
+
+// RestoreFrom loads a SnapshotTo file into this server. It refuses
+// while the server holds a role, since overwriting a live replica
+// would diverge it from its peer; restore an idle server, then let
+// the view service recruit it.
+func (kv *KVServer) RestoreFrom(args *RestoreFromArgs, reply *RestoreFromReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	if kv.adminSecret != "" && args.Secret != kv.adminSecret {
+		return errors.New("kvservice: bad admin secret")
+	}
+	if kv.view.Primary == kv.me || kv.view.Backup == kv.me {
+		return errors.New("kvservice: refusing to restore onto a server with a role")
+	}
+
+	f, err := os.Open(args.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var snap snapshotFile
+	if err := kv.codec.Decode(f, &snap); err != nil {
+		return err
+	}
+	kv.store.Replace(snap.Data)
+	kv.approxBytes = approxSize(snap.Data)
+	kv.meta = make(map[string]KeyMeta, len(snap.Meta))
+	for k, m := range snap.Meta {
+		kv.meta[k] = m
+	}
+	kv.lastSeq = make(map[int64]DedupEntry, len(snap.LastSeq))
+	for c, e := range snap.LastSeq {
+		kv.lastSeq[c] = e
+	}
+	// A restored snapshot is a full copy: the server may serve as
+	// primary once the view service appoints it.
+	kv.stateComplete = true
+	reply.Keys = len(snap.Data)
+	return nil
+}
+
+// Inspect reports when a key was last modified: the view number and
+// wall time of the write, as stamped by the primary. Like
+// VerifyState it answers from local state regardless of role, so an
+// operator can confirm both replicas hold the same metadata.
+func (kv *KVServer) Inspect(args *InspectArgs, reply *InspectReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	if _, ok := kv.store.Get(args.Key); !ok {
+		reply.Err = ErrNoKey
+		return nil
+	}
+	reply.Meta = kv.meta[args.Key]
+	reply.Err = OK
+	return nil
+}
+
+// VerifyState reports a checksum of this server's current contents,
+// so an operator can re-check primary/backup consistency on demand.
+func (kv *KVServer) VerifyState(args *VerifyStateArgs, reply *VerifyStateReply) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rpcCount++
+
+	reply.Checksum = stateChecksum(kv.store.Snapshot())
+	reply.Keys = kv.store.Len()
+	return nil
+}
+
+// pingLoop drives tick once per ping interval.
+func (kv *KVServer) pingLoop() {
+	t := kv.clk.NewTicker(viewservice.PingInterval)
+	defer t.Stop()
+	for !kv.dead.Load() {
+		kv.tick()
+		<-t.C()
+	}
+}
+
+// Kill shuts the server down, for tests.
+func (kv *KVServer) Kill() {
+	kv.leave()
+	kv.dead.Store(true)
+	kv.l.Close()
+}
+
+// leave tells the view service this server is going for good, so
+// failover starts now rather than after DeadInterval of silence.
+// Sent once, best effort: if the view service is unreachable it will
+// notice our silence the slow way.
+func (kv *KVServer) leave() {
+	if kv.left.CompareAndSwap(false, true) {
+		kv.vs.Leave()
+	}
+}
+
+// Shutdown stops the server gracefully: it stops accepting new
+// connections, then waits for the in-flight ones to drain. If ctx
+// expires first — say a handler is stuck forwarding to a dead
+// backup — the remaining connections are force-closed and the
+// returned error reports the forced stop, so orchestrators get a
+// bounded shutdown either way. Kill is Shutdown with no grace.
+func (kv *KVServer) Shutdown(ctx context.Context) error {
+	kv.leave()
+	kv.dead.Store(true)
+	kv.l.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		kv.connWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	kv.connMu.Lock()
+	n := len(kv.conns)
+	for c := range kv.conns {
+		c.Close()
+	}
+	kv.connMu.Unlock()
+	return fmt.Errorf("kvservice: %s: forced shutdown with %d connections still open: %w", kv.me, n, ctx.Err())
+}
+
+// SetMaxConns caps how many connections the server serves at once;
+// newcomers over the cap are closed immediately, which clients see
+// as a retryable transport failure. Zero means unlimited.
+func (kv *KVServer) SetMaxConns(n int) {
+	kv.maxConns.Store(int64(n))
+}
+
+// SetMaxMessageBytes caps the size of a single incoming RPC message;
+// a connection that sends a larger one is closed mid-decode instead
+// of ballooning memory. Zero (the default) means unlimited. Only
+// connections accepted after the change are affected.
+func (kv *KVServer) SetMaxMessageBytes(n int64) {
+	kv.maxMsgBytes.Store(n)
+}
+
+// SetSlowRPCThreshold makes the server log any RPC handler that
+// takes longer than d, naming the method and the duration. Zero (the
+// default) disables the logging.
+func (kv *KVServer) SetSlowRPCThreshold(d time.Duration) {
+	kv.slowRPC.Store(int64(d))
+}
+
+// slowCodec wraps the server codec to time each request from header
+// read to response write and log the slow ones. net/rpc may run a
+// connection's handlers concurrently, so in-flight requests are
+// matched up by sequence number.
+type slowCodec struct {
+	rpc.ServerCodec
+	kv      *KVServer
+	mu      sync.Mutex
+	pending map[uint64]pendingRPC
+}
+
+type pendingRPC struct {
+	method string
+	start  time.Time
+}
+
+func (c *slowCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pending[r.Seq] = pendingRPC{method: r.ServiceMethod, start: c.kv.clk.Now()}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *slowCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	p, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+	if threshold := time.Duration(c.kv.slowRPC.Load()); ok && threshold > 0 {
+		if elapsed := c.kv.clk.Now().Sub(p.start); elapsed > threshold {
+			log.Printf("kvservice: %s: slow RPC %s took %v (threshold %v)",
+				c.kv.me, p.method, elapsed, threshold)
+		}
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// openConns is the number of accepted connections currently being
+// served.
+func (kv *KVServer) openConns() int {
+	kv.connMu.Lock()
+	defer kv.connMu.Unlock()
+	return len(kv.conns)
+}
+
+// trackConn registers an accepted connection for Shutdown's drain
+// accounting; the returned func removes it once serving ends.
+func (kv *KVServer) trackConn(c net.Conn) func() {
+	kv.connMu.Lock()
+	kv.conns[c] = struct{}{}
+	kv.connMu.Unlock()
+	kv.connWG.Add(1)
+	return func() {
+		kv.connMu.Lock()
+		delete(kv.conns, c)
+		kv.connMu.Unlock()
+		kv.connWG.Done()
+	}
+}
+
+// StartServer starts a KV server listening on me that reports to the
+// view service at vshost, backed by the in-memory store.
+func StartServer(vshost string, me string) *KVServer {
+	return StartServerWithClock(vshost, me, clock.Real())
+}
+
+// StartServerWithClock is StartServer with an explicit clock, for
+// tests that need deterministic time.
+func StartServerWithClock(vshost string, me string, clk clock.Clock) *KVServer {
+	return StartServerWithStore(vshost, me, clk, NewMapStore())
+}
+
+// StartServerWithStore is StartServer with an explicit storage
+// backend, e.g. a FileStore for datasets larger than memory.
+func StartServerWithStore(vshost string, me string, clk clock.Clock, store Store) *KVServer {
+	return StartServerAdvertising(vshost, me, me, clk, store)
+}
+
+// StartServerAdvertising is StartServerWithStore with the listener
+// bound separately from the advertised name: me is what the view
+// service records and what clients and peers dial, listenAddr is
+// what the process binds — e.g. advertise a routable hostname while
+// binding "0.0.0.0:9001" behind NAT. The other constructors bind
+// and advertise the same address.
+func StartServerAdvertising(vshost string, me string, listenAddr string, clk clock.Clock, store Store) *KVServer {
+	return StartServerWithTransport(vshost, me, listenAddr, clk, store, transport.Real())
+}
+
+// StartServerWithTransport is the most general constructor: it also
+// takes the transport the server listens and dials on, so tests can
+// run a whole cluster over in-memory pipes.
+func StartServerWithTransport(vshost string, me string, listenAddr string, clk clock.Clock, store Store, tr transport.Transport) *KVServer {
+	kv := &KVServer{
+		me:           me,
+		vs:           viewservice.MakeClerkWithTransport(me, vshost, tr),
+		store:        store,
+		lastSeq:      map[int64]DedupEntry{},
+		meta:         map[string]KeyMeta{},
+		tombstones:   map[string]time.Time{},
+		keyLocks:     map[string]*keyLock{},
+		lastPingOK:   clk.Now(),
+		clk:          clk,
+		maxPending:   DefaultMaxPending,
+		fwdConns:     DefaultForwardConns,
+		maxKeySize:   DefaultMaxKeySize,
+		maxValueSize: DefaultMaxValueSize,
+		// Strict forwarding is the default; SetStrictForwarding(false)
+		// restores the old apply-anyway behavior.
+		strictForward: true,
+		codec:         GobCodec{},
+		tr:            tr,
+		conns:         map[net.Conn]struct{}{},
+	}
+	kv.transferCond = sync.NewCond(&kv.mu)
+	kv.watchCh = make(chan struct{})
+
+	rpcs := rpc.NewServer()
+	rpcs.Register(kv)
+
+	l, err := tr.Listen(listenAddr)
+	if err != nil {
+		log.Fatal("kvservice listen error: ", err)
+	}
+	kv.l = l
+
+	go func() {
+		for !kv.dead.Load() {
+			conn, err := kv.l.Accept()
+			if err != nil {
+				if kv.dead.Load() {
+					return
+				}
+				continue
+			}
+			if kv.dead.Load() {
+				conn.Close()
+				continue
+			}
+			if max := kv.maxConns.Load(); max > 0 && int64(kv.openConns()) >= max {
+				// Over the connection cap: shed the newcomer at once
+				// instead of spawning yet another serving goroutine.
+				conn.Close()
+				continue
+			}
+			wrapped := transport.IdleTimeout(conn, time.Duration(kv.idleTimeout.Load()))
+			done := kv.trackConn(wrapped)
+			go func() {
+				defer done()
+				codec := transport.GobServerCodec(wrapped, kv.maxMsgBytes.Load())
+				rpcs.ServeCodec(&slowCodec{ServerCodec: codec, kv: kv, pending: map[uint64]pendingRPC{}})
+			}()
+		}
+	}()
+
+	go kv.pingLoop()
+	return kv
+}
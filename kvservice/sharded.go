@@ -0,0 +1,125 @@
+package kvservice
+
+import (
+	"dsdemo/viewservice"
+)
+
+// ShardedClient routes each key to the primary/backup pair that owns
+// it, for deployments where the view service splits the key space
+// over several shards (ViewServer.SetNumShards). It holds one Client
+// per shard; each inherits the full retry and failover behavior, so
+// sharding composes with the existing per-pair replication rather
+// than replacing it. Cross-key operations touch one shard per key
+// and give no atomicity across shards.
+type ShardedClient struct {
+	clients []*Client
+	// partitioner decides which shard owns each key; the stable hash
+	// from viewservice.ShardFor unless SetPartitioner replaced it.
+	partitioner Partitioner
+}
+
+// Partitioner maps keys to shard ids for a ShardedClient. shards is
+// the client's shard count; implementations must return a value in
+// [0, shards) and be deterministic, and every client of a cluster
+// must use the same mapping or they will read and write through
+// different primaries. With a single shard every mapping collapses
+// to shard 0.
+type Partitioner interface {
+	ShardFor(key string, shards int) int
+}
+
+// hashPartitioner is the default Partitioner: the same stable FNV
+// hash the view service ships as viewservice.ShardFor.
+type hashPartitioner struct{}
+
+func (hashPartitioner) ShardFor(key string, shards int) int {
+	return viewservice.ShardFor(key, shards)
+}
+
+// MakeShardedClient returns a client for a cluster of shards
+// primary/backup pairs. shards must match the view service's
+// configured shard count, or keys will be routed to the wrong
+// primaries.
+func MakeShardedClient(shards int, vsAddrs ...string) *ShardedClient {
+	return MakeShardedClientWithConfig(ClientConfig{}, shards, vsAddrs...)
+}
+
+// MakeShardedClientWithConfig is MakeShardedClient with explicit
+// tuning; the config applies to every per-shard client.
+func MakeShardedClientWithConfig(cfg ClientConfig, shards int, vsAddrs ...string) *ShardedClient {
+	if shards < 1 {
+		shards = 1
+	}
+	sc := &ShardedClient{clients: make([]*Client, shards), partitioner: hashPartitioner{}}
+	for i := range sc.clients {
+		sc.clients[i] = MakeClientWithConfig(cfg, vsAddrs...)
+		sc.clients[i].shard = i
+	}
+	return sc
+}
+
+// SetPartitioner replaces how keys map to shards, e.g. to route by a
+// key prefix and keep related keys on one shard. Every client of the
+// cluster must be given the same partitioner; nil restores the
+// default hash.
+func (sc *ShardedClient) SetPartitioner(p Partitioner) {
+	if p == nil {
+		p = hashPartitioner{}
+	}
+	sc.partitioner = p
+}
+
+// ShardFor returns the shard that owns key. A partitioner result
+// outside [0, shards) is folded back in rather than letting a buggy
+// implementation index out of range.
+func (sc *ShardedClient) ShardFor(key string) int {
+	s := sc.partitioner.ShardFor(key, len(sc.clients)) % len(sc.clients)
+	if s < 0 {
+		s += len(sc.clients)
+	}
+	return s
+}
+
+// Shard exposes the per-shard client owning key, for operations the
+// routing wrappers below don't cover.
+func (sc *ShardedClient) Shard(key string) *Client {
+	return sc.clients[sc.ShardFor(key)]
+}
+
+// Close releases every per-shard client.
+func (sc *ShardedClient) Close() {
+	for _, ck := range sc.clients {
+		ck.Close()
+	}
+}
+
+// Get fetches the current value for a key from the shard that owns
+// it; "" if the key has never been set.
+func (sc *ShardedClient) Get(key string) string {
+	return sc.Shard(key).Get(key)
+}
+
+// GetOK is Get distinguishing a missing key from an empty value.
+func (sc *ShardedClient) GetOK(key string) (string, bool, error) {
+	return sc.Shard(key).GetOK(key)
+}
+
+// Put writes a key on the shard that owns it.
+func (sc *ShardedClient) Put(key string, value string) error {
+	return sc.Shard(key).Put(key, value)
+}
+
+// PutIfAbsent writes a key only if it does not exist yet.
+func (sc *ShardedClient) PutIfAbsent(key string, value string) (bool, error) {
+	return sc.Shard(key).PutIfAbsent(key, value)
+}
+
+// Delete removes a key from the shard that owns it.
+func (sc *ShardedClient) Delete(key string) error {
+	return sc.Shard(key).Delete(key)
+}
+
+// Incr atomically adds delta to the integer stored under key.
+func (sc *ShardedClient) Incr(key string, delta int64) (int64, error) {
+	return sc.Shard(key).Incr(key, delta)
+}
@@ -0,0 +1,218 @@
+package kvservice
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Store abstracts the key/value storage backend so the server isn't
+// tied to an in-memory map. Implementations don't need to be
+// goroutine-safe; the server serializes access under its mutex.
+type Store interface {
+	Get(key string) (string, bool)
+	Put(key, value string)
+	Delete(key string)
+	// Range calls fn for every pair until fn returns false.
+	Range(fn func(key, value string) bool)
+	// Snapshot returns a copy of the entire contents, for state
+	// transfer.
+	Snapshot() map[string]string
+	// Replace swaps in entirely new contents, for state transfer
+	// restore.
+	Replace(data map[string]string)
+	Len() int
+}
+
+// MapStore is the default in-memory backend.
+type MapStore struct {
+	m map[string]string
+}
+
+func NewMapStore() *MapStore {
+	return &MapStore{m: map[string]string{}}
+}
+
+func (s *MapStore) Get(key string) (string, bool) {
+	v, ok := s.m[key]
+	return v, ok
+}
+
+func (s *MapStore) Put(key, value string) {
+	s.m[key] = value
+}
+
+func (s *MapStore) Delete(key string) {
+	delete(s.m, key)
+}
+
+func (s *MapStore) Range(fn func(key, value string) bool) {
+	for k, v := range s.m {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+func (s *MapStore) Snapshot() map[string]string {
+	out := make(map[string]string, len(s.m))
+	for k, v := range s.m {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *MapStore) Replace(data map[string]string) {
+	s.m = make(map[string]string, len(data))
+	for k, v := range data {
+		s.m[k] = v
+	}
+}
+
+func (s *MapStore) Len() int {
+	return len(s.m)
+}
+
+// FileStore keeps values on disk, one file per key, so the dataset
+// isn't bounded by RAM. Only the key set lives in memory; values are
+// read back from disk on demand. Entries are gob-encoded and written
+// via rename for crash safety.
+type FileStore struct {
+	dir  string
+	dd   *DataDir
+	keys map[string]bool
+}
+
+type fileEntry struct {
+	Key   string
+	Value string
+}
+
+// NewFileStore opens (or creates) a store rooted at dir, rebuilding
+// the key index from the files already present. The directory is
+// taken under an exclusive lock; opening a dir another process (or
+// another store) holds fails fast instead of corrupting it.
+func NewFileStore(dir string) (*FileStore, error) {
+	dd, err := OpenDataDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{dir: dir, dd: dd, keys: map[string]bool{}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		dd.Close()
+		return nil, err
+	}
+	for _, de := range entries {
+		if de.IsDir() || filepath.Ext(de.Name()) != ".kv" {
+			continue
+		}
+		var e fileEntry
+		if s.read(filepath.Join(dir, de.Name()), &e) {
+			s.keys[e.Key] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *FileStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".kv")
+}
+
+func (s *FileStore) read(path string, e *fileEntry) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(e); err != nil {
+		log.Printf("kvservice: corrupt store entry %s: %v", path, err)
+		return false
+	}
+	return true
+}
+
+func (s *FileStore) Get(key string) (string, bool) {
+	if !s.keys[key] {
+		return "", false
+	}
+	var e fileEntry
+	if !s.read(s.path(key), &e) {
+		return "", false
+	}
+	return e.Value, true
+}
+
+func (s *FileStore) Put(key, value string) {
+	path := s.path(key)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("kvservice: store write %s: %v", key, err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(&fileEntry{Key: key, Value: value})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Printf("kvservice: store write %s: %v", key, err)
+		os.Remove(tmp)
+		return
+	}
+	s.keys[key] = true
+}
+
+func (s *FileStore) Delete(key string) {
+	if !s.keys[key] {
+		return
+	}
+	delete(s.keys, key)
+	if err := os.Remove(s.path(key)); err != nil {
+		log.Printf("kvservice: store delete %s: %v", key, err)
+	}
+}
+
+func (s *FileStore) Range(fn func(key, value string) bool) {
+	for key := range s.keys {
+		value, ok := s.Get(key)
+		if ok && !fn(key, value) {
+			return
+		}
+	}
+}
+
+func (s *FileStore) Snapshot() map[string]string {
+	out := make(map[string]string, len(s.keys))
+	s.Range(func(k, v string) bool {
+		out[k] = v
+		return true
+	})
+	return out
+}
+
+func (s *FileStore) Replace(data map[string]string) {
+	for key := range s.keys {
+		s.Delete(key)
+	}
+	for k, v := range data {
+		s.Put(k, v)
+	}
+}
+
+func (s *FileStore) Len() int {
+	return len(s.keys)
+}
+
+// Close releases the store's directory lock so another process (or a
+// reopened store) may take the dir over.
+func (s *FileStore) Close() error {
+	return s.dd.Close()
+}
@@ -0,0 +1,116 @@
+package kvservice
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStores runs the same contract checks over both backends.
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"map": func(t *testing.T) Store { return NewMapStore() },
+		"file": func(t *testing.T) Store {
+			s, err := NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("NewFileStore: %v", err)
+			}
+			return s
+		},
+	}
+
+	for name, mk := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := mk(t)
+			s.Put("a", "1")
+			s.Put("b", "2")
+			if v, ok := s.Get("a"); !ok || v != "1" {
+				t.Fatalf("Get(a) = %q, %v", v, ok)
+			}
+			if _, ok := s.Get("missing"); ok {
+				t.Fatal("Get(missing) should report absence")
+			}
+			s.Delete("a")
+			if _, ok := s.Get("a"); ok {
+				t.Fatal("Get after Delete should report absence")
+			}
+			if s.Len() != 1 {
+				t.Fatalf("Len = %d, want 1", s.Len())
+			}
+			s.Replace(map[string]string{"x": "9"})
+			if snap := s.Snapshot(); len(snap) != 1 || snap["x"] != "9" {
+				t.Fatalf("after Replace, snapshot = %v", snap)
+			}
+		})
+	}
+}
+
+// TestFileStoreReopen checks the index is rebuilt from disk.
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	s.Put("k", "v")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s2, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if v, ok := s2.Get("k"); !ok || v != "v" {
+		t.Fatalf("after reopen, Get(k) = %q, %v", v, ok)
+	}
+}
+
+// TestDataDirLock checks that a data dir can only be held by one
+// opener at a time: the second open fails fast instead of letting two
+// stores scribble over each other.
+func TestDataDirLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	if _, err := NewFileStore(dir); err == nil {
+		t.Fatal("second open of a held data dir should fail")
+	} else if !strings.Contains(err.Error(), "locked by another process") {
+		t.Fatalf("second open failed with %v, want a locked-dir error", err)
+	}
+
+	// Releasing the lock hands the dir over.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s2, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("open after Close: %v", err)
+	}
+	s2.Close()
+}
+
+// TestDataDirLayout pins the standard file names so tooling can rely
+// on them.
+func TestDataDirLayout(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDataDir(dir)
+	if err != nil {
+		t.Fatalf("OpenDataDir: %v", err)
+	}
+	defer d.Close()
+
+	want := map[string]string{
+		d.WALPath():      "wal.log",
+		d.SnapshotPath(): "snapshot.gob",
+		d.MetaPath():     "meta.gob",
+	}
+	for path, name := range want {
+		if path != filepath.Join(dir, name) {
+			t.Fatalf("layout path %q, want %q under the dir", path, name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+)
+
+// ErrMessageTooLarge is the error a size-limited codec fails with
+// when a single RPC message exceeds its byte budget; the connection
+// is then unusable and gets closed.
+var ErrMessageTooLarge = errors.New("transport: rpc message exceeds size limit")
+
+// GobServerCodec serves gob RPC on conn while capping how many bytes
+// a single request message may occupy, so a malicious or buggy peer
+// cannot make the decoder swallow an arbitrarily large payload. The
+// budget resets per message; gob's read-ahead buffering makes the
+// accounting approximate by up to one internal buffer, which is
+// noise against any sensible limit. limit 0 means unlimited, which
+// behaves like rpc.ServeConn.
+func GobServerCodec(conn net.Conn, limit int64) rpc.ServerCodec {
+	lim := &limitedReader{r: conn, limit: limit, remain: limit}
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		conn:   conn,
+		lim:    lim,
+		dec:    gob.NewDecoder(lim),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+// limitedReader reads from r until the per-message budget runs out.
+type limitedReader struct {
+	r      io.Reader
+	limit  int64 // bytes allowed per message; 0 disables the check
+	remain int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limit > 0 {
+		if l.remain <= 0 {
+			return 0, ErrMessageTooLarge
+		}
+		if int64(len(p)) > l.remain {
+			p = p[:l.remain]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.remain -= int64(n)
+	return n, err
+}
+
+// gobServerCodec mirrors net/rpc's unexported gob codec, with the
+// message budget reset before each header and body decode.
+type gobServerCodec struct {
+	conn   net.Conn
+	lim    *limitedReader
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.lim.remain = c.lim.limit
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	c.lim.remain = c.lim.limit
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		c.Close()
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		c.Close()
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
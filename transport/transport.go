@@ -0,0 +1,67 @@
+// Package transport abstracts how servers listen and clients dial,
+// so tests can wire a whole cluster together over in-memory pipes
+// instead of real TCP listeners. Production code uses Real(); tests
+// use transporttest.Network.
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// Transport makes listeners and connections. Addresses are opaque
+// strings: TCP host:port in production, arbitrary names in tests.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// Real returns a Transport backed by TCP.
+func Real() Transport {
+	return netTransport{network: "tcp"}
+}
+
+// Network returns a Transport backed by the named net package
+// network: "tcp" (the default everywhere) or "unix", where addresses
+// are socket paths. Unix sockets skip the loopback stack for
+// co-located processes; every peer of a deployment must use the same
+// network, since the addresses servers advertise only make sense on
+// it.
+func Network(network string) Transport {
+	return netTransport{network: network}
+}
+
+// IdleTimeout wraps a server-side connection so every read must
+// deliver data within d of starting; a connection whose peer has
+// gone away times out instead of parking its serving goroutine
+// forever. d <= 0 returns conn unchanged.
+func IdleTimeout(conn net.Conn, d time.Duration) net.Conn {
+	if d <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, timeout: d}
+}
+
+// idleConn pushes the read deadline forward on each read, turning
+// the absolute deadline the net package offers into an idle one.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+type netTransport struct {
+	network string
+}
+
+func (t netTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(t.network, addr)
+}
+
+func (t netTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(t.network, addr, timeout)
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	wrapped := IdleTimeout(server, 20*time.Millisecond)
+	buf := make([]byte, 1)
+
+	// A quiet peer times the read out.
+	if _, err := wrapped.Read(buf); err == nil {
+		t.Fatal("read from an idle peer succeeded")
+	}
+
+	// The deadline is idle, not absolute: traffic keeps the
+	// connection alive past the first timeout window.
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			client.Write([]byte{'x'})
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := wrapped.Read(buf); err != nil {
+			t.Fatalf("read %d with active peer: %v", i, err)
+		}
+	}
+
+	// Disabled wrapping returns the connection unchanged.
+	if got := IdleTimeout(server, 0); got != server {
+		t.Fatal("IdleTimeout(0) wrapped the connection")
+	}
+}
+
+func TestUnixNetwork(t *testing.T) {
+	sock := t.TempDir() + "/rpc.sock"
+	ln, err := Network("unix").Listen(sock)
+	if err != nil {
+		t.Fatal("listen on unix socket:", err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil {
+			done <- err
+			return
+		}
+		_, err = conn.Write(buf)
+		done <- err
+	}()
+
+	conn, err := Network("unix").Dial(sock, time.Second)
+	if err != nil {
+		t.Fatal("dial unix socket:", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal("write:", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal("read echo:", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("echoed %q, want %q", buf, "hello")
+	}
+	if err := <-done; err != nil {
+		t.Fatal("server side:", err)
+	}
+}
+
+// LimitEcho is a trivial RPC service for exercising the size-limited
+// codec.
+type LimitEcho struct{}
+
+func (LimitEcho) Echo(args *string, reply *string) error {
+	*reply = *args
+	return nil
+}
+
+// TestGobServerCodecLimit checks that requests under the budget are
+// served and an oversized one kills the connection.
+func TestGobServerCodecLimit(t *testing.T) {
+	srv := rpc.NewServer()
+	if err := srv.Register(LimitEcho{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	cliConn, srvConn := net.Pipe()
+	go srv.ServeCodec(GobServerCodec(srvConn, 1024))
+	client := rpc.NewClient(cliConn)
+	defer client.Close()
+
+	small := "hello"
+	var reply string
+	if err := client.Call("LimitEcho.Echo", &small, &reply); err != nil || reply != small {
+		t.Fatalf("small call = %q, %v", reply, err)
+	}
+
+	big := strings.Repeat("x", 10_000)
+	if err := client.Call("LimitEcho.Echo", &big, &reply); err == nil {
+		t.Fatal("oversized call succeeded, want a closed connection")
+	}
+	// The connection is dead; even a small call fails now.
+	if err := client.Call("LimitEcho.Echo", &small, &reply); err == nil {
+		t.Fatal("call after oversized message succeeded, want failure")
+	}
+}
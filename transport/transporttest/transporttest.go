@@ -0,0 +1,129 @@
+// Package transporttest provides an in-memory transport.Transport
+// for tests: servers listen under arbitrary names, dials connect
+// through net.Pipe, and delays and connection drops are controllable
+// so replication tests run fast and deterministically.
+package transporttest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Network is an in-memory registry of listeners. The zero value is
+// not usable; call New.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*listener
+	delay     time.Duration
+	dropDials bool
+}
+
+func New() *Network {
+	return &Network{listeners: map[string]*listener{}}
+}
+
+// SetDelay makes every subsequent Dial pause before connecting,
+// simulating a slow link.
+func (n *Network) SetDelay(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delay = d
+}
+
+// SetDropDials makes every subsequent Dial fail, simulating a
+// partition. Existing connections are not affected; close them
+// separately if the test needs a full cut.
+func (n *Network) SetDropDials(drop bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropDials = drop
+}
+
+// Listen registers a listener under addr. Listening twice on the
+// same name fails, like binding a busy TCP port.
+func (n *Network) Listen(addr string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, errors.New("transporttest: address already in use: " + addr)
+	}
+	l := &listener{net: n, addr: addr, accept: make(chan net.Conn), closed: make(chan struct{})}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to the listener registered under addr. It honors the
+// network's configured delay and drop setting, and fails when no
+// listener is registered or the listener doesn't accept in time.
+func (n *Network) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	n.mu.Lock()
+	delay, drop := n.delay, n.dropDials
+	l := n.listeners[addr]
+	n.mu.Unlock()
+
+	if drop {
+		return nil, errors.New("transporttest: dial dropped: " + addr)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if l == nil {
+		return nil, errors.New("transporttest: connection refused: " + addr)
+	}
+
+	client, server := net.Pipe()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		return nil, errors.New("transporttest: connection refused: " + addr)
+	case <-t.C:
+		client.Close()
+		return nil, errors.New("transporttest: dial timed out: " + addr)
+	}
+}
+
+// listener implements net.Listener over the network's registry.
+type listener struct {
+	net    *Network
+	addr   string
+	accept chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("transporttest: listener closed")
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.net.mu.Lock()
+		if l.net.listeners[l.addr] == l {
+			delete(l.net.listeners, l.addr)
+		}
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.addr)
+}
+
+// addr is a trivial net.Addr naming an in-memory endpoint.
+type addr string
+
+func (a addr) Network() string { return "mem" }
+func (a addr) String() string  { return string(a) }
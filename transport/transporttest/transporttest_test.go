@@ -0,0 +1,84 @@
+package transporttest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	n := New()
+	l, err := n.Listen("srv")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 5)
+		if _, err := c.Read(buf); err == nil {
+			c.Write(buf)
+		}
+	}()
+
+	c, err := n.Dial("srv", time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("echoed %q, want %q", buf, "hello")
+	}
+}
+
+func TestDuplicateListen(t *testing.T) {
+	n := New()
+	l, err := n.Listen("srv")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if _, err := n.Listen("srv"); err == nil {
+		t.Fatal("second Listen on the same name succeeded")
+	}
+	// Closing frees the name for reuse.
+	l.Close()
+	if _, err := n.Listen("srv"); err != nil {
+		t.Fatalf("Listen after Close: %v", err)
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	n := New()
+	if _, err := n.Dial("nobody", time.Second); err == nil {
+		t.Fatal("Dial with no listener succeeded")
+	}
+
+	l, err := n.Listen("srv")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	n.SetDropDials(true)
+	if _, err := n.Dial("srv", time.Second); err == nil || !strings.Contains(err.Error(), "dropped") {
+		t.Fatalf("Dial while dropping: err = %v, want dropped", err)
+	}
+	n.SetDropDials(false)
+
+	// Nobody accepting: the dial should give up after the timeout.
+	if _, err := n.Dial("srv", 10*time.Millisecond); err == nil {
+		t.Fatal("Dial with no accepter succeeded")
+	}
+}
@@ -0,0 +1,204 @@
+package viewservice
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"dsdemo/transport"
+)
+
+// callTimeout bounds each RPC to the view service, so a hung (but not
+// dead) view server can't stall a ping loop indefinitely. A timed out
+// call reads as a failed one.
+const callTimeout = DeadInterval
+
+// Clerk is how KV servers and test code talk to the view service.
+type Clerk struct {
+	me     string // this server's name, "" for pure observers
+	server string // view service address
+	tr     transport.Transport
+}
+
+func MakeClerk(me string, server string) *Clerk {
+	return MakeClerkWithTransport(me, server, transport.Real())
+}
+
+// MakeClerkWithTransport is MakeClerk with an explicit transport, so
+// tests can reach an in-memory view service.
+func MakeClerkWithTransport(me string, server string, tr transport.Transport) *Clerk {
+	return &Clerk{me: me, server: server, tr: tr}
+}
+
+// call dials srv, issues a single RPC and hangs up. Both the dial and
+// the call are bounded by callTimeout. It returns false if anything
+// went wrong.
+func call(tr transport.Transport, srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return callBounded(tr, srv, rpcname, args, reply, callTimeout)
+}
+
+// callBounded is call with an explicit bound on the RPC itself, for
+// long-polls that legitimately outlast callTimeout. The dial stays
+// bounded by callTimeout.
+func callBounded(tr transport.Transport, srv string, rpcname string, args interface{}, reply interface{}, d time.Duration) bool {
+	conn, err := tr.Dial(srv, callTimeout)
+	if err != nil {
+		return false
+	}
+	c := rpc.NewClient(conn)
+	defer c.Close()
+	done := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case d := <-done.Done:
+		return d.Error == nil
+	case <-t.C:
+		return false
+	}
+}
+
+// Ping announces liveness to the view service and returns the
+// current view. viewnum is the most recent view number the caller
+// has seen (0 on startup).
+func (ck *Clerk) Ping(viewnum uint) (View, error) {
+	reply, err := ck.PingReport(viewnum, false, 0, false, false)
+	return reply.View, err
+}
+
+// PingReport is Ping plus the sender's status report: whether its
+// backup is unreachable or still receiving a state transfer, the
+// sender's promotion priority, and whether it refuses the primary
+// role. The view service uses the report to replace a partitioned
+// backup and to refuse promoting an unsynced one. The full reply is
+// returned so the sender also sees per-server directives like
+// StateAuthoritative.
+func (ck *Clerk) PingReport(viewnum uint, backupUnreachable bool, priority int, backupSyncing, backupOnly bool) (PingReply, error) {
+	args := &PingArgs{
+		Me:                ck.me,
+		ViewNum:           viewnum,
+		BackupUnreachable: backupUnreachable,
+		Priority:          priority,
+		BackupSyncing:     backupSyncing,
+		BackupOnly:        backupOnly,
+	}
+	var reply PingReply
+	if !call(ck.tr, ck.server, "ViewServer.Ping", args, &reply) {
+		return PingReply{}, errors.New("viewservice: Ping failed")
+	}
+	return reply, nil
+}
+
+// Leave announces that this server is going away for good, so the
+// view service can fail over immediately instead of waiting out the
+// ping deadline. Best effort: a view service that cannot be reached
+// will notice the silence the slow way.
+func (ck *Clerk) Leave() {
+	var reply LeaveReply
+	call(ck.tr, ck.server, "ViewServer.Leave", &LeaveArgs{Me: ck.me}, &reply)
+}
+
+// Get fetches the current view without counting as a liveness signal.
+func (ck *Clerk) Get() (View, bool) {
+	var reply GetReply
+	if !call(ck.tr, ck.server, "ViewServer.Get", &GetArgs{}, &reply) {
+		return View{}, false
+	}
+	return reply.View, true
+}
+
+// GetShards fetches every shard's view, indexed by shard number. An
+// unsharded view service reports a single entry.
+func (ck *Clerk) GetShards() ([]View, error) {
+	var reply GetReply
+	if !call(ck.tr, ck.server, "ViewServer.Get", &GetArgs{}, &reply) {
+		return nil, errors.New("viewservice: Get failed")
+	}
+	return reply.Shards, nil
+}
+
+// GetIdleServers fetches the live servers holding no role, in the
+// order idle recruitment would pick them, so operators can check
+// standby capacity before taking a server down.
+func (ck *Clerk) GetIdleServers() ([]string, error) {
+	var reply GetReply
+	if !call(ck.tr, ck.server, "ViewServer.Get", &GetArgs{IncludeIdle: true}, &reply) {
+		return nil, errors.New("viewservice: Get failed")
+	}
+	return reply.Idle, nil
+}
+
+// AdminReassign sends an operator reassignment (demote/evict) to the
+// view service.
+func (ck *Clerk) AdminReassign(args *AdminReassignArgs) (AdminReassignReply, error) {
+	var reply AdminReassignReply
+	if !call(ck.tr, ck.server, "ViewServer.AdminReassign", args, &reply) {
+		return reply, errors.New("viewservice: AdminReassign failed")
+	}
+	return reply, nil
+}
+
+// GetViewHistory fetches the most recent view changes, oldest first.
+func (ck *Clerk) GetViewHistory() ([]ViewHistoryEntry, error) {
+	var reply GetViewHistoryReply
+	if !call(ck.tr, ck.server, "ViewServer.GetViewHistory", &GetViewHistoryArgs{}, &reply) {
+		return nil, errors.New("viewservice: GetViewHistory failed")
+	}
+	return reply.Entries, nil
+}
+
+// WatchView delivers each view change after since on the returned
+// channel, long-polling the view service's WatchView RPC instead of
+// hammering Get. A poll that fails (view service down or restarting)
+// is retried after a ping interval, so the watch survives transient
+// outages. Call stop to end the watch; the channel is then closed.
+func (ck *Clerk) WatchView(since uint) (<-chan View, func()) {
+	views := make(chan View)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+
+	go func() {
+		defer close(views)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			args := &WatchViewArgs{SinceViewNum: since}
+			var reply WatchViewReply
+			// Allow the server its full poll window plus call slack.
+			if !callBounded(ck.tr, ck.server, "ViewServer.WatchView", args, &reply, watchPollTimeout+callTimeout) {
+				t := time.NewTimer(PingInterval)
+				select {
+				case <-done:
+					t.Stop()
+					return
+				case <-t.C:
+				}
+				continue
+			}
+			if reply.Timeout {
+				continue
+			}
+			since = reply.View.ViewNum
+			select {
+			case views <- reply.View:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return views, stop
+}
+
+// Primary returns the current primary's address, or "" if unknown.
+func (ck *Clerk) Primary() string {
+	v, ok := ck.Get()
+	if !ok {
+		return ""
+	}
+	return v.Primary
+}
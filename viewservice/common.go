@@ -0,0 +1,204 @@
+package viewservice
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// A View describes the current primary/backup configuration of the
+// key/value service. ViewNum increases by one each time the
+// configuration changes. Backup may be empty.
+type View struct {
+	ViewNum uint
+	Primary string
+	Backup  string
+}
+
+// Servers Ping the view service every PingInterval. The view service
+// declares a server dead if it has not heard a Ping from it for
+// DeadPings intervals in a row.
+const PingInterval = 500 * time.Millisecond
+const DeadPings = 3
+
+// DeadInterval is how long a server may go silent before it is
+// declared dead.
+const DeadInterval = DeadPings * PingInterval
+
+// Ping is sent by KV servers to announce liveness. ViewNum is the
+// most recent view number the sender has seen; a primary pinging
+// with the current view number acknowledges that view. ViewNum == 0
+// means the sender has (re)started.
+type PingArgs struct {
+	Me      string
+	ViewNum uint
+	// BackupUnreachable is set by a primary whose forwards to the
+	// backup keep failing even though both servers can reach the view
+	// service (a partial partition). The sense is inverted from
+	// "reachable" so binaries from before the field existed report
+	// nothing rather than a permanent complaint.
+	BackupUnreachable bool
+	// BackupSyncing is set by a primary whose backup has not yet
+	// received a complete state transfer. The view service refuses to
+	// promote a backup reported as syncing: it holds a partial copy,
+	// so promoting it would present missing keys as the truth. The
+	// sense is chosen so binaries from before the field existed (it
+	// reads false) keep today's promote-freely behavior.
+	BackupSyncing bool
+	// Priority is the sender's promotion preference: idle recruitment
+	// picks higher-priority servers first, and a backup that outranks
+	// its primary is swapped into the primary role once it has
+	// settled in. Zero (the default) means no preference.
+	Priority int
+	// BackupOnly marks a server that must never hold the primary
+	// role: the view service skips it when filling or re-filling a
+	// primary slot, but still recruits it as a backup. The sense is
+	// chosen so binaries from before the field existed (it reads
+	// false) remain eligible for every role.
+	BackupOnly bool
+}
+
+type PingReply struct {
+	View View
+	// StateAuthoritative tells a primary that was promoted through
+	// the data-loss path that its current contents — typically
+	// nothing — are the shard's dataset by decree: the old data is
+	// gone and the loss was accepted, so the server must mark its
+	// state complete and serve instead of waiting for a transfer
+	// that can never come.
+	StateAuthoritative bool
+}
+
+// Get is sent by clients to learn the current view. It does not
+// count as a liveness signal.
+type GetArgs struct {
+	// IncludeIdle asks for the idle roster in the reply, so callers
+	// can see how much standby capacity the cluster has.
+	IncludeIdle bool
+}
+
+type GetReply struct {
+	// View is shard 0's view, which is the whole story for an
+	// unsharded deployment.
+	View View
+	// PrimaryAcked reports whether shard 0's primary has acked View.
+	// During an unacked transition the listed primary may be about to
+	// be replaced; cautious clients wait for an acked view before
+	// routing writes.
+	PrimaryAcked bool
+	// Shards holds every shard's view, indexed by shard number, so
+	// sharded clients can route each key to the right primary.
+	Shards []View
+	// Idle lists the live servers holding no role, in the order they
+	// first registered — the order idle recruitment would pick them.
+	// Only filled when the request set IncludeIdle.
+	Idle []string
+}
+
+// ShardFor maps a key to the shard that owns it. The mapping is a
+// stable hash: for a fixed shard count every client and server agrees
+// on the owner of every key. Changing the shard count remaps keys,
+// so it must only be done on an empty cluster.
+func ShardFor(key string, shards int) int {
+	if shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Leave is a graceful decommission: the named server is marked
+// not-alive immediately, so a planned shutdown fails over right away
+// instead of waiting out DeadInterval of missed pings. KV servers
+// send it when they are killed or shut down. The resulting promotion
+// goes through the ordinary repair pass, so it still waits for an
+// unacked view to be acknowledged first.
+type LeaveArgs struct {
+	Me string
+}
+
+type LeaveReply struct {
+}
+
+// WatchView is a long-poll for view changes: it blocks until shard
+// 0's view number exceeds SinceViewNum, then returns the new view.
+// SinceViewNum 0 returns the first view ever installed (or the
+// current one, if views exist already).
+type WatchViewArgs struct {
+	SinceViewNum uint
+}
+
+type WatchViewReply struct {
+	View View
+	// Timeout is true when the poll window elapsed with no newer
+	// view; View then holds the unchanged current view and the
+	// caller just polls again.
+	Timeout bool
+}
+
+// ServerStatus describes one server known to the view service, for
+// operators inspecting spare capacity.
+type ServerStatus struct {
+	Name    string
+	Role    string // "primary", "backup" or "idle"
+	Shard   int    // which shard the server serves; 0 when idle
+	Alive   bool
+	PingAge time.Duration // time since the server's last ping
+}
+
+// GetServers lists every server the view service has heard from.
+type GetServersArgs struct {
+}
+
+type GetServersReply struct {
+	Servers []ServerStatus
+}
+
+// ViewHistoryEntry records one view change for after-the-fact
+// debugging of failovers: the installed view, when it was installed
+// and why.
+type ViewHistoryEntry struct {
+	Shard  int
+	View   View
+	Time   time.Time
+	Reason string
+}
+
+// GetViewHistory returns the most recent view changes, oldest first.
+type GetViewHistoryArgs struct {
+}
+
+type GetViewHistoryReply struct {
+	Entries []ViewHistoryEntry
+}
+
+// AdminReassign lets an operator change role assignments for
+// maintenance: "demote" hands the primary role to the backup,
+// "evict" removes a named server from the view, and "ack-dataloss"
+// accepts losing a shard's data so an empty server may replace a
+// primary that died with no backup. Guarded by the server's admin
+// secret, if one is configured.
+type AdminReassignArgs struct {
+	Secret string
+	Action string // "demote", "evict" or "ack-dataloss"
+	Server string // the server to evict; unused otherwise
+	Shard  int    // which shard to demote or ack; ignored for "evict"
+}
+
+type AdminReassignReply struct {
+	// Queued is true if the change had to wait for the current
+	// primary to ack its view; it will apply on a later tick.
+	Queued bool
+	View   View
+}
+
+// Health is a read-only liveness probe for monitoring tools. It does
+// not touch ping bookkeeping or RPC counters.
+type HealthArgs struct {
+}
+
+type HealthReply struct {
+	Role    string
+	Alive   bool
+	ViewNum uint
+}
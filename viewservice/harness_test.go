@@ -0,0 +1,108 @@
+package viewservice
+
+import (
+	"testing"
+	"time"
+
+	"dsdemo/clock/clocktest"
+)
+
+// harness runs a ViewServer on an ephemeral port with a controllable
+// clock, so failure-detection tests are deterministic instead of
+// depending on real 1.5s timeouts. Tests inject pings by name and
+// simulate a dropped server simply by not pinging it anymore.
+type harness struct {
+	t   *testing.T
+	vs  *ViewServer
+	clk *clocktest.FakeClock
+}
+
+func newHarness(t *testing.T) *harness {
+	h := &harness{t: t, clk: clocktest.New(time.Unix(1000, 0))}
+	h.vs = StartServerWithClock("127.0.0.1:0", h.clk)
+	t.Cleanup(h.vs.Kill)
+	return h
+}
+
+// addr returns the address the server actually bound.
+func (h *harness) addr() string {
+	return h.vs.l.Addr().String()
+}
+
+// ping injects a Ping from server carrying viewnum and returns the
+// view the server would reply with.
+func (h *harness) ping(server string, viewnum uint) View {
+	args := &PingArgs{Me: server, ViewNum: viewnum}
+	var reply PingReply
+	if err := h.vs.Ping(args, &reply); err != nil {
+		h.t.Fatalf("Ping(%s, %d): %v", server, viewnum, err)
+	}
+	return reply.View
+}
+
+// pingReporting is ping with the sender's backup-unreachability flag
+// set, as a partitioned primary would send it.
+func (h *harness) pingReporting(server string, viewnum uint, backupUnreachable bool) View {
+	args := &PingArgs{Me: server, ViewNum: viewnum, BackupUnreachable: backupUnreachable}
+	var reply PingReply
+	if err := h.vs.Ping(args, &reply); err != nil {
+		h.t.Fatalf("Ping(%s, %d, unreachable=%v): %v", server, viewnum, backupUnreachable, err)
+	}
+	return reply.View
+}
+
+// pingBackupOnly is ping with the sender declaring itself ineligible
+// for the primary role.
+func (h *harness) pingBackupOnly(server string, viewnum uint) View {
+	args := &PingArgs{Me: server, ViewNum: viewnum, BackupOnly: true}
+	var reply PingReply
+	if err := h.vs.Ping(args, &reply); err != nil {
+		h.t.Fatalf("Ping(%s, %d, backup-only): %v", server, viewnum, err)
+	}
+	return reply.View
+}
+
+// pingPriority is ping with the sender's promotion preference set.
+func (h *harness) pingPriority(server string, viewnum uint, priority int) View {
+	args := &PingArgs{Me: server, ViewNum: viewnum, Priority: priority}
+	var reply PingReply
+	if err := h.vs.Ping(args, &reply); err != nil {
+		h.t.Fatalf("Ping(%s, %d, priority=%d): %v", server, viewnum, priority, err)
+	}
+	return reply.View
+}
+
+// leave injects a graceful-decommission Leave from server.
+func (h *harness) leave(server string) {
+	var reply LeaveReply
+	if err := h.vs.Leave(&LeaveArgs{Me: server}, &reply); err != nil {
+		h.t.Fatalf("Leave(%s): %v", server, err)
+	}
+}
+
+// view returns the current view via the Get RPC.
+func (h *harness) view() View {
+	var reply GetReply
+	if err := h.vs.Get(&GetArgs{}, &reply); err != nil {
+		h.t.Fatalf("Get: %v", err)
+	}
+	return reply.View
+}
+
+// advance moves the fake clock forward and runs one failure check
+// directly; the background ticker may run extra (idempotent) checks.
+func (h *harness) advance(d time.Duration) {
+	h.clk.Advance(d)
+	h.vs.checkFailuresAndPromote()
+}
+
+// pingUntilDead advances past the failure-detection deadline while
+// keeping the listed servers alive with fresh pings.
+func (h *harness) pingUntilDead(alive map[string]uint) {
+	for i := 0; i < DeadPings+1; i++ {
+		for s, vn := range alive {
+			h.ping(s, vn)
+		}
+		h.advance(PingInterval)
+	}
+}
@@ -0,0 +1,1015 @@
+package viewservice
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dsdemo/clock"
+	"dsdemo/transport"
+)
+
+// ViewServer is the central view service. It tracks which KV servers
+// are alive via their Pings and decides who is primary and who is
+// backup. It stores no key/value data. A sharded deployment runs
+// several primary/backup pairs, one per shard; each pair is managed
+// independently with the same per-pair rules, and servers are handed
+// out to whichever shard needs one.
+type ViewServer struct {
+	mu   sync.Mutex
+	l    net.Listener
+	dead atomic.Bool
+	me   string
+	// counts tallies handled RPCs per method; see GetRPCCounts.
+	counts RPCCounts
+
+	// pairs holds one primary/backup pair per shard. An unsharded
+	// deployment has exactly one.
+	pairs   []*pairState
+	servers map[string]*serverInfo
+
+	// clk is the server's notion of time; tests substitute a fake
+	// clock to make failure detection deterministic.
+	clk clock.Clock
+
+	// adminSecret guards admin RPCs; "" leaves them open (dev mode).
+	adminSecret string
+
+	// selectLess, when set, replaces the default idle-server
+	// preference order; see SetSelectionCompare.
+	selectLess func(a, b string) bool
+
+	// watchCh is closed and replaced on every view change to wake
+	// blocked WatchView long-polls.
+	watchCh chan struct{}
+
+	// idleTimeout (nanoseconds) reaps accepted connections whose
+	// peer goes quiet for that long; 0 keeps connections forever.
+	idleTimeout atomic.Int64
+
+	// maxConns caps how many accepted connections may be served at
+	// once; excess ones are closed straight after the accept, so a
+	// connection storm can't exhaust descriptors or goroutines. 0
+	// (the default) means unlimited. connCount is the current tally.
+	maxConns  atomic.Int64
+	connCount atomic.Int64
+
+	// maxMsgBytes caps the size of one incoming RPC message; see
+	// SetMaxMessageBytes. 0 means unlimited.
+	maxMsgBytes atomic.Int64
+
+	// requireLossAck makes a shard whose primary died with no backup
+	// wait for an operator's "ack-dataloss" before an empty server is
+	// promoted in its place, instead of only logging the data loss.
+	requireLossAck bool
+
+	// cooldown remembers when servers were removed for being dead;
+	// if they re-register they sit out one DeadInterval of healthy
+	// pings before becoming eligible for a role again.
+	cooldown map[string]time.Time
+
+	// history retains the most recent view changes with timestamps
+	// and reasons, for debugging failovers after the fact.
+	history []ViewHistoryEntry
+
+	// faults, when non-nil, lets tests perturb the server
+	// deterministically; see FaultInjector.
+	faults *FaultInjector
+}
+
+// FaultInjector is a set of test-only hooks for reproducing failure
+// scenarios on demand: dropping chosen pings as if the network lost
+// them, freezing failure detection, or declaring a server dead ahead
+// of its ping deadline. Every hook may be nil; each is called with
+// the server's mutex held, so hooks must not call back into the
+// server. Production deployments never set one.
+type FaultInjector struct {
+	// DropPing discards the ping when it returns true; the sender
+	// sees it as a lost RPC.
+	DropPing func(args *PingArgs) bool
+	// SkipTick suppresses a failure-detection pass when it returns
+	// true, as if the ticker goroutine had stalled.
+	SkipTick func() bool
+	// ForceDead makes the named server read as dead regardless of its
+	// ping history.
+	ForceDead func(server string) bool
+}
+
+// SetFaultInjector installs test-only fault hooks; nil removes them.
+func (vs *ViewServer) SetFaultInjector(fi *FaultInjector) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.faults = fi
+}
+
+// pairState is the per-shard view machinery: one primary/backup pair
+// plus the bookkeeping that drives its view changes. The failure
+// detection rules operate on a single pair; sharding just runs them
+// once per shard.
+type pairState struct {
+	view         View
+	primaryAcked bool
+	// pendingReassign holds an operator request waiting for this
+	// pair's primary to ack its view.
+	pendingReassign *AdminReassignArgs
+	// backupUnreach counts consecutive primary pings reporting the
+	// backup unreachable. The backup may look perfectly alive from
+	// here (a partial partition), but a backup the primary cannot
+	// forward to is useless, so it is dropped once the complaints
+	// persist for DeadPings pings.
+	backupUnreach int
+	// lossAcked records an operator's acknowledgment that promoting
+	// an empty server after the primary died with no backup — i.e.
+	// losing the shard's data — is acceptable. Only consulted when
+	// the view service is configured to require the acknowledgment;
+	// cleared once the promotion happens.
+	lossAcked bool
+	// lossPrimary names a primary installed through the data-loss
+	// path: its contents, however empty, are authoritative by that
+	// decision, and its ping replies say so until the role moves on.
+	lossPrimary string
+	// backupSince records when the current backup took its slot, so
+	// a priority swap waits until the backup has had time to receive
+	// the primary's state.
+	backupSince time.Time
+	// backupSyncing mirrors the primary's last report of whether its
+	// backup is still mid state transfer; a syncing backup holds a
+	// partial copy and must not be promoted.
+	backupSyncing bool
+}
+
+// serverInfo is what the view service remembers about one server.
+type serverInfo struct {
+	lastPing  time.Time
+	firstPing time.Time // registration time, for deterministic selection
+	// priority is the server's self-reported promotion preference,
+	// refreshed on every ping.
+	priority int
+	// eligibleAfter delays role assignment for servers that were
+	// previously declared dead, so a flapping server doesn't bounce
+	// straight back into the view.
+	eligibleAfter time.Time
+	// backupOnly excludes the server from primary selection,
+	// refreshed on every ping.
+	backupOnly bool
+}
+
+// viewHistorySize bounds the view-change history; older entries are
+// discarded.
+const viewHistorySize = 32
+
+// SetNumShards splits the key space over n primary/backup pairs. It
+// must be called before any server registers; once servers hold
+// roles the shard count is fixed, since changing it would remap keys
+// under live data.
+func (vs *ViewServer) SetNumShards(n int) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if n < 1 {
+		return errors.New("viewservice: shard count must be at least 1")
+	}
+	if len(vs.servers) > 0 {
+		return errors.New("viewservice: cannot reshard with registered servers")
+	}
+	vs.pairs = make([]*pairState, n)
+	for i := range vs.pairs {
+		vs.pairs[i] = &pairState{}
+	}
+	return nil
+}
+
+// shardOf returns the shard whose pair the named server belongs to,
+// or -1 if the server holds no role. Caller must hold vs.mu.
+func (vs *ViewServer) shardOf(server string) int {
+	for i, p := range vs.pairs {
+		if server == p.view.Primary || server == p.view.Backup {
+			return i
+		}
+	}
+	return -1
+}
+
+// updatePrimary installs a new view for one shard and bumps its view
+// number, recording why in the history. The new view does not become
+// changeable again until the new primary acknowledges it via Ping.
+func (vs *ViewServer) updatePrimary(shard int, primary string, backup string, reason string) {
+	p := vs.pairs[shard]
+	if backup != p.view.Backup {
+		p.backupSince = vs.clk.Now()
+	}
+	p.view = View{ViewNum: p.view.ViewNum + 1, Primary: primary, Backup: backup}
+	if primary != p.lossPrimary {
+		p.lossPrimary = ""
+	}
+	p.primaryAcked = false
+	p.backupUnreach = 0
+	p.backupSyncing = false
+	vs.history = append(vs.history, ViewHistoryEntry{
+		Shard:  shard,
+		View:   p.view,
+		Time:   vs.clk.Now(),
+		Reason: reason,
+	})
+	if len(vs.history) > viewHistorySize {
+		vs.history = vs.history[len(vs.history)-viewHistorySize:]
+	}
+	close(vs.watchCh)
+	vs.watchCh = make(chan struct{})
+}
+
+// Ping records a liveness report from a KV server and returns the
+// view of the shard the server serves (shard 0's view while it is
+// idle).
+func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.faults != nil && vs.faults.DropPing != nil && vs.faults.DropPing(args) {
+		return errors.New("viewservice: ping dropped by fault injector")
+	}
+	vs.counts.Ping++
+
+	if shard := vs.shardOf(args.Me); shard >= 0 {
+		p := vs.pairs[shard]
+		switch args.Me {
+		case p.view.Primary:
+			if args.ViewNum == p.view.ViewNum {
+				p.primaryAcked = true
+			} else if args.ViewNum == 0 && p.view.ViewNum > 0 && p.primaryAcked {
+				// The primary crashed and restarted; it has lost its
+				// state, so hand the view to the backup. With no backup
+				// the slot just empties, and the data-loss path refills
+				// it — often with the restarted server itself, marked
+				// state-authoritative.
+				reason := "primary " + args.Me + " restarted; promoting the backup"
+				if p.view.Backup == "" {
+					reason = "primary " + args.Me + " restarted with no backup; emptying the slot for the data-loss path"
+				}
+				vs.updatePrimary(shard, p.view.Backup, "", reason)
+			}
+			if p.view.Backup != "" {
+				if args.BackupUnreachable {
+					p.backupUnreach++
+				} else {
+					p.backupUnreach = 0
+				}
+				p.backupSyncing = args.BackupSyncing
+			}
+		case p.view.Backup:
+			if args.ViewNum == 0 && p.view.ViewNum > 0 && p.primaryAcked {
+				// The backup crashed and restarted empty; drop it so it
+				// rejoins as idle and gets a fresh state transfer.
+				vs.updatePrimary(shard, p.view.Primary, "", "backup "+args.Me+" restarted; dropping it")
+			}
+		}
+	} else if !args.BackupOnly {
+		// Bootstrap: a shard that has never had a view takes the first
+		// unassigned server as its primary. Empty primary slots are
+		// filled before any backup slot, so every shard can take
+		// writes as early as possible.
+		for i, p := range vs.pairs {
+			if p.view.Primary == "" && p.view.ViewNum == 0 {
+				vs.updatePrimary(i, args.Me, "", "first server "+args.Me+" becomes primary of shard "+strconv.Itoa(i))
+				break
+			}
+		}
+	} else if _, known := vs.servers[args.Me]; !known {
+		// A backup-only server cannot fill an empty primary slot; if
+		// it registers while one exists, the shard stays primary-less
+		// until a regular server arrives. Warn once, at registration.
+		for i, p := range vs.pairs {
+			if p.view.Primary == "" && p.view.ViewNum == 0 {
+				log.Printf("viewservice: backup-only server %s cannot take the empty primary slot of shard %d; the shard has no primary until a regular server registers", args.Me, i)
+				break
+			}
+		}
+	}
+
+	now := vs.clk.Now()
+	if info, ok := vs.servers[args.Me]; ok {
+		info.lastPing = now
+		info.priority = args.Priority
+		info.backupOnly = args.BackupOnly
+	} else {
+		info := &serverInfo{lastPing: now, firstPing: now, priority: args.Priority, backupOnly: args.BackupOnly}
+		if _, wasDead := vs.cooldown[args.Me]; wasDead {
+			info.eligibleAfter = now.Add(DeadInterval)
+			delete(vs.cooldown, args.Me)
+		}
+		vs.servers[args.Me] = info
+	}
+
+	// Don't leave an acked primary without redundancy until the next
+	// ticker pass: recruit an idle server into an empty backup slot
+	// right here, whether it was this ping that acked the view or
+	// this ping that brought the idle server in. A dead primary gets
+	// no backup: it could never stream state to it, and pairing the
+	// newcomer with a corpse would later promote an empty server as
+	// if it held the data.
+	for i, p := range vs.pairs {
+		if p.primaryAcked && p.view.Primary != "" && p.view.Backup == "" && !vs.isDead(p.view.Primary, now) {
+			if idle := vs.idleServer(now, false); idle != "" {
+				vs.updatePrimary(i, p.view.Primary, idle, "recruiting idle server "+idle+" as backup")
+			}
+		}
+	}
+
+	if shard := vs.shardOf(args.Me); shard >= 0 {
+		p := vs.pairs[shard]
+		reply.View = p.view
+		reply.StateAuthoritative = args.Me == p.view.Primary && args.Me == p.lossPrimary
+	} else {
+		reply.View = vs.pairs[0].view
+	}
+	return nil
+}
+
+// Get returns the current views without counting as a liveness
+// signal: shard 0's view in the classic field, plus every shard's
+// view for clients that route by key.
+func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.counts.Get++
+	reply.View = vs.pairs[0].view
+	reply.PrimaryAcked = vs.pairs[0].primaryAcked
+	reply.Shards = make([]View, len(vs.pairs))
+	for i, p := range vs.pairs {
+		reply.Shards[i] = p.view
+	}
+	if args.IncludeIdle {
+		reply.Idle = vs.idleRoster(vs.clk.Now())
+	}
+	return nil
+}
+
+// idleRoster returns every live server that holds no role, ordered by
+// first registration (name as tie-break) — the same order idle
+// recruitment walks them. Caller must hold vs.mu.
+func (vs *ViewServer) idleRoster(now time.Time) []string {
+	var idle []string
+	for s, info := range vs.servers {
+		if vs.shardOf(s) >= 0 {
+			continue
+		}
+		if elapsedSince(now, info.lastPing) > DeadInterval {
+			continue
+		}
+		idle = append(idle, s)
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		fi, fj := vs.servers[idle[i]].firstPing, vs.servers[idle[j]].firstPing
+		if !fi.Equal(fj) {
+			return fi.Before(fj)
+		}
+		return idle[i] < idle[j]
+	})
+	return idle
+}
+
+// SetIdleTimeout makes the server drop accepted connections that go
+// quiet for d, so abandoned clients don't pin goroutines and file
+// descriptors forever. 0 (the default) keeps connections open
+// indefinitely. Applies to connections accepted after the call.
+func (vs *ViewServer) SetIdleTimeout(d time.Duration) {
+	vs.idleTimeout.Store(int64(d))
+}
+
+// SetRequireDataLossAck makes a shard whose primary died with no
+// backup wait for an operator's AdminReassign "ack-dataloss" before
+// an empty server is promoted in its place. Off by default: the
+// promotion then proceeds on its own with only the logged warning.
+func (vs *ViewServer) SetRequireDataLossAck(require bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.requireLossAck = require
+}
+
+// SetAdminSecret configures the shared secret required by admin
+// RPCs. An empty secret leaves them open.
+func (vs *ViewServer) SetAdminSecret(secret string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.adminSecret = secret
+}
+
+// AdminReassign demotes a shard's primary or evicts a named server.
+// If the affected primary hasn't acked its view yet the request is
+// queued and applied on a later tick, so the view never changes
+// unsafely.
+func (vs *ViewServer) AdminReassign(args *AdminReassignArgs, reply *AdminReassignReply) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.counts.AdminReassign++
+
+	if vs.adminSecret != "" && args.Secret != vs.adminSecret {
+		return errors.New("viewservice: bad admin secret")
+	}
+	shard := args.Shard
+	switch args.Action {
+	case "ack-dataloss":
+		if shard < 0 || shard >= len(vs.pairs) {
+			return errors.New("viewservice: no such shard")
+		}
+		// The operator accepts losing the shard's data; the next tick
+		// may promote an empty server.
+		vs.pairs[shard].lossAcked = true
+		reply.View = vs.pairs[shard].view
+		return nil
+	case "demote":
+		if shard < 0 || shard >= len(vs.pairs) {
+			return errors.New("viewservice: no such shard")
+		}
+		if vs.pairs[shard].view.Backup == "" {
+			return errors.New("viewservice: no backup to promote")
+		}
+	case "evict":
+		if args.Server == "" {
+			return errors.New("viewservice: evict needs a server name")
+		}
+		shard = vs.shardOf(args.Server)
+		if shard >= 0 && args.Server == vs.pairs[shard].view.Primary && vs.pairs[shard].view.Backup == "" {
+			return errors.New("viewservice: refusing to evict the only primary")
+		}
+	default:
+		return errors.New("viewservice: unknown admin action " + args.Action)
+	}
+
+	if shard < 0 {
+		// Evicting an idle server needs no view change.
+		delete(vs.servers, args.Server)
+		reply.View = vs.pairs[0].view
+		return nil
+	}
+	p := vs.pairs[shard]
+	if !p.primaryAcked {
+		p.pendingReassign = args
+		reply.Queued = true
+		reply.View = p.view
+		return nil
+	}
+	vs.applyReassignLocked(shard, args)
+	reply.View = p.view
+	return nil
+}
+
+// applyReassignLocked performs a validated operator reassignment on
+// one shard. Caller must hold vs.mu and have checked primaryAcked.
+func (vs *ViewServer) applyReassignLocked(shard int, args *AdminReassignArgs) {
+	p := vs.pairs[shard]
+	switch args.Action {
+	case "demote":
+		if p.view.Backup != "" {
+			// The old primary stays alive and becomes eligible as a
+			// future backup through normal idle recruitment.
+			vs.updatePrimary(shard, p.view.Backup, "", "admin demote of primary "+p.view.Primary)
+		}
+	case "evict":
+		delete(vs.servers, args.Server)
+		switch args.Server {
+		case p.view.Primary:
+			if p.view.Backup != "" {
+				vs.updatePrimary(shard, p.view.Backup, "", "admin evict of primary "+args.Server)
+			}
+		case p.view.Backup:
+			vs.updatePrimary(shard, p.view.Primary, "", "admin evict of backup "+args.Server)
+		}
+	}
+}
+
+// GetServers reports every server the view service has heard from,
+// with its role, shard and last ping age, sorted by name.
+func (vs *ViewServer) GetServers(args *GetServersArgs, reply *GetServersReply) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.counts.GetServers++
+
+	now := vs.clk.Now()
+	for name, info := range vs.servers {
+		role, shard := "idle", 0
+		if i := vs.shardOf(name); i >= 0 {
+			shard = i
+			if name == vs.pairs[i].view.Primary {
+				role = "primary"
+			} else {
+				role = "backup"
+			}
+		}
+		reply.Servers = append(reply.Servers, ServerStatus{
+			Name:    name,
+			Role:    role,
+			Shard:   shard,
+			Alive:   !vs.isDead(name, now),
+			PingAge: elapsedSince(now, info.lastPing),
+		})
+	}
+	sort.Slice(reply.Servers, func(i, j int) bool {
+		return reply.Servers[i].Name < reply.Servers[j].Name
+	})
+	return nil
+}
+
+// GetViewHistory reports the most recent view changes, oldest first,
+// each with the shard it affected, the time it happened and the
+// reason for the change.
+func (vs *ViewServer) GetViewHistory(args *GetViewHistoryArgs, reply *GetViewHistoryReply) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.counts.GetViewHistory++
+
+	reply.Entries = append([]ViewHistoryEntry(nil), vs.history...)
+	return nil
+}
+
+// RPCCounts tallies how many RPCs of each kind the view service has
+// handled, one field per method. Monitoring probes (Health) are not
+// counted.
+type RPCCounts struct {
+	Ping           int
+	Get            int
+	AdminReassign  int
+	GetServers     int
+	GetViewHistory int
+	WatchView      int
+	Leave          int
+}
+
+// GetRPCCounts returns a snapshot of the per-method RPC counters, so
+// tests can assert on client behavior — e.g. that a client with a
+// stable primary isn't asking for the view on every operation.
+func (vs *ViewServer) GetRPCCounts() RPCCounts {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.counts
+}
+
+// Leave handles a graceful decommission: the departing server's last
+// ping is backdated past the deadline, so every liveness check reads
+// it as dead at once, and a repair pass runs immediately instead of
+// waiting for the next tick. Promotion and recruitment then follow
+// the ordinary rules — in particular, an unacked view still blocks
+// until its primary acknowledges it.
+func (vs *ViewServer) Leave(args *LeaveArgs, reply *LeaveReply) error {
+	vs.mu.Lock()
+	vs.counts.Leave++
+	if info, ok := vs.servers[args.Me]; ok {
+		info.lastPing = vs.clk.Now().Add(-(DeadInterval + PingInterval))
+	}
+	vs.mu.Unlock()
+	vs.checkFailuresAndPromote()
+	return nil
+}
+
+// watchPollTimeout is how long a WatchView poll blocks before
+// returning empty-handed; the caller simply polls again.
+const watchPollTimeout = 10 * time.Second
+
+// WatchView blocks until shard 0's view number exceeds
+// args.SinceViewNum and returns the new view, so external controllers
+// can react to failovers promptly without polling Get in a loop. A
+// poll window that elapses without a change returns the current view
+// with Timeout set.
+func (vs *ViewServer) WatchView(args *WatchViewArgs, reply *WatchViewReply) error {
+	vs.mu.Lock()
+	vs.counts.WatchView++
+
+	deadline := time.NewTimer(watchPollTimeout)
+	defer deadline.Stop()
+	for {
+		if v := vs.pairs[0].view; v.ViewNum > args.SinceViewNum {
+			reply.View = v
+			vs.mu.Unlock()
+			return nil
+		}
+		ch := vs.watchCh
+		cur := vs.pairs[0].view
+		vs.mu.Unlock()
+		select {
+		case <-ch:
+		case <-deadline.C:
+			reply.View = cur
+			reply.Timeout = true
+			return nil
+		}
+		vs.mu.Lock()
+	}
+}
+
+// Health reports liveness for monitoring tools. It deliberately does
+// not increment the RPC counters and does not touch ping bookkeeping.
+func (vs *ViewServer) Health(args *HealthArgs, reply *HealthReply) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	reply.Role = "viewservice"
+	reply.Alive = !vs.dead.Load()
+	reply.ViewNum = vs.pairs[0].view.ViewNum
+	return nil
+}
+
+// removeDeadLocked drops a server that was declared dead and starts
+// its cooldown, so it must re-register and prove itself healthy for
+// a DeadInterval before holding a role again. Caller must hold vs.mu.
+func (vs *ViewServer) removeDeadLocked(server string, now time.Time) {
+	delete(vs.servers, server)
+	vs.cooldown[server] = now
+}
+
+// elapsedSince guards duration arithmetic against clock jumps: if
+// the clock moved backwards past t, the elapsed time reads as zero
+// instead of going negative and poisoning comparisons downstream.
+// (Go's monotonic clock covers in-process readings, but lastPing
+// values can come from before an operator resets the wall clock.)
+func elapsedSince(now, t time.Time) time.Duration {
+	d := now.Sub(t)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// isDead reports whether the named server has missed too many pings.
+func (vs *ViewServer) isDead(server string, now time.Time) bool {
+	if vs.faults != nil && vs.faults.ForceDead != nil && vs.faults.ForceDead(server) {
+		return true
+	}
+	info, ok := vs.servers[server]
+	return ok && elapsedSince(now, info.lastPing) > DeadPings*PingInterval
+}
+
+// idleServer returns the live server that holds no role in any shard,
+// preferring higher priority, then earliest registration, then name.
+// The deterministic order keeps view evolution independent of map
+// iteration order. forPrimary excludes backup-only servers, for call
+// sites that are filling a primary slot.
+func (vs *ViewServer) idleServer(now time.Time, forPrimary bool) string {
+	best := ""
+	var bestInfo *serverInfo
+	for s, info := range vs.servers {
+		if vs.shardOf(s) >= 0 {
+			continue
+		}
+		if elapsedSince(now, info.lastPing) > DeadInterval {
+			continue
+		}
+		if now.Before(info.eligibleAfter) {
+			continue
+		}
+		if forPrimary && info.backupOnly {
+			continue
+		}
+		if best == "" || vs.preferLocked(s, info, best, bestInfo) {
+			best = s
+			bestInfo = info
+		}
+	}
+	return best
+}
+
+// preferLocked reports whether idle candidate a should be picked for
+// an empty role over b. The configured comparator wins when one is
+// set; the default prefers higher priority, then earlier
+// registration, then name. Caller must hold vs.mu.
+func (vs *ViewServer) preferLocked(a string, ai *serverInfo, b string, bi *serverInfo) bool {
+	if vs.selectLess != nil {
+		return vs.selectLess(a, b)
+	}
+	if ai.priority != bi.priority {
+		return ai.priority > bi.priority
+	}
+	if !ai.firstPing.Equal(bi.firstPing) {
+		return ai.firstPing.Before(bi.firstPing)
+	}
+	return a < b
+}
+
+// SetSelectionCompare overrides the idle-server preference order with
+// less, which reports whether server a should be recruited ahead of
+// server b. Only live, eligible idle servers are ever compared. Tests
+// use it to pin exactly which server an election picks; nil restores
+// the default (priority, then registration order, then name).
+func (vs *ViewServer) SetSelectionCompare(less func(a, b string) bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.selectLess = less
+}
+
+// priorityOf returns the named server's self-reported priority, or 0
+// if the server is unknown. Caller must hold vs.mu.
+func (vs *ViewServer) priorityOf(server string) int {
+	if info, ok := vs.servers[server]; ok {
+		return info.priority
+	}
+	return 0
+}
+
+// backupOnlyOf reports whether the named server has declared itself
+// ineligible for the primary role. Unknown servers are eligible.
+// Caller must hold vs.mu.
+func (vs *ViewServer) backupOnlyOf(server string) bool {
+	if info, ok := vs.servers[server]; ok {
+		return info.backupOnly
+	}
+	return false
+}
+
+// evaluateViewLocked runs the failure-detection decision logic for
+// one shard without applying anything: it returns the view the next
+// tick would install (equal to the current view when nothing would
+// change) and a human-readable reason. At most one view change
+// happens per shard per tick, since each change must be acked before
+// the next. Caller must hold vs.mu.
+func (vs *ViewServer) evaluateViewLocked(shard int, now time.Time) (View, string) {
+	p := vs.pairs[shard]
+	if !p.primaryAcked && p.view.Primary != "" {
+		// The ack gate fences the outgoing primary. A view with no
+		// primary has nobody to fence — and nobody who could ever ack
+		// it — so it must stay changeable or the shard wedges.
+		return p.view, "waiting for the primary to ack the current view"
+	}
+	if args := p.pendingReassign; args != nil {
+		switch args.Action {
+		case "demote":
+			if p.view.Backup != "" {
+				next := View{ViewNum: p.view.ViewNum + 1, Primary: p.view.Backup}
+				return next, "applying queued admin demote"
+			}
+		case "evict":
+			switch args.Server {
+			case p.view.Primary:
+				if p.view.Backup != "" {
+					next := View{ViewNum: p.view.ViewNum + 1, Primary: p.view.Backup}
+					return next, "applying queued admin evict of the primary"
+				}
+			case p.view.Backup:
+				next := View{ViewNum: p.view.ViewNum + 1, Primary: p.view.Primary}
+				return next, "applying queued admin evict of the backup"
+			}
+		}
+		return p.view, "queued admin " + args.Action + " is a no-op"
+	}
+	v := p.view
+	if v.Primary == "" && v.ViewNum > 0 {
+		// The primary slot emptied mid-flight — a primary restarted
+		// with no backup to hand over to. Whatever data the shard had
+		// is already gone, so refilling the slot with an empty server
+		// (often the restarted one itself) is the same decision as the
+		// data-loss promotion below and travels the same path.
+		idle := vs.idleServer(now, true)
+		if idle == "" {
+			return v, "shard has no primary and no idle server; shard is down"
+		}
+		if vs.requireLossAck && !p.lossAcked {
+			return v, "shard has no primary; waiting for operator ack-dataloss"
+		}
+		return View{ViewNum: v.ViewNum + 1, Primary: idle},
+			"DATA LOSS: shard had no primary; promoting empty server " + idle
+	}
+	if v.Backup != "" && vs.isDead(v.Backup, now) {
+		return View{ViewNum: v.ViewNum + 1, Primary: v.Primary},
+			"backup " + v.Backup + " is dead"
+	}
+	if v.Backup != "" && p.backupUnreach >= DeadPings {
+		return View{ViewNum: v.ViewNum + 1, Primary: v.Primary},
+			"primary cannot reach backup " + v.Backup + "; dropping it"
+	}
+	if v.Primary != "" && vs.isDead(v.Primary, now) && v.Backup != "" && !p.backupSyncing {
+		if vs.backupOnlyOf(v.Backup) {
+			// The synced copy sits on a server that must never be
+			// primary. Promoting an empty idle server instead would
+			// discard that copy, so hold the view and wait for the
+			// primary to return or an operator to intervene.
+			return v, "primary " + v.Primary + " is dead but backup " + v.Backup + " is backup-only; shard has no usable primary"
+		}
+		return View{ViewNum: v.ViewNum + 1, Primary: v.Backup},
+			"primary " + v.Primary + " is dead; promoting the backup"
+	}
+	if v.Primary != "" && vs.isDead(v.Primary, now) {
+		// The primary took the shard's only complete copy of the data
+		// with it: there is no backup, or the backup never finished
+		// its state transfer and holds a partial copy that must not be
+		// promoted. An idle server can take over, but it starts empty,
+		// so this is data loss — flag it loudly, and when configured
+		// to, wait for an operator to acknowledge it first.
+		dropped := ""
+		if v.Backup != "" {
+			dropped = "; dropping unsynced backup " + v.Backup
+		}
+		idle := vs.idleServer(now, true)
+		if idle == "" {
+			return v, "primary " + v.Primary + " died with no synced backup and no idle server; shard is down"
+		}
+		if vs.requireLossAck && !p.lossAcked {
+			return v, "primary " + v.Primary + " died with no synced backup; waiting for operator ack-dataloss"
+		}
+		return View{ViewNum: v.ViewNum + 1, Primary: idle},
+			"DATA LOSS: primary " + v.Primary + " died with no synced backup; promoting empty server " + idle + dropped
+	}
+	if v.Primary != "" && v.Backup == "" {
+		if idle := vs.idleServer(now, false); idle != "" {
+			return View{ViewNum: v.ViewNum + 1, Primary: v.Primary, Backup: idle},
+				"recruiting idle server " + idle + " as backup"
+		}
+	}
+	// Primary affinity: a backup that outranks its primary takes over
+	// once it has held the slot long enough to have received the
+	// primary's state, with the old primary staying on as backup. The
+	// preferred server always travels through the backup role first,
+	// so both copies of the data survive the swap.
+	if v.Primary != "" && v.Backup != "" && p.backupUnreach == 0 && !p.backupSyncing &&
+		!vs.backupOnlyOf(v.Backup) &&
+		vs.priorityOf(v.Backup) > vs.priorityOf(v.Primary) &&
+		elapsedSince(now, p.backupSince) >= DeadInterval {
+		return View{ViewNum: v.ViewNum + 1, Primary: v.Backup, Backup: v.Primary},
+			"backup " + v.Backup + " outranks primary " + v.Primary + "; swapping roles"
+	}
+	return v, "no change"
+}
+
+// EvaluateView reports what the next failure-detection tick would do
+// to shard 0 without applying it, so tests and admin tooling can
+// inspect the promotion decision.
+func (vs *ViewServer) EvaluateView() (View, string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.evaluateViewLocked(0, vs.clk.Now())
+}
+
+// checkFailuresAndPromote declares servers that have missed too many
+// pings dead and repairs each shard's view: the backup is promoted
+// if the primary died, and an idle server fills an empty backup
+// slot. A shard's view can only change once its primary has acked
+// it. The decision itself lives in evaluateViewLocked; this applies
+// it.
+func (vs *ViewServer) checkFailuresAndPromote() {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if vs.faults != nil && vs.faults.SkipTick != nil && vs.faults.SkipTick() {
+		return
+	}
+
+	now := vs.clk.Now()
+
+	// Forget stale cooldown entries for servers that never returned.
+	for s, t := range vs.cooldown {
+		if now.Sub(t) > 10*DeadInterval {
+			delete(vs.cooldown, s)
+		}
+	}
+
+	for shard, p := range vs.pairs {
+		if p.pendingReassign != nil && p.primaryAcked {
+			vs.applyReassignLocked(shard, p.pendingReassign)
+			p.pendingReassign = nil
+			continue
+		}
+
+		next, reason := vs.evaluateViewLocked(shard, now)
+		if next.ViewNum == p.view.ViewNum {
+			continue
+		}
+		// Drop the server the transition pushed out of the view (dead,
+		// or unreachable from the primary); the cooldown keeps it from
+		// bouncing straight back into a role.
+		switch {
+		case next.Primary == p.view.Primary && next.Backup == "" && p.view.Backup != "":
+			vs.removeDeadLocked(p.view.Backup, now)
+		case next.Primary != p.view.Primary && p.view.Primary != "" && vs.isDead(p.view.Primary, now):
+			vs.removeDeadLocked(p.view.Primary, now)
+		}
+		// Coalesce the follow-up recruitment into the same change: a
+		// transition that leaves the backup slot empty while an idle
+		// server is standing by would otherwise cost a second view —
+		// an intermediate nobody observes — one ack later. Filling the
+		// slot now is still a single change from an acked view, so the
+		// ack protocol holds and view numbers count net transitions.
+		if next.Primary != "" && next.Backup == "" {
+			if idle := vs.idleServer(now, false); idle != "" && idle != next.Primary {
+				next.Backup = idle
+				reason += "; recruiting idle server " + idle + " as backup"
+			}
+		}
+		if strings.HasPrefix(reason, "DATA LOSS") {
+			// This is the one transition that silently discards data if
+			// nobody is watching; make it impossible to miss in the logs.
+			log.Printf("viewservice: shard %d: %s", shard, reason)
+			p.lossAcked = false
+			p.lossPrimary = next.Primary
+		}
+		vs.updatePrimary(shard, next.Primary, next.Backup, reason)
+	}
+}
+
+// ticker drives failure detection once per ping interval.
+func (vs *ViewServer) ticker() {
+	t := vs.clk.NewTicker(PingInterval)
+	defer t.Stop()
+	for !vs.dead.Load() {
+		<-t.C()
+		vs.checkFailuresAndPromote()
+	}
+}
+
+// Addr returns the address the listener actually bound, which
+// differs from the configured one when listening on an ephemeral
+// port.
+func (vs *ViewServer) Addr() string {
+	return vs.l.Addr().String()
+}
+
+// SetMaxConns caps how many connections the server serves at once;
+// newcomers over the cap are closed immediately, which clients see
+// as a retryable transport failure. Zero means unlimited.
+func (vs *ViewServer) SetMaxConns(n int) {
+	vs.maxConns.Store(int64(n))
+}
+
+// OpenConns is the number of accepted connections currently being
+// served, for monitoring against the SetMaxConns cap.
+func (vs *ViewServer) OpenConns() int {
+	return int(vs.connCount.Load())
+}
+
+// SetMaxMessageBytes caps the size of a single incoming RPC message;
+// a connection that sends a larger one is closed mid-decode instead
+// of ballooning memory. Zero (the default) means unlimited. Only
+// connections accepted after the change are affected.
+func (vs *ViewServer) SetMaxMessageBytes(n int64) {
+	vs.maxMsgBytes.Store(n)
+}
+
+// Kill shuts the server down, for tests.
+func (vs *ViewServer) Kill() {
+	vs.dead.Store(true)
+	vs.l.Close()
+}
+
+// StartServer starts a view service listening on me and returns it.
+func StartServer(me string) *ViewServer {
+	return StartServerWithClock(me, clock.Real())
+}
+
+// StartServerWithClock is StartServer with an explicit clock, for
+// tests that need deterministic time.
+func StartServerWithClock(me string, clk clock.Clock) *ViewServer {
+	return StartServerWithTransport(me, clk, transport.Real())
+}
+
+// StartServerWithTransport is StartServerWithClock with an explicit
+// transport, so tests can run the view service over in-memory pipes.
+func StartServerWithTransport(me string, clk clock.Clock, tr transport.Transport) *ViewServer {
+	vs := &ViewServer{
+		me:       me,
+		pairs:    []*pairState{{}},
+		servers:  map[string]*serverInfo{},
+		cooldown: map[string]time.Time{},
+		clk:      clk,
+		watchCh:  make(chan struct{}),
+	}
+
+	rpcs := rpc.NewServer()
+	rpcs.Register(vs)
+
+	l, err := tr.Listen(me)
+	if err != nil {
+		log.Fatal("viewservice listen error: ", err)
+	}
+	vs.l = l
+
+	go func() {
+		for !vs.dead.Load() {
+			conn, err := vs.l.Accept()
+			if err != nil {
+				if vs.dead.Load() {
+					return
+				}
+				continue
+			}
+			if vs.dead.Load() {
+				conn.Close()
+				continue
+			}
+			if max := vs.maxConns.Load(); max > 0 && vs.connCount.Load() >= max {
+				// Over the connection cap: shed the newcomer at once
+				// instead of spawning yet another serving goroutine.
+				conn.Close()
+				continue
+			}
+			vs.connCount.Add(1)
+			go func() {
+				defer vs.connCount.Add(-1)
+				wrapped := transport.IdleTimeout(conn, time.Duration(vs.idleTimeout.Load()))
+				rpcs.ServeCodec(transport.GobServerCodec(wrapped, vs.maxMsgBytes.Load()))
+			}()
+		}
+	}()
+
+	go vs.ticker()
+	return vs
+}
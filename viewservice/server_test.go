@@ -0,0 +1,975 @@
+package viewservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	s1 = "s1:1001"
+	s2 = "s2:1002"
+	s3 = "s3:1003"
+)
+
+func TestFirstServerBecomesPrimary(t *testing.T) {
+	h := newHarness(t)
+
+	v := h.ping(s1, 0)
+	if v.ViewNum != 1 || v.Primary != s1 || v.Backup != "" {
+		t.Fatalf("after first ping, got view %+v", v)
+	}
+}
+
+func TestIdleServerBecomesBackup(t *testing.T) {
+	h := newHarness(t)
+
+	h.ping(s1, 0)
+	h.ping(s1, 1) // primary acks view 1
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+
+	v := h.view()
+	if v.ViewNum != 2 || v.Primary != s1 || v.Backup != s2 {
+		t.Fatalf("after idle server joined, got view %+v", v)
+	}
+}
+
+// TestBackupRecruitedPromptly asserts the empty backup slot is
+// filled within two ticks of an idle server joining, rather than
+// waiting out an extra ticker pass.
+func TestBackupRecruitedPromptly(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1) // primary acks
+	h.ping(s2, 0) // idle server joins
+	h.advance(PingInterval)
+	h.advance(PingInterval)
+
+	v := h.view()
+	if v.Primary != s1 || v.Backup != s2 {
+		t.Fatalf("backup not recruited within two ticks: %+v", v)
+	}
+}
+
+// TestFailures drives the harness through a scripted failure and
+// checks the resulting view.
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(h *harness)
+		want View
+	}{
+		{
+			name: "primary death promotes backup",
+			run: func(h *harness) {
+				h.ping(s1, 0)
+				h.ping(s1, 1)
+				h.ping(s2, 0)
+				h.advance(PingInterval)
+				h.ping(s1, 2) // ack view with backup
+				h.pingUntilDead(map[string]uint{s2: 2})
+			},
+			want: View{ViewNum: 3, Primary: s2, Backup: ""},
+		},
+		{
+			name: "backup death empties backup slot",
+			run: func(h *harness) {
+				h.ping(s1, 0)
+				h.ping(s1, 1)
+				h.ping(s2, 0)
+				h.advance(PingInterval)
+				h.ping(s1, 2)
+				h.pingUntilDead(map[string]uint{s1: 2})
+			},
+			want: View{ViewNum: 3, Primary: s1, Backup: ""},
+		},
+		{
+			// The replacement rides in the same view change that drops
+			// the dead backup: no intermediate backup-less view.
+			name: "idle server replaces dead backup",
+			run: func(h *harness) {
+				h.ping(s1, 0)
+				h.ping(s1, 1)
+				h.ping(s2, 0)
+				h.advance(PingInterval)
+				h.ping(s1, 2)
+				h.pingUntilDead(map[string]uint{s1: 2, s3: 2})
+			},
+			want: View{ViewNum: 3, Primary: s1, Backup: s3},
+		},
+		{
+			name: "unacked view blocks promotion",
+			run: func(h *harness) {
+				h.ping(s1, 0)
+				h.ping(s1, 1)
+				h.ping(s2, 0)
+				h.advance(PingInterval)
+				// s1 never acks view 2, then dies: the view must not
+				// move even though s2 is alive.
+				h.pingUntilDead(map[string]uint{s2: 2})
+			},
+			want: View{ViewNum: 2, Primary: s1, Backup: s2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			tt.run(h)
+			if v := h.view(); v != tt.want {
+				t.Errorf("got view %+v, want %+v", v, tt.want)
+			}
+		})
+	}
+}
+
+// TestRestartedPrimaryHandsOff covers a primary that reboots and
+// pings with view number 0: the backup must take over.
+func TestRestartedPrimaryHandsOff(t *testing.T) {
+	h := newHarness(t)
+
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2)
+
+	v := h.ping(s1, 0) // s1 crashed and came back empty
+	if v.Primary != s2 || v.Backup != "" {
+		t.Fatalf("after primary restart, got view %+v", v)
+	}
+}
+
+// TestOldestIdleServerChosen pins deterministic selection: the idle
+// server that registered first becomes backup, regardless of map
+// iteration order.
+func TestOldestIdleServerChosen(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s3, 0) // s3 registers before s2
+	h.advance(PingInterval / 2)
+	h.ping(s2, 0)
+	h.ping(s1, 1)
+	h.advance(PingInterval / 2)
+
+	v := h.view()
+	if v.Backup != s3 {
+		t.Fatalf("oldest idle server should be picked, got view %+v", v)
+	}
+}
+
+// TestDeadServerCoolsDownBeforeReuse checks that a server removed
+// for being dead can't bounce straight back in as backup: it must
+// ping healthily for a full DeadInterval first.
+func TestDeadServerCoolsDownBeforeReuse(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2)
+	h.pingUntilDead(map[string]uint{s2: 2}) // s1 dies, s2 promoted
+
+	h.ping(s2, 3) // new primary acks
+	h.ping(s1, 0) // the dead ex-primary comes back
+	h.advance(PingInterval)
+	if v := h.view(); v.Backup != "" {
+		t.Fatalf("ex-dead server became backup without cooldown: %+v", v)
+	}
+
+	// After a DeadInterval of healthy pings it is eligible again.
+	for i := 0; i < DeadPings+1; i++ {
+		h.ping(s1, 0)
+		h.ping(s2, 3)
+		h.advance(PingInterval)
+	}
+	if v := h.view(); v.Backup != s1 {
+		t.Fatalf("ex-dead server should be backup after cooldown: %+v", v)
+	}
+}
+
+func TestAdminReassignDemote(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2)
+
+	var reply AdminReassignReply
+	if err := h.vs.AdminReassign(&AdminReassignArgs{Action: "demote"}, &reply); err != nil {
+		t.Fatalf("AdminReassign: %v", err)
+	}
+	if reply.Queued {
+		t.Fatal("demote should apply immediately once the primary acked")
+	}
+	if reply.View.Primary != s2 || reply.View.Backup != "" {
+		t.Fatalf("after demote, got view %+v", reply.View)
+	}
+}
+
+func TestAdminReassignQueuedUntilAck(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	// View 2 (s1 primary, s2 backup) is not acked yet.
+
+	var reply AdminReassignReply
+	if err := h.vs.AdminReassign(&AdminReassignArgs{Action: "demote"}, &reply); err != nil {
+		t.Fatalf("AdminReassign: %v", err)
+	}
+	if !reply.Queued {
+		t.Fatal("demote should queue while the view is unacked")
+	}
+	if v := h.view(); v.Primary != s1 {
+		t.Fatalf("queued demote applied early: %+v", v)
+	}
+
+	h.ping(s1, 2) // primary acks
+	h.advance(PingInterval)
+	if v := h.view(); v.Primary != s2 || v.Backup != "" {
+		t.Fatalf("after ack, queued demote should apply, got %+v", v)
+	}
+}
+
+func TestAdminReassignBadSecret(t *testing.T) {
+	h := newHarness(t)
+	h.vs.SetAdminSecret("hunter2")
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2)
+
+	var reply AdminReassignReply
+	if err := h.vs.AdminReassign(&AdminReassignArgs{Action: "demote"}, &reply); err == nil {
+		t.Fatal("AdminReassign without the secret should fail")
+	}
+	if err := h.vs.AdminReassign(&AdminReassignArgs{Secret: "hunter2", Action: "demote"}, &reply); err != nil {
+		t.Fatalf("AdminReassign with the secret: %v", err)
+	}
+}
+
+// TestBackwardClockJump simulates the wall clock jumping backwards
+// past the recorded ping times and checks nobody is declared dead.
+func TestBackwardClockJump(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2)
+
+	h.clk.Advance(-10 * DeadInterval)
+	h.vs.checkFailuresAndPromote()
+
+	if v := h.view(); v.ViewNum != 2 || v.Primary != s1 || v.Backup != s2 {
+		t.Fatalf("backward jump changed the view: %+v", v)
+	}
+	var reply GetServersReply
+	if err := h.vs.GetServers(&GetServersArgs{}, &reply); err != nil {
+		t.Fatalf("GetServers: %v", err)
+	}
+	for _, s := range reply.Servers {
+		if !s.Alive {
+			t.Fatalf("server %s falsely declared dead", s.Name)
+		}
+		if s.PingAge < 0 {
+			t.Fatalf("server %s has negative ping age %v", s.Name, s.PingAge)
+		}
+	}
+}
+
+// TestEvaluateViewDryRun checks that EvaluateView reports the
+// promotion the next tick would make without applying it.
+func TestEvaluateViewDryRun(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2)
+
+	// Age the primary's last ping past the deadline without moving
+	// the clock, so the background ticker can't apply the change
+	// before we inspect it.
+	h.vs.mu.Lock()
+	h.vs.servers[s1].lastPing = h.clk.Now().Add(-DeadInterval - PingInterval)
+	h.vs.mu.Unlock()
+
+	next, reason := h.vs.EvaluateView()
+	if next.ViewNum != 3 || next.Primary != s2 || next.Backup != "" {
+		t.Fatalf("EvaluateView = %+v (%s)", next, reason)
+	}
+	if v := h.view(); v.ViewNum != 2 {
+		t.Fatalf("dry run mutated the view: %+v", v)
+	}
+
+	h.vs.checkFailuresAndPromote()
+	if v := h.view(); v != next {
+		t.Fatalf("tick applied %+v, EvaluateView predicted %+v", v, next)
+	}
+}
+
+// A backup that still pings the view service but is unreachable from
+// the primary is dropped once the primary has complained for
+// DeadPings consecutive pings; a single reachable report in between
+// resets the count.
+func TestBackupUnreachableFromPrimary(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1) // ack view 1
+	h.ping(s2, 0) // recruited as backup: view 2
+	h.ping(s1, 2) // ack view 2
+
+	// A complaint followed by a clean report must not count.
+	h.pingReporting(s1, 2, true)
+	h.pingReporting(s1, 2, false)
+
+	for i := 0; i < DeadPings; i++ {
+		if v := h.view(); v.ViewNum != 2 {
+			t.Fatalf("view changed after only %d complaints: %+v", i, v)
+		}
+		h.pingReporting(s1, 2, true)
+		h.ping(s2, 2)
+		h.advance(PingInterval)
+	}
+	v := h.view()
+	if v.ViewNum != 3 || v.Primary != s1 || v.Backup != "" {
+		t.Fatalf("view = %+v, want view 3 with %s alone", v, s1)
+	}
+}
+
+// Every view change lands in the history with a reason, oldest
+// first, so a failover can be reconstructed after the fact.
+func TestViewHistory(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0) // view 1: s1 primary
+	h.ping(s1, 1)
+	h.ping(s2, 0) // view 2: s2 recruited as backup
+	h.ping(s1, 2)
+	h.pingUntilDead(map[string]uint{s2: 2}) // view 3: s1 dead, s2 promoted
+
+	var reply GetViewHistoryReply
+	if err := h.vs.GetViewHistory(&GetViewHistoryArgs{}, &reply); err != nil {
+		t.Fatalf("GetViewHistory: %v", err)
+	}
+	if len(reply.Entries) != 3 {
+		t.Fatalf("got %d history entries, want 3: %+v", len(reply.Entries), reply.Entries)
+	}
+	for i, e := range reply.Entries {
+		if e.View.ViewNum != uint(i+1) {
+			t.Errorf("entry %d has view %d, want %d", i, e.View.ViewNum, i+1)
+		}
+		if e.Reason == "" {
+			t.Errorf("entry %d has no reason", i)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("entry %d has no timestamp", i)
+		}
+	}
+	if last := reply.Entries[2].View; last.Primary != s2 || last.Backup != "" {
+		t.Fatalf("last entry = %+v, want %s promoted alone", last, s2)
+	}
+}
+
+// TestHarnessAddr just checks the ephemeral listener is usable.
+func TestHarnessAddr(t *testing.T) {
+	h := newHarness(t)
+	ck := MakeClerk(s1, h.addr())
+	if _, err := ck.Ping(0); err != nil {
+		t.Fatalf("Ping over TCP: %v", err)
+	}
+	if v, ok := ck.Get(); !ok || v.Primary != s1 {
+		t.Fatalf("Get over TCP: ok=%v view=%+v", ok, v)
+	}
+}
+
+func TestShardedAssignment(t *testing.T) {
+	h := newHarness(t)
+	if err := h.vs.SetNumShards(2); err != nil {
+		t.Fatalf("SetNumShards: %v", err)
+	}
+
+	// Empty primary slots are filled before any backup slot, so the
+	// first two servers become the two shard primaries and the next
+	// two fill the backup slots.
+	v1 := h.ping(s1, 0)
+	if v1.ViewNum != 1 || v1.Primary != s1 {
+		t.Fatalf("shard 0 view after first ping = %+v", v1)
+	}
+	v2 := h.ping(s2, 0)
+	if v2.ViewNum != 1 || v2.Primary != s2 {
+		t.Fatalf("shard 1 view after second ping = %+v", v2)
+	}
+	h.ping(s1, 1) // ack shard 0
+	h.ping(s2, 1) // ack shard 1
+	if v := h.ping(s3, 0); v.Primary != s1 || v.Backup != s3 {
+		t.Fatalf("s3 not recruited into shard 0: %+v", v)
+	}
+	const s4 = "s4:1004"
+	if v := h.ping(s4, 0); v.Primary != s2 || v.Backup != s4 {
+		t.Fatalf("s4 not recruited into shard 1: %+v", v)
+	}
+
+	// Get exposes both shard views; shard 0's doubles as the classic
+	// single view.
+	var reply GetReply
+	if err := h.vs.Get(&GetArgs{}, &reply); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(reply.Shards) != 2 {
+		t.Fatalf("got %d shard views, want 2", len(reply.Shards))
+	}
+	if reply.View != reply.Shards[0] {
+		t.Fatalf("View %+v != Shards[0] %+v", reply.View, reply.Shards[0])
+	}
+	if reply.Shards[1].Primary != s2 {
+		t.Fatalf("shard 1 primary = %q, want %s", reply.Shards[1].Primary, s2)
+	}
+
+	// Resharding with live servers would remap keys under their data.
+	if err := h.vs.SetNumShards(4); err == nil {
+		t.Fatal("SetNumShards succeeded with registered servers")
+	}
+}
+
+func TestShardedFailoverIsIndependent(t *testing.T) {
+	h := newHarness(t)
+	if err := h.vs.SetNumShards(2); err != nil {
+		t.Fatalf("SetNumShards: %v", err)
+	}
+	h.ping(s1, 0)
+	h.ping(s2, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 1)
+	h.ping(s3, 0) // backup for shard 0
+	h.ping(s1, 2) // ack shard 0's view 2
+
+	// Kill shard 0's primary; only shard 0 changes.
+	h.pingUntilDead(map[string]uint{s2: 1, s3: 2})
+	var reply GetReply
+	if err := h.vs.Get(&GetArgs{}, &reply); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := reply.Shards[0]; got.Primary != s3 || got.Backup != "" {
+		t.Fatalf("shard 0 after failover = %+v, want %s promoted alone", got, s3)
+	}
+	if got := reply.Shards[1]; got.ViewNum != 1 || got.Primary != s2 {
+		t.Fatalf("shard 1 disturbed by shard 0's failover: %+v", got)
+	}
+}
+
+func TestShardFor(t *testing.T) {
+	if got := ShardFor("anything", 1); got != 0 {
+		t.Fatalf("ShardFor with 1 shard = %d", got)
+	}
+	seen := map[int]bool{}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		s := ShardFor(k, 4)
+		if s < 0 || s >= 4 {
+			t.Fatalf("ShardFor(%q, 4) = %d, out of range", k, s)
+		}
+		if s != ShardFor(k, 4) {
+			t.Fatalf("ShardFor(%q, 4) is not stable", k)
+		}
+		seen[s] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("8 keys over 4 shards all landed on %v", seen)
+	}
+}
+
+func TestDataLossPromotionIsFlagged(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0) // view 1: s1 primary, never gets a backup
+	h.ping(s1, 1)
+	h.pingUntilDead(map[string]uint{}) // s1 dies alone
+
+	// A newcomer must not be paired with the corpse as its backup.
+	if v := h.ping(s2, 0); v.Backup == s2 {
+		t.Fatalf("s2 recruited as backup of a dead primary: %+v", v)
+	}
+	h.vs.checkFailuresAndPromote()
+	v := h.view()
+	if v.ViewNum != 2 || v.Primary != s2 {
+		t.Fatalf("after tick view = %+v, want s2 promoted in view 2", v)
+	}
+
+	var reply GetViewHistoryReply
+	if err := h.vs.GetViewHistory(&GetViewHistoryArgs{}, &reply); err != nil {
+		t.Fatalf("GetViewHistory: %v", err)
+	}
+	last := reply.Entries[len(reply.Entries)-1]
+	if !strings.HasPrefix(last.Reason, "DATA LOSS") {
+		t.Fatalf("promotion reason %q does not flag the data loss", last.Reason)
+	}
+}
+
+func TestDataLossWaitsForOperatorAck(t *testing.T) {
+	h := newHarness(t)
+	h.vs.SetRequireDataLossAck(true)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.pingUntilDead(map[string]uint{})
+	h.ping(s2, 0)
+
+	// Without the ack the shard stays down rather than serving empty.
+	h.vs.checkFailuresAndPromote()
+	if v := h.view(); v.Primary != s1 || v.ViewNum != 1 {
+		t.Fatalf("view changed without operator ack: %+v", v)
+	}
+
+	var reply AdminReassignReply
+	args := &AdminReassignArgs{Action: "ack-dataloss"}
+	if err := h.vs.AdminReassign(args, &reply); err != nil {
+		t.Fatalf("AdminReassign(ack-dataloss): %v", err)
+	}
+	h.vs.checkFailuresAndPromote()
+	if v := h.view(); v.Primary != s2 || v.ViewNum != 2 {
+		t.Fatalf("view after ack = %+v, want s2 promoted in view 2", v)
+	}
+}
+
+// TestIdleRosterExposed checks Get reports live role-less servers in
+// join order, and only when asked.
+func TestIdleRosterExposed(t *testing.T) {
+	const s4 = "s4:1004"
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval) // s2 recruited as backup
+	h.ping(s4, 0)           // idles, in this join order
+	h.advance(PingInterval / 2)
+	h.ping(s3, 0)
+
+	var reply GetReply
+	if err := h.vs.Get(&GetArgs{IncludeIdle: true}, &reply); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(reply.Idle) != 2 || reply.Idle[0] != s4 || reply.Idle[1] != s3 {
+		t.Fatalf("idle roster = %v, want [%s %s]", reply.Idle, s4, s3)
+	}
+
+	var plain GetReply
+	if err := h.vs.Get(&GetArgs{}, &plain); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if plain.Idle != nil {
+		t.Fatalf("idle roster reported without IncludeIdle: %v", plain.Idle)
+	}
+}
+
+// TestPriorityBackupReclaimsPrimary walks a preferred server through
+// the affinity path: it is recruited as backup ahead of older idle
+// servers, holds the slot for a settling period, then swaps into the
+// primary role with the old primary kept on as its backup.
+func TestPriorityBackupReclaimsPrimary(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s3, 0)             // ordinary idle server, registered first
+	h.pingPriority(s2, 0, 10) // preferred server joins later
+	h.ping(s1, 1)             // ack frees the backup slot for recruitment
+	h.advance(PingInterval)
+
+	v := h.view()
+	if v.Primary != s1 || v.Backup != s2 {
+		t.Fatalf("high-priority server not recruited first: %+v", v)
+	}
+
+	// No swap until the backup has settled for a DeadInterval.
+	h.pingPriority(s1, v.ViewNum, 0)
+	h.advance(PingInterval)
+	if got := h.view(); got.ViewNum != v.ViewNum {
+		t.Fatalf("swapped before the backup settled: %+v", got)
+	}
+
+	for i := 0; i < DeadPings+1; i++ {
+		h.pingPriority(s1, h.view().ViewNum, 0)
+		h.pingPriority(s2, h.view().ViewNum, 10)
+		h.ping(s3, 0)
+		h.advance(PingInterval)
+	}
+	got := h.view()
+	if got.Primary != s2 || got.Backup != s1 {
+		t.Fatalf("after settling, got view %+v, want %s primary and %s backup", got, s2, s1)
+	}
+}
+
+// TestFaultInjector exercises the three test hooks: dropped pings
+// starve a server into death, ForceDead kills one ahead of its
+// deadline, and SkipTick freezes failure detection entirely.
+func TestFaultInjector(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2) // ack view 2: s1 primary, s2 backup
+
+	// Freeze the ticker: even a silent backup stays in the view.
+	frozen := true
+	h.vs.SetFaultInjector(&FaultInjector{
+		SkipTick: func() bool { return frozen },
+	})
+	h.pingUntilDead(map[string]uint{s1: 2})
+	if v := h.view(); v.Backup != s2 {
+		t.Fatalf("ticker ran while frozen: %+v", v)
+	}
+
+	// Unfreeze with s2's pings dropped on the floor: it is declared
+	// dead on the next passes.
+	frozen = false
+	h.vs.SetFaultInjector(&FaultInjector{
+		DropPing: func(args *PingArgs) bool { return args.Me == s2 },
+	})
+	var reply PingReply
+	if err := h.vs.Ping(&PingArgs{Me: s2, ViewNum: 2}, &reply); err == nil {
+		t.Fatal("dropped ping did not report an error")
+	}
+	h.pingUntilDead(map[string]uint{s1: 2})
+	v := h.view()
+	if v.Primary != s1 || v.Backup != "" {
+		t.Fatalf("after dropping s2's pings, got view %+v", v)
+	}
+
+	// ForceDead kills the primary without waiting out its deadline.
+	h.ping(s1, v.ViewNum)
+	h.ping(s3, 0)
+	h.advance(PingInterval)
+	h.ping(s1, h.view().ViewNum) // ack s3 as backup
+	h.vs.SetFaultInjector(&FaultInjector{
+		ForceDead: func(server string) bool { return server == s1 },
+	})
+	h.advance(PingInterval)
+	if v := h.view(); v.Primary != s3 {
+		t.Fatalf("ForceDead primary not replaced: %+v", v)
+	}
+}
+
+// TestUnsyncedBackupNotPromoted checks a backup the primary reported
+// as still syncing is never promoted: when the primary dies the
+// shard waits for an idle server and takes the data-loss path, with
+// the partial copy dropped from the view.
+func TestUnsyncedBackupNotPromoted(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.ping(s2, 0)
+	h.advance(PingInterval) // view 2: s1 primary, s2 backup
+
+	// s1 acks view 2 but reports the transfer to s2 never finished.
+	var reply PingReply
+	if err := h.vs.Ping(&PingArgs{Me: s1, ViewNum: 2, BackupSyncing: true}, &reply); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	// s1 dies; s2 keeps pinging but must not become primary.
+	h.pingUntilDead(map[string]uint{s2: 2})
+	if v := h.view(); v.ViewNum != 2 || v.Primary != s1 {
+		t.Fatalf("unsynced backup was promoted: %+v", v)
+	}
+
+	// An idle server arrives: it is promoted (data loss) instead of
+	// the partial copy, which leaves the view.
+	h.ping(s3, 0)
+	for i := 0; i < DeadPings+1; i++ {
+		h.ping(s2, 2)
+		h.ping(s3, 0)
+		h.advance(PingInterval)
+	}
+	v := h.view()
+	if v.Primary != s3 {
+		t.Fatalf("idle server not promoted over unsynced backup: %+v", v)
+	}
+	found := false
+	for _, e := range h.vs.history {
+		if strings.Contains(e.Reason, "DATA LOSS") && strings.Contains(e.Reason, "dropping unsynced backup "+s2) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("history does not flag the dropped unsynced backup: %+v", h.vs.history)
+	}
+}
+
+// TestRPCCounts checks the per-method counters: each RPC bumps only
+// its own counter, and Health stays invisible.
+func TestRPCCounts(t *testing.T) {
+	h := newHarness(t)
+	s1 := "server1"
+
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.view()
+	h.view()
+	h.view()
+
+	counts := h.vs.GetRPCCounts()
+	if counts.Ping != 2 {
+		t.Fatalf("Ping count = %d, want 2", counts.Ping)
+	}
+	if counts.Get != 3 {
+		t.Fatalf("Get count = %d, want 3", counts.Get)
+	}
+	if counts.AdminReassign != 0 || counts.GetServers != 0 || counts.GetViewHistory != 0 {
+		t.Fatalf("unused methods counted: %+v", counts)
+	}
+
+	// Health is a monitoring probe and must not move any counter.
+	var hr HealthReply
+	if err := h.vs.Health(&HealthArgs{}, &hr); err != nil {
+		t.Fatalf("Health: %v", err)
+	}
+	if got := h.vs.GetRPCCounts(); got != counts {
+		t.Fatalf("Health moved the counters: %+v -> %+v", counts, got)
+	}
+}
+
+// TestSelectionCompare pins an election outcome with a custom
+// comparator: recruitment picks the comparator's favorite instead of
+// the default registration order, and clearing it restores the
+// default.
+func TestSelectionCompare(t *testing.T) {
+	h := newHarness(t)
+	// Reverse name order: s3 beats s2 regardless of join order.
+	h.vs.SetSelectionCompare(func(a, b string) bool { return a > b })
+
+	h.ping(s1, 0)
+	h.ping(s2, 0) // registers first; the default would pick it
+	h.ping(s3, 0)
+	h.ping(s1, 1) // ack frees the backup slot for recruitment
+	h.advance(PingInterval)
+
+	v := h.view()
+	if v.Primary != s1 || v.Backup != s3 {
+		t.Fatalf("comparator not honored: %+v", v)
+	}
+}
+
+// TestBackupOnly checks the backup-only constraint end to end: a
+// backup-only server never bootstraps a primary, is still recruited
+// as a backup, and is not promoted when the primary dies.
+func TestBackupOnly(t *testing.T) {
+	h := newHarness(t)
+
+	// The first pinger is backup-only: the view stays primary-less.
+	h.pingBackupOnly(s2, 0)
+	if v := h.view(); v.Primary != "" {
+		t.Fatalf("backup-only server took the primary slot: %+v", v)
+	}
+
+	// A regular server becomes primary, and the backup-only one is
+	// recruited into the backup slot.
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+	h.pingBackupOnly(s2, 0)
+	h.advance(PingInterval)
+	v := h.view()
+	if v.Primary != s1 || v.Backup != s2 {
+		t.Fatalf("backup-only server not recruited as backup: %+v", v)
+	}
+
+	// The primary dies. The backup-only backup must not be promoted;
+	// the view holds instead. s2 keeps reporting backup-only (the
+	// plain-ping pingUntilDead would reset the flag).
+	h.ping(s1, v.ViewNum)
+	for i := 0; i < DeadPings+1; i++ {
+		h.pingBackupOnly(s2, v.ViewNum)
+		h.advance(PingInterval)
+	}
+	if got := h.view(); got.Primary != s1 {
+		t.Fatalf("backup-only server was promoted to primary: %+v", got)
+	}
+	if _, reason := h.vs.EvaluateView(); !strings.Contains(reason, "backup-only") {
+		t.Fatalf("hold reason does not mention backup-only: %q", reason)
+	}
+}
+
+// TestGetReportsPrimaryAcked checks that Get distinguishes an acked
+// view from one the new primary hasn't confirmed yet.
+func TestGetReportsPrimaryAcked(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0) // view 1 created, not yet acked
+
+	var reply GetReply
+	if err := h.vs.Get(&GetArgs{}, &reply); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if reply.PrimaryAcked {
+		t.Fatalf("view reported acked before the primary confirmed it: %+v", reply)
+	}
+
+	h.ping(s1, 1) // primary acks view 1
+	if err := h.vs.Get(&GetArgs{}, &reply); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !reply.PrimaryAcked {
+		t.Fatalf("view not reported acked after the primary confirmed it: %+v", reply)
+	}
+}
+
+// TestWatchView covers the long-poll: a poll behind the current view
+// returns at once, a poll at the current view blocks until the next
+// change, and the clerk's channel wrapper delivers changes in order.
+func TestWatchView(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0) // view 1
+
+	// Already behind: returns without blocking.
+	var reply WatchViewReply
+	if err := h.vs.WatchView(&WatchViewArgs{SinceViewNum: 0}, &reply); err != nil {
+		t.Fatalf("WatchView: %v", err)
+	}
+	if reply.Timeout || reply.View.ViewNum != 1 {
+		t.Fatalf("WatchView(0) = %+v, want view 1 without timeout", reply)
+	}
+
+	// Current: blocks until the next view change wakes it.
+	got := make(chan WatchViewReply, 1)
+	go func() {
+		var r WatchViewReply
+		if err := h.vs.WatchView(&WatchViewArgs{SinceViewNum: 1}, &r); err != nil {
+			t.Errorf("WatchView: %v", err)
+		}
+		got <- r
+	}()
+	h.ping(s1, 1) // ack view 1
+	h.ping(s2, 0) // idle server joins; recruitment makes view 2
+	h.advance(PingInterval)
+	select {
+	case r := <-got:
+		if r.Timeout || r.View.ViewNum != 2 {
+			t.Fatalf("blocked WatchView woke with %+v, want view 2", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchView never woke after the view change")
+	}
+
+	// The clerk wraps the long-poll in a channel.
+	ck := MakeClerk("", h.addr())
+	views, stop := ck.WatchView(0)
+	defer stop()
+	select {
+	case v := <-views:
+		if v.ViewNum != 2 {
+			t.Fatalf("watched view = %+v, want view 2", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clerk watch never delivered a view")
+	}
+}
+
+// TestLeave covers graceful decommission: a leaving server is treated
+// as dead on the spot, so failover happens without waiting out the
+// ping deadline — but still not past an unacked view.
+func TestLeave(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1) // ack view 1
+	h.ping(s2, 0)
+	h.advance(PingInterval)
+	h.ping(s1, 2) // ack view with backup
+
+	// The primary leaves; the backup is promoted immediately, with no
+	// clock advance at all.
+	h.leave(s1)
+	if v := h.view(); v.ViewNum != 3 || v.Primary != s2 || v.Backup != "" {
+		t.Fatalf("after primary left, got view %+v", v)
+	}
+
+	// A leaving backup frees its slot just as promptly.
+	h.ping(s2, 3)
+	h.ping(s3, 0)
+	h.advance(PingInterval)
+	h.ping(s2, 4) // ack view with s3 as backup
+	h.leave(s3)
+	if v := h.view(); v.ViewNum != 5 || v.Primary != s2 || v.Backup != "" {
+		t.Fatalf("after backup left, got view %+v", v)
+	}
+}
+
+// TestLeaveRespectsAck checks that a Leave from the primary of an
+// unacked view does not shortcut the ack protocol: the view holds
+// until the primary acks, exactly as a timeout death would.
+func TestLeaveRespectsAck(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1) // ack view 1
+	h.ping(s2, 0)
+	h.advance(PingInterval) // view 2, s1 primary, s2 backup — unacked
+
+	h.leave(s1)
+	h.advance(PingInterval)
+	if v := h.view(); v.ViewNum != 2 || v.Primary != s1 {
+		t.Fatalf("promotion jumped an unacked view: %+v", v)
+	}
+}
+
+// TestDataLossPromotionMarksStateAuthoritative checks the promoted
+// server is told its (empty) contents are now the dataset: without
+// the flag it would wait forever for a state transfer nobody can
+// send.
+func TestDataLossPromotionMarksStateAuthoritative(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1)
+
+	// An ordinary primary never sees the flag.
+	var reply PingReply
+	if err := h.vs.Ping(&PingArgs{Me: s1, ViewNum: 1}, &reply); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if reply.StateAuthoritative {
+		t.Fatal("bootstrap primary's ping reply claims StateAuthoritative")
+	}
+
+	h.pingUntilDead(map[string]uint{}) // s1 dies alone
+	h.ping(s2, 0)
+	h.vs.checkFailuresAndPromote()
+	if v := h.view(); v.Primary != s2 {
+		t.Fatalf("view after data-loss promotion = %+v, want s2 primary", v)
+	}
+
+	reply = PingReply{}
+	if err := h.vs.Ping(&PingArgs{Me: s2, ViewNum: 2}, &reply); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if !reply.StateAuthoritative {
+		t.Fatal("loss-promoted primary's ping reply lacks StateAuthoritative")
+	}
+}
+
+// TestRestartedPrimaryWithNoBackupRecovers covers a primary that
+// reboots with no backup to hand over to: the old code installed a
+// primary-less view nobody could ever ack, wedging the shard. The
+// slot must instead be refilled through the data-loss path — usually
+// with the restarted server itself, told its empty state is now
+// authoritative.
+func TestRestartedPrimaryWithNoBackupRecovers(t *testing.T) {
+	h := newHarness(t)
+	h.ping(s1, 0)
+	h.ping(s1, 1) // acked; never gets a backup
+
+	if v := h.ping(s1, 0); v.Primary != "" || v.ViewNum != 2 {
+		t.Fatalf("after restart, got view %+v, want the slot emptied in view 2", v)
+	}
+	h.advance(PingInterval)
+
+	v := h.view()
+	if v.ViewNum != 3 || v.Primary != s1 {
+		t.Fatalf("restarted server not reinstalled: %+v", v)
+	}
+	var reply PingReply
+	if err := h.vs.Ping(&PingArgs{Me: s1, ViewNum: 3}, &reply); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if !reply.StateAuthoritative {
+		t.Fatal("reinstalled primary's ping reply lacks StateAuthoritative")
+	}
+}